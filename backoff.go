@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/annotations"
+)
+
+const (
+	retryAnnotation      = annotations.Retry
+	syncFailedAnnotation = annotations.SyncFailed
+)
+
+const (
+	// defaultSyncBackoffBase is how long a Node waits before it is retried after its first failed sync,
+	// the wait doubles with every failure in a row, up to defaultSyncBackoffMax
+	defaultSyncBackoffBase = 5 * time.Second
+	defaultSyncBackoffMax  = 5 * time.Minute
+	// defaultMaxSyncAttempts is how many syncs in a row can fail before the controller gives up on a Node
+	defaultMaxSyncAttempts = 10
+)
+
+// nodeFailures counts the syncs in a row that failed, by Node
+type nodeFailures struct {
+	lock     sync.Mutex
+	attempts map[string]int
+}
+
+// add counts a failed sync of the Node, and returns how many failed in a row
+func (f *nodeFailures) add(key string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.attempts[key]++
+	return f.attempts[key]
+}
+
+// reset forgets the failed syncs of the Node, after a successful one
+func (f *nodeFailures) reset(key string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.attempts, key)
+}
+
+// syncBackoff returns how long a Node waits after its attempts-th failed sync in a row
+func (c *NodeController) syncBackoff(attempts int) time.Duration {
+	backoff := c.syncBackoffBase
+	for i := 1; i < attempts && backoff < c.syncBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > c.syncBackoffMax {
+		return c.syncBackoffMax
+	}
+	return backoff
+}
+
+// clearSyncFailure resets the backoff of a Node, and removes its syncFailedAnnotation and retryAnnotation,
+// so that the Node is synced again
+func (c *NodeController) clearSyncFailure(node *corev1.Node) error {
+	c.failures.reset(node.Name)
+	if err := c.removeAnnotationFromNode(node.Name, syncFailedAnnotation); err != nil {
+		return err
+	}
+	return c.removeAnnotationFromNode(node.Name, retryAnnotation)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// defaultBatchConcurrency is how many operations the batch sync runs at the same time
+const defaultBatchConcurrency = 10
+
+// batchDiff is what the batch sync has to do to converge the cluster
+type batchDiff struct {
+	// assign are the Nodes that have no Public IP, or whose Public IP is not attached to their NIC
+	assign []*corev1.Node
+	// orphaned are the Nodes that no longer exist but still have a Public IP
+	orphaned []string
+	// detached are the Nodes in assign whose Public IP exists, but is detached, by name
+	detached map[string]bool
+}
+
+// batchSync lists all the Nodes, NICs and Public IPs of the cluster once, and applies the difference
+// with up to batchConcurrency operations at the same time. The workers keep syncing single Nodes as they change,
+// Nodes that have an operation in flight or whose slots are taken are left to them
+func (c *NodeController) batchSync(ctx context.Context) {
+	nodes, err := c.nodesLister.List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("batch sync: cannot list Nodes: %s", err.Error()))
+		return
+	}
+	ips, err := c.ipUpdater.ListPublicIPs(ctx)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("batch sync: cannot list Public IPs: %s", err.Error()))
+		return
+	}
+	nics, err := c.ipUpdater.ListNetworkInterfaces(ctx)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("batch sync: cannot list network interfaces: %s", err.Error()))
+		return
+	}
+
+	diff := computeBatchDiff(nodes, ips, nics)
+	c.log.Infof("Batch sync of %d Nodes: %d need a Public IP (%d detached), %d orphaned Public IPs",
+		len(nodes), len(diff.assign), len(diff.detached), len(diff.orphaned))
+
+	var tasks []func()
+	for _, node := range diff.assign {
+		node := node
+		tasks = append(tasks, func() {
+			err := c.assignPublicIP(ctx, node, diff.detached[node.Name])
+			if err == errConcurrencyLimited {
+				// the Node is busy, the workers or the next batch sync will take care of it
+				return
+			}
+			batchSyncOperations.WithLabelValues(c.clusterName, operationCreate).Inc()
+			if err != nil {
+				runtime.HandleError(fmt.Errorf("batch sync: cannot assign Public IP to Node %s: %s", node.Name, err.Error()))
+			}
+		})
+	}
+	for _, nodeName := range diff.orphaned {
+		nodeName := nodeName
+		tasks = append(tasks, func() {
+			err := c.syncDeletedNode(ctx, nodeName)
+			if err == errConcurrencyLimited {
+				// the Node is busy, the workers or the next batch sync will take care of it
+				return
+			}
+			batchSyncOperations.WithLabelValues(c.clusterName, operationDelete).Inc()
+			if err != nil {
+				runtime.HandleError(fmt.Errorf("batch sync: cannot delete Public IP of Node %s: %s", nodeName, err.Error()))
+			}
+		})
+	}
+	c.runBounded(tasks)
+}
+
+// computeBatchDiff compares the Nodes with their NICs and Public IPs.
+// Nodes being released, Nodes the controller gave up on, Nodes with a bring-your-own Public IP, and Nodes whose VM
+// has no NIC in the list, e.g. scale set instances, are left alone
+func computeBatchDiff(nodes []*corev1.Node, ips []helpers.PublicIP, nics []helpers.NetworkInterface) batchDiff {
+	nicsByVM := make(map[string]helpers.NetworkInterface)
+	for _, nic := range nics {
+		nicsByVM[nic.VMName] = nic
+	}
+	// the primary Public IP of each Node, and every Node with a primary or secondary Public IP
+	ipsByNode := make(map[string]helpers.PublicIP)
+	withIPs := make(map[string]bool)
+	for _, ip := range ips {
+		nodeName := helpers.GetNodeNameFromPublicIPName(ip.Name)
+		withIPs[nodeName] = true
+		if helpers.GetPublicIPIndex(ip.Name) == 0 {
+			ipsByNode[nodeName] = ip
+		}
+	}
+
+	diff := batchDiff{detached: make(map[string]bool)}
+	existing := make(map[string]bool)
+	for _, node := range nodes {
+		existing[node.Name] = true
+		if _, ok := node.Annotations[releaseAnnotation]; ok {
+			continue
+		}
+		if _, ok := node.Annotations[syncFailedAnnotation]; ok {
+			// until an operator retries it
+			continue
+		}
+		if _, ok := node.Annotations[publicIPIDAnnotation]; ok {
+			// bring-your-own Public IPs are left to the per-Node sync
+			continue
+		}
+		nic, ok := nicsByVM[node.Name]
+		if !ok {
+			continue
+		}
+		ip, ok := ipsByNode[node.Name]
+		if !ok {
+			diff.assign = append(diff.assign, node)
+		} else if !strings.HasPrefix(strings.ToLower(ip.IPConfigurationID), strings.ToLower(nic.ID)+"/") {
+			diff.assign = append(diff.assign, node)
+			diff.detached[node.Name] = true
+		}
+	}
+	for nodeName := range withIPs {
+		if !existing[nodeName] {
+			diff.orphaned = append(diff.orphaned, nodeName)
+		}
+	}
+	return diff
+}
+
+// runBounded runs the tasks with up to batchConcurrency of them at the same time, and returns once the started ones
+// have completed. It stops starting tasks once the controller is shutting down
+func (c *NodeController) runBounded(tasks []func()) {
+	limit := c.batchConcurrency
+	if limit < 1 {
+		limit = 1
+	}
+	slots := make(chan struct{}, limit)
+	var running sync.WaitGroup
+	for _, task := range tasks {
+		slots <- struct{}{}
+		if c.workqueue.ShuttingDown() {
+			<-slots
+			break
+		}
+		running.Add(1)
+		go func(task func()) {
+			defer func() {
+				<-slots
+				running.Done()
+			}()
+			task()
+		}(task)
+	}
+	running.Wait()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/annotations"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const publicIPIDAnnotation = annotations.PublicIPID
+
+// byoIPState keeps the bring-your-own Public IPs the controller has seen, by Node, so that they are detached
+// instead of deleted once their Node is gone
+type byoIPState struct {
+	lock  sync.Mutex
+	ipIDs map[string]string
+	// saved are the Public IPs that are in the byoIPStore, by Node
+	saved map[string]string
+}
+
+func (s *byoIPState) set(nodeName, ipID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ipIDs[nodeName] = ipID
+}
+
+func (s *byoIPState) get(nodeName string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ipID, ok := s.ipIDs[nodeName]
+	return ipID, ok
+}
+
+func (s *byoIPState) remove(nodeName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.ipIDs, nodeName)
+}
+
+// isSaved returns whether the Node's Public IP is in the byoIPStore already
+func (s *byoIPState) isSaved(nodeName, ipID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	saved, ok := s.saved[nodeName]
+	return ok && saved == ipID
+}
+
+func (s *byoIPState) setSaved(nodeName, ipID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ipID == "" {
+		delete(s.saved, nodeName)
+		return
+	}
+	s.saved[nodeName] = ipID
+}
+
+// byoIPEntry is the bring-your-own Public IP of a Node
+type byoIPEntry struct {
+	Cluster    string `json:"cluster"`
+	Node       string `json:"node"`
+	PublicIPID string `json:"publicIPID"`
+}
+
+// byoIPStore keeps the bring-your-own Public IPs of all clusters in a ConfigMap, next to the leader election lock,
+// so that the Public IPs of the Nodes deleted while no controller was running are still detached, not deleted
+type byoIPStore struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	name       string
+}
+
+// newBYOIPStore returns a store kept in the designated ConfigMap, which is created when needed
+func newBYOIPStore(kubeClient kubernetes.Interface, namespace, name string) *byoIPStore {
+	return &byoIPStore{kubeClient: kubeClient, namespace: namespace, name: name}
+}
+
+// update applies change to the ConfigMap's data, creating the ConfigMap when needed
+func (s *byoIPStore) update(change func(data map[string]string) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := s.kubeClient.CoreV1().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+		create := errors.IsNotFound(err)
+		if create {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace}}
+		} else if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		if err := change(cm.Data); err != nil {
+			return err
+		}
+		if create {
+			_, err = s.kubeClient.CoreV1().ConfigMaps(s.namespace).Create(cm)
+		} else {
+			_, err = s.kubeClient.CoreV1().ConfigMaps(s.namespace).Update(cm)
+		}
+		return err
+	})
+}
+
+// set records the Node's Public IP, replacing any previous one
+func (s *byoIPStore) set(cluster, nodeName, ipID string) error {
+	value, err := json.Marshal(byoIPEntry{Cluster: cluster, Node: nodeName, PublicIPID: ipID})
+	if err != nil {
+		return err
+	}
+	return s.update(func(data map[string]string) error {
+		data[journalKey(cluster, nodeName)] = string(value)
+		return nil
+	})
+}
+
+// remove forgets the Node's Public IP
+func (s *byoIPStore) remove(cluster, nodeName string) error {
+	return s.update(func(data map[string]string) error {
+		delete(data, journalKey(cluster, nodeName))
+		return nil
+	})
+}
+
+// list returns the Public IPs of the designated cluster's Nodes, by Node
+func (s *byoIPStore) list(cluster string) (map[string]string, error) {
+	cm, err := s.kubeClient.CoreV1().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ipIDs := make(map[string]string)
+	for key, value := range cm.Data {
+		var e byoIPEntry
+		if err := json.Unmarshal([]byte(value), &e); err != nil {
+			runtime.HandleError(fmt.Errorf("ignoring invalid bring-your-own Public IP entry %s: %s", key, err.Error()))
+			continue
+		}
+		if e.Cluster == cluster {
+			ipIDs[e.Node] = e.PublicIPID
+		}
+	}
+	return ipIDs, nil
+}
+
+// saveBYOIP keeps the Node's bring-your-own Public IP, in the byoIPStore too if it is not there yet
+func (c *NodeController) saveBYOIP(nodeName, ipID string) error {
+	c.byoIPs.set(nodeName, ipID)
+	if c.byoIPStore == nil || c.byoIPs.isSaved(nodeName, ipID) {
+		return nil
+	}
+	if err := c.byoIPStore.set(c.clusterName, nodeName, ipID); err != nil {
+		return fmt.Errorf("cannot save the bring-your-own Public IP of Node %s: %s", nodeName, err.Error())
+	}
+	c.byoIPs.setSaved(nodeName, ipID)
+	return nil
+}
+
+// forgetBYOIP forgets the Node's bring-your-own Public IP, once it has been detached
+func (c *NodeController) forgetBYOIP(nodeName string) error {
+	c.byoIPs.remove(nodeName)
+	if c.byoIPStore == nil {
+		return nil
+	}
+	if err := c.byoIPStore.remove(c.clusterName, nodeName); err != nil {
+		return fmt.Errorf("cannot forget the bring-your-own Public IP of Node %s: %s", nodeName, err.Error())
+	}
+	c.byoIPs.setSaved(nodeName, "")
+	return nil
+}
+
+// loadBYOIPs reads the bring-your-own Public IPs that were saved by the previous leaders.
+// The ones the informer has seen since are kept, since the Nodes' annotations are more recent
+func (c *NodeController) loadBYOIPs() {
+	if c.byoIPStore == nil {
+		return
+	}
+	ipIDs, err := c.byoIPStore.list(c.clusterName)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("cannot read the bring-your-own Public IPs: %s", err.Error()))
+		return
+	}
+	for nodeName, ipID := range ipIDs {
+		c.byoIPs.setSaved(nodeName, ipID)
+		if _, ok := c.byoIPs.get(nodeName); !ok {
+			c.byoIPs.set(nodeName, ipID)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	informers "k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+// command is a one-off operation, run with <binary> [flags] <command> [args] instead of the controller.
+// Commands use the same flags, credentials and clusters as the controller
+type command struct {
+	usage       string
+	description string
+	run         func(ctx context.Context, clusters []*cluster, args []string) error
+}
+
+var commands = map[string]command{
+	"list":    {"list", "list the Nodes and their Public IPs", listCommand},
+	"assign":  {"assign <node>", "create the Public IP of a Node and attach it", assignCommand},
+	"release": {"release <node>", "detach the Public IP of a Node and delete it", releaseCommand},
+	"gc":      {"gc [-delete]", "list the Public IPs whose Node does not exist anymore, -delete deletes them", gcCommand},
+	"gc-nics": {"gc-nics [-delete]", "list the NICs whose VM does not exist anymore, -delete deletes them", gcNICsCommand},
+	"audit":   {"audit", "report the differences between the Nodes and their Public IPs in Azure", auditCommand},
+}
+
+// errUsage is returned by a command that was called with the wrong arguments
+var errUsage = errors.New("invalid arguments")
+
+// runCommand runs the designated command and returns the process exit code.
+// The command's Azure calls are cancelled when ctx is
+func runCommand(ctx context.Context, clusters []*cluster, args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", args[0])
+		flag.Usage()
+		return 2
+	}
+	if err := cmd.run(ctx, clusters, args[1:]); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: %s [flags] %s\n", os.Args[0], cmd.usage)
+			return 2
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+// commandCluster is a cluster with a synced Node cache and its Public IPs, for the commands to work on
+type commandCluster struct {
+	*cluster
+	controller *NodeController
+	nodes      []*corev1.Node
+	// publicIPs are the Public IPs the controller has created, by Node name
+	publicIPs map[string]helpers.PublicIP
+}
+
+// loadClusters syncs the Node caches and lists the Public IPs of all clusters.
+// The caches stop when stopCh is closed
+func loadClusters(ctx context.Context, clusters []*cluster, stopCh <-chan struct{}) ([]*commandCluster, error) {
+	var loaded []*commandCluster
+	for _, cl := range clusters {
+		sharedInformers := informers.NewSharedInformerFactory(cl.kubeClient, 0)
+		controller := newClusterController(cl, sharedInformers)
+		sharedInformers.Start(stopCh)
+		if !cache.WaitForCacheSync(stopCh, controller.nodesSynced) {
+			return nil, fmt.Errorf("failed to wait for the Node cache of cluster %s to sync", cl.name)
+		}
+
+		nodes, err := controller.nodesLister.List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("cannot list Nodes of cluster %s: %s", cl.name, err.Error())
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+		ips, err := controller.ipUpdater.ListPublicIPs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list Public IPs of cluster %s: %s", cl.name, err.Error())
+		}
+		publicIPs := make(map[string]helpers.PublicIP)
+		for _, ip := range ips {
+			publicIPs[helpers.GetNodeNameFromPublicIPName(ip.Name)] = ip
+		}
+
+		loaded = append(loaded, &commandCluster{cluster: cl, controller: controller, nodes: nodes, publicIPs: publicIPs})
+	}
+	return loaded, nil
+}
+
+// orphans returns the names of the Nodes that have a Public IP but do not exist anymore, sorted
+func (cc *commandCluster) orphans() []string {
+	existing := make(map[string]bool)
+	for _, node := range cc.nodes {
+		existing[node.Name] = true
+	}
+	var orphans []string
+	for nodeName := range cc.publicIPs {
+		if !existing[nodeName] {
+			orphans = append(orphans, nodeName)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+// findNode returns the cluster the designated Node belongs to
+func findNode(clusters []*commandCluster, nodeName string) (*commandCluster, error) {
+	for _, cc := range clusters {
+		if _, err := cc.controller.nodesLister.Get(nodeName); err == nil {
+			return cc, nil
+		}
+	}
+	return nil, fmt.Errorf("Node %s not found", nodeName)
+}
+
+func getExternalIP(node *corev1.Node) string {
+	for _, x := range node.Status.Addresses {
+		if x.Type == corev1.NodeExternalIP {
+			return x.Address
+		}
+	}
+	return ""
+}
+
+func listCommand(ctx context.Context, clusters []*cluster, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	loaded, err := loadClusters(ctx, clusters, stopCh)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tNODE\tPUBLIC IP\tADDRESS\tATTACHED\tFQDN")
+	for _, cc := range loaded {
+		for _, node := range cc.nodes {
+			ip, ok := cc.publicIPs[node.Name]
+			if !ok {
+				fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\n", cc.name, node.Name)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\n", cc.name, node.Name, ip.Name, orDash(ip.Address), ip.IPConfigurationID != "", orDash(ip.FQDN))
+		}
+	}
+	return w.Flush()
+}
+
+func assignCommand(ctx context.Context, clusters []*cluster, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	nodeName := args[0]
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	loaded, err := loadClusters(ctx, clusters, stopCh)
+	if err != nil {
+		return err
+	}
+	cc, err := findNode(loaded, nodeName)
+	if err != nil {
+		return err
+	}
+
+	// this is exactly what the controller does for a new Node
+	if err := cc.controller.syncHandler(ctx, nodeName); err != nil {
+		return err
+	}
+	if dryRunPlan != nil {
+		return nil
+	}
+	ip, err := cc.controller.ipUpdater.GetPublicIP(ctx, helpers.GetPublicIPName(nodeName))
+	if err != nil {
+		return err
+	}
+	if ip == nil || ip.IPConfigurationID == "" {
+		return fmt.Errorf("Public IP was not assigned to Node %s, check the Node's Events", nodeName)
+	}
+	fmt.Printf("Public IP %s (%s) assigned to Node %s\n", ip.Name, ip.Address, nodeName)
+	return nil
+}
+
+func releaseCommand(ctx context.Context, clusters []*cluster, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	nodeName := args[0]
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	loaded, err := loadClusters(ctx, clusters, stopCh)
+	if err != nil {
+		return err
+	}
+	// the Node may already be gone, in which case its Public IP is an orphan of the first cluster
+	cc, err := findNode(loaded, nodeName)
+	if err != nil {
+		cc = loaded[0]
+	}
+
+	if err := cc.controller.deletePublicIPForNode(ctx, nodeName); err != nil {
+		return err
+	}
+	if _, err := cc.controller.nodesLister.Get(nodeName); err == nil {
+		if err := cc.controller.removeLabelFromNode(nodeName); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Public IP of Node %s released\n", nodeName)
+	return nil
+}
+
+func gcCommand(ctx context.Context, clusters []*cluster, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	deleteOrphans := flags.Bool("delete", false, "delete the orphaned Public IPs")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	loaded, err := loadClusters(ctx, clusters, stopCh)
+	if err != nil {
+		return err
+	}
+
+	for _, cc := range loaded {
+		for _, nodeName := range cc.orphans() {
+			ip := cc.publicIPs[nodeName]
+			fmt.Printf("%s\t%s\t%s\n", cc.name, ip.Name, orDash(ip.Address))
+			if *deleteOrphans {
+				deleted, err := cc.controller.vmDeleted(ctx, nodeName)
+				if err != nil {
+					return err
+				}
+				if !deleted {
+					fmt.Printf("%s\t%s\tkept, the VM of Node %s still exists\n", cc.name, ip.Name, nodeName)
+					continue
+				}
+				if err := cc.controller.deletePublicIPForNode(ctx, nodeName); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// gcNICsCommand lists, and with -delete deletes, the NICs AKS created for VMs that do not exist anymore.
+// The controller never deletes NICs itself, and a NIC is only deleted if it is not attached to a VM, has no Public IP,
+// and the VM it was named after does not exist
+func gcNICsCommand(ctx context.Context, clusters []*cluster, args []string) error {
+	flags := flag.NewFlagSet("gc-nics", flag.ContinueOnError)
+	deleteOrphans := flags.Bool("delete", false, "delete the orphaned NICs")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	loaded, err := loadClusters(ctx, clusters, stopCh)
+	if err != nil {
+		return err
+	}
+
+	for _, cc := range loaded {
+		nics, err := cc.controller.ipUpdater.ListOrphanedNetworkInterfaces(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot list orphaned NICs of cluster %s: %s", cc.name, err.Error())
+		}
+		for _, nic := range nics {
+			if _, err := cc.controller.nodesLister.Get(nic.VMName); err == nil {
+				// ARM and the cluster disagree, leave it alone
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\n", cc.name, nic.Name, nic.VMName)
+			if *deleteOrphans {
+				if err := cc.controller.ipUpdater.DeleteOrphanedNetworkInterface(ctx, nic.Name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func auditCommand(ctx context.Context, clusters []*cluster, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	loaded, err := loadClusters(ctx, clusters, stopCh)
+	if err != nil {
+		return err
+	}
+
+	var differences int
+	report := func(cc *commandCluster, format string, a ...interface{}) {
+		differences++
+		fmt.Printf("%s\t%s\n", cc.name, fmt.Sprintf(format, a...))
+	}
+	for _, cc := range loaded {
+		for _, node := range cc.nodes {
+			ip, hasIP := cc.publicIPs[node.Name]
+			labeled := node.Labels[hasPublicIPLabel] == "true"
+			externalIP := getExternalIP(node)
+			switch {
+			case !hasIP:
+				report(cc, "Node %s has no Public IP in Azure", node.Name)
+			case ip.IPConfigurationID == "":
+				report(cc, "Public IP %s of Node %s is not attached", ip.Name, node.Name)
+			case externalIP != "" && ip.Address != "" && externalIP != ip.Address:
+				report(cc, "Node %s reports external IP %s, but its Public IP %s has address %s", node.Name, externalIP, ip.Name, ip.Address)
+			}
+			if labeled && !hasIP {
+				report(cc, "Node %s is labeled HasPublicIP but has no Public IP", node.Name)
+			}
+			if !labeled && hasIP && ip.IPConfigurationID != "" {
+				report(cc, "Node %s has an attached Public IP but is not labeled HasPublicIP", node.Name)
+			}
+		}
+		for _, nodeName := range cc.orphans() {
+			report(cc, "Public IP %s has no Node", cc.publicIPs[nodeName].Name)
+		}
+	}
+
+	if differences > 0 {
+		return fmt.Errorf("%d differences found", differences)
+	}
+	fmt.Println("No differences found")
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [command]\n\nWithout a command, the controller runs. Commands:\n", os.Args[0])
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %-16s %s\n", commands[name].usage, commands[name].description)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+		flag.PrintDefaults()
+	}
+}
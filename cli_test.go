@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/fakearm"
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+func TestCommands(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+
+	assigned, unassigned, gone := "aks-nodepool1-26427378-0", "aks-nodepool1-26427378-1", "aks-nodepool1-26427378-2"
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, unassigned)
+	ipUpdater := newFakeARMIPUpdate(server)
+	for _, nodeName := range []string{assigned, gone} {
+		server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, nodeName)
+		if _, err := ipUpdater.CreateOrUpdateVMPulicIP(context.Background(), nodeName, helpers.GetPublicIPName(nodeName), ""); err != nil {
+			t.Fatalf("error creating Public IP: %v", err)
+		}
+	}
+
+	kubeClient := k8sfake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: assigned, Labels: map[string]string{"HasPublicIP": "true"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: unassigned}},
+	)
+	clusters := []*cluster{{name: "test", kubeClient: kubeClient, ipUpdater: ipUpdater}}
+	// the gone Node was scaled in, AKS has not deleted its NIC yet
+	server.Delete(fakearm.VirtualMachineID(testSubscription, testResourceGroup, gone))
+
+	// the unassigned Node and the Public IP of the gone Node
+	err := auditCommand(context.Background(), clusters, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "2 differences") {
+		t.Fatalf("expected 2 differences, got %v", err)
+	}
+
+	if err := gcCommand(context.Background(), clusters, []string{"-delete"}); err != nil {
+		t.Fatalf("error running gc: %v", err)
+	}
+	if server.Get(fakearm.PublicIPID(testSubscription, testResourceGroup, helpers.GetPublicIPName(gone))) != nil {
+		t.Errorf("orphaned Public IP was not deleted")
+	}
+
+	// only the NIC of the scaled in VM is an orphan
+	if err := gcNICsCommand(context.Background(), clusters, []string{"-delete"}); err != nil {
+		t.Fatalf("error running gc-nics: %v", err)
+	}
+	for _, nodeName := range []string{assigned, unassigned, gone} {
+		nic := server.Get(fakearm.NetworkInterfaceID(testSubscription, testResourceGroup, nodeName+"-nic"))
+		if (nic == nil) != (nodeName == gone) {
+			t.Errorf("unexpected NIC of Node %s after gc-nics: %v", nodeName, nic)
+		}
+	}
+
+	if err := assignCommand(context.Background(), clusters, []string{unassigned}); err != nil {
+		t.Fatalf("error running assign: %v", err)
+	}
+	if err := auditCommand(context.Background(), clusters, nil); err != nil {
+		t.Errorf("expected no differences, got %v", err)
+	}
+
+	if err := releaseCommand(context.Background(), clusters, []string{assigned}); err != nil {
+		t.Fatalf("error running release: %v", err)
+	}
+	if server.Get(fakearm.PublicIPID(testSubscription, testResourceGroup, helpers.GetPublicIPName(assigned))) != nil {
+		t.Errorf("released Public IP was not deleted")
+	}
+	node, err := kubeClient.CoreV1().Nodes().Get(assigned, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if _, ok := node.Labels["HasPublicIP"]; ok {
+		t.Errorf("released Node is still labeled")
+	}
+
+	if err := assignCommand(context.Background(), clusters, nil); err != errUsage {
+		t.Errorf("expected a usage error, got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+// kubectl-nodeip is a kubectl plugin that shows the Public IPs the controller manages and asks it to retry or release them.
+// Install it anywhere in the PATH and run it as `kubectl nodeip`
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/annotations"
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+var (
+	kubeconfig  string
+	kubecontext string
+	azureConfig string
+)
+
+const usage = `usage: kubectl nodeip [flags] [command]
+
+Commands:
+  list              show the Nodes and their Public IPs (default)
+  retry <node>      make the controller reconcile the Node again, also after it has given up on it
+  release <node>    make the controller detach and delete the Node's Public IP, and not assign a new one
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	kubeClient, err := getKubeClient()
+	if err != nil {
+		log.Fatalf("cannot create Kubernetes client: %s", err.Error())
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		err = list(kubeClient)
+	case args[0] == "retry" && len(args) == 2:
+		err = annotate(kubeClient, args[1], annotations.Retry, time.Now().UTC().Format(time.RFC3339))
+	case args[0] == "release" && len(args) == 2:
+		err = annotate(kubeClient, args[1], annotations.Release, "true")
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// getKubeClient uses the same kubeconfig as kubectl, unless --kubeconfig is set
+func getKubeClient() (kubernetes.Interface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: kubecontext}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// getPublicIPs returns the Public IPs of the cluster by Node name, using the same credentials as the controller
+func getPublicIPs() (map[string]helpers.PublicIP, error) {
+	var sp *helpers.ServicePrincipalDetails
+	var err error
+	if azureConfig != "" {
+		sp, err = helpers.LoadServicePrincipalDetails(azureConfig)
+	} else {
+		sp, err = helpers.InitializeServicePrincipalDetails()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := helpers.NewIPUpdate(sp, log.WithField("cluster", sp.ResourceGroup)).ListPublicIPs(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	publicIPs := make(map[string]helpers.PublicIP)
+	for _, ip := range ips {
+		publicIPs[helpers.GetNodeNameFromPublicIPName(ip.Name)] = ip
+	}
+	return publicIPs, nil
+}
+
+// getLastErrors returns the message of the latest Warning Event of each Node
+func getLastErrors(kubeClient kubernetes.Interface) (map[string]string, error) {
+	events, err := kubeClient.CoreV1().Events("").List(metav1.ListOptions{FieldSelector: "involvedObject.kind=Node,type=Warning"})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(events.Items, func(i, j int) bool {
+		return events.Items[i].LastTimestamp.Before(&events.Items[j].LastTimestamp)
+	})
+	lastErrors := make(map[string]string)
+	for _, e := range events.Items {
+		lastErrors[e.InvolvedObject.Name] = e.Reason + ": " + e.Message
+	}
+	return lastErrors, nil
+}
+
+func list(kubeClient kubernetes.Interface) error {
+	nodes, err := kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	sort.Slice(nodes.Items, func(i, j int) bool { return nodes.Items[i].Name < nodes.Items[j].Name })
+
+	// without Azure credentials, the table only shows what the Nodes know
+	publicIPs, err := getPublicIPs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot get the Public IPs from Azure: %s\n", err.Error())
+	}
+	lastErrors, err := getLastErrors(kubeClient)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot get the Node Events: %s\n", err.Error())
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tPOOL\tIP\tFQDN\tALLOCATION\tSTATE\tLAST ERROR")
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		ip, hasIP := publicIPs[node.Name]
+
+		address := ip.Address
+		if address == "" {
+			address = getExternalIP(node)
+		}
+		fqdn := node.Annotations[annotations.DNSRecord]
+		if fqdn == "" {
+			fqdn = node.Annotations[annotations.FQDN]
+		}
+		if fqdn == "" {
+			fqdn = ip.FQDN
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", node.Name, orDash(getPool(node)), orDash(address), orDash(fqdn),
+			orDash(ip.AllocationMethod), getState(node, ip, hasIP, publicIPs != nil), orDash(lastErrors[node.Name]))
+	}
+	return w.Flush()
+}
+
+// getState returns released, failed (the controller gave up on the Node), attached, detached or pending (no Public IP yet).
+// If Azure could not be read, it returns labeled or unknown, depending on the Node's HasPublicIP label
+func getState(node *corev1.Node, ip helpers.PublicIP, hasIP, azureRead bool) string {
+	if _, ok := node.Annotations[annotations.Release]; ok {
+		return "released"
+	}
+	if _, ok := node.Annotations[annotations.SyncFailed]; ok {
+		return "failed"
+	}
+	switch {
+	case !azureRead:
+		if node.Labels[annotations.HasPublicIPLabel] == "true" {
+			return "labeled"
+		}
+		return "unknown"
+	case !hasIP:
+		return "pending"
+	case ip.IPConfigurationID == "":
+		return "detached"
+	default:
+		return "attached"
+	}
+}
+
+// getPool returns the AKS agent pool of the Node
+func getPool(node *corev1.Node) string {
+	if pool := node.Labels["agentpool"]; pool != "" {
+		return pool
+	}
+	// aks-<pool>-<hash>-<index>
+	parts := strings.Split(node.Name, "-")
+	if len(parts) >= 4 && parts[0] == "aks" {
+		return strings.Join(parts[1:len(parts)-2], "-")
+	}
+	return ""
+}
+
+func getExternalIP(node *corev1.Node) string {
+	for _, x := range node.Status.Addresses {
+		if x.Type == corev1.NodeExternalIP {
+			return x.Address
+		}
+	}
+	return ""
+}
+
+// annotate sets an annotation on the Node, which makes the controller reconcile it
+func annotate(kubeClient kubernetes.Interface, nodeName, key, value string) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, key, value)
+	if _, err := kubeClient.CoreV1().Nodes().Patch(nodeName, types.MergePatchType, []byte(patch)); err != nil {
+		return err
+	}
+	fmt.Printf("node/%s annotated with %s=%s\n", nodeName, key, value)
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Defaults to the one kubectl uses.")
+	flag.StringVar(&kubecontext, "context", "", "kubeconfig context to use. Defaults to the current context.")
+	flag.StringVar(&azureConfig, "azure-config", "", "Path to an azure.json file with the cluster's Service Principal details. Defaults to the same environment variables and file the controller uses.")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// concurrencyRetryDelay is how long a Node waits in the workqueue when its node pool or subscription
+// has no free slot for another ARM operation
+const concurrencyRetryDelay = 2 * time.Second
+
+// errConcurrencyLimited is returned by the syncHandler when the Node has to wait for a free slot
+var errConcurrencyLimited = errors.New("too many concurrent ARM operations")
+
+// concurrencyLimits caps the number of ARM operations that run at the same time for the same key,
+// e.g. the same node pool or subscription
+type concurrencyLimits struct {
+	lock    sync.Mutex
+	limit   int
+	running map[string]int
+}
+
+// newConcurrencyLimits returns limits of limit operations per key, limit <= 0 means no limit
+func newConcurrencyLimits(limit int) *concurrencyLimits {
+	return &concurrencyLimits{limit: limit, running: make(map[string]int)}
+}
+
+// tryAcquire takes a slot for key and returns true, or returns false if all the slots are taken
+func (l *concurrencyLimits) tryAcquire(key string) bool {
+	if l == nil || l.limit <= 0 {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.running[key] >= l.limit {
+		return false
+	}
+	l.running[key]++
+	return true
+}
+
+// release frees a slot taken by tryAcquire
+func (l *concurrencyLimits) release(key string) {
+	if l == nil || l.limit <= 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.running[key]--
+	if l.running[key] <= 0 {
+		delete(l.running, key)
+	}
+}
+
+// getOperationSubscriptions returns the subscriptions the operation writes to: the VMs' subscription
+// for the NICs and the NSGs (which must live in the subscription of the NIC and of its virtual network),
+// the Public IPs' subscription and the DNS zone's subscription
+func (c *NodeController) getOperationSubscriptions(operation string) []string {
+	var subscriptionIDs []string
+	switch operation {
+	case operationCreate:
+		subscriptionIDs = []string{c.subscriptionID, c.ipSubscriptionID}
+	case operationDelete, operationRelease:
+		subscriptionIDs = []string{c.subscriptionID, c.ipSubscriptionID}
+		if c.dnsUpdater != nil {
+			subscriptionIDs = append(subscriptionIDs, c.dnsSubscriptionID)
+		}
+	case operationDNS:
+		subscriptionIDs = []string{c.dnsSubscriptionID}
+	case operationNSG:
+		subscriptionIDs = []string{c.subscriptionID}
+	}
+
+	// a subscription only gives one slot to an operation, even if it is the target of several of its writes
+	var unique []string
+	seen := make(map[string]bool)
+	for _, subscriptionID := range subscriptionIDs {
+		if subscriptionID != "" && !seen[subscriptionID] {
+			seen[subscriptionID] = true
+			unique = append(unique, subscriptionID)
+		}
+	}
+	return unique
+}
+
+// startARMOperation takes a slot in the Node's pool and in every subscription the operation writes to,
+// and marks the operation as in flight.
+// It returns errConcurrencyLimited if any of them is full, or if another operation is in flight for the Node,
+// e.g. started by the batch sync. Otherwise the returned function frees the slots and, unless ctx has been cancelled,
+// marks the operation as finished. Cancelled operations stay in flight, so that they are recorded to the journal
+func (c *NodeController) startARMOperation(ctx context.Context, nodeName, operation string) (func(), error) {
+	pool, _ := getNodePoolAndIndex(nodeName)
+	poolKey := c.clusterName + "/" + pool
+	if !c.poolLimits.tryAcquire(poolKey) {
+		return nil, errConcurrencyLimited
+	}
+	var acquired []string
+	release := func() {
+		for _, subscriptionID := range acquired {
+			c.subscriptionLimits.release(subscriptionID)
+		}
+		c.poolLimits.release(poolKey)
+	}
+	for _, subscriptionID := range c.getOperationSubscriptions(operation) {
+		if !c.subscriptionLimits.tryAcquire(subscriptionID) {
+			release()
+			return nil, errConcurrencyLimited
+		}
+		acquired = append(acquired, subscriptionID)
+	}
+	if !c.inFlight.start(nodeName, operation) {
+		release()
+		return nil, errConcurrencyLimited
+	}
+	return func() {
+		if ctx.Err() == nil {
+			c.inFlight.finish(nodeName)
+		}
+		release()
+	}, nil
+}
@@ -2,7 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"text/template"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -12,6 +19,9 @@ import (
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/fakearm"
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
 )
 
 var (
@@ -37,12 +47,12 @@ func newFixture(t *testing.T) *fixture {
 	return f
 }
 
-func (f *fixture) newController(ipUpdater *MockIPUpdater) (*NodeController, kubeinformers.SharedInformerFactory) {
+func (f *fixture) newController(ipUpdater helpers.IPUpdater) (*NodeController, kubeinformers.SharedInformerFactory) {
 	f.kubeclient = k8sfake.NewSimpleClientset(f.kubeobjects...)
 
 	k8sI := kubeinformers.NewSharedInformerFactory(f.kubeclient, noResyncPeriodFunc())
 
-	c := NewNodeController(f.kubeclient, k8sI.Core().V1().Nodes(), ipUpdater)
+	c := NewNodeController("test", f.kubeclient, k8sI.Core().V1().Nodes(), ipUpdater)
 
 	c.nodesSynced = alwaysReady
 	c.recorder = &record.FakeRecorder{}
@@ -69,11 +79,23 @@ func getKey(node *corev1.Node, t *testing.T) string {
 
 type MockIPUpdater struct {
 	actions []string
+	// vmStates are the states GetVMState returns, VMs that are not in it are deleted
+	vmStates map[string]helpers.VMState
+	// quota is the Public IP quota GetPublicIPQuota returns
+	quota *helpers.PublicIPQuota
+	// createErr is the error CreateOrUpdateVMPulicIP returns
+	createErr error
 }
 
-func (m *MockIPUpdater) CreateOrUpdateVMPulicIP(ctx context.Context, vmName string, ipName string) error {
+func (m *MockIPUpdater) CreateOrUpdateVMPulicIP(ctx context.Context, vmName string, ipName string, domainNameLabel string) (string, error) {
 	m.actions = append(m.actions, "IP_CREATE")
-	return nil
+	if m.createErr != nil {
+		return "", m.createErr
+	}
+	if domainNameLabel != "" {
+		return domainNameLabel + ".westeurope.cloudapp.azure.com", nil
+	}
+	return "", nil
 }
 func (m *MockIPUpdater) DeletePublicIP(ctx context.Context, ipName string) error {
 	m.actions = append(m.actions, "IP_DELETE")
@@ -83,6 +105,81 @@ func (m *MockIPUpdater) DisassociatePublicIPForNode(ctx context.Context, nodeNam
 	m.actions = append(m.actions, "IP_DISASSOCIATE")
 	return nil
 }
+func (m *MockIPUpdater) GetPublicIP(ctx context.Context, ipName string) (*helpers.PublicIP, error) {
+	m.actions = append(m.actions, "IP_GET")
+	return nil, nil
+}
+func (m *MockIPUpdater) ListPublicIPs(ctx context.Context) ([]helpers.PublicIP, error) {
+	m.actions = append(m.actions, "IP_LIST")
+	return nil, nil
+}
+func (m *MockIPUpdater) ListNetworkInterfaces(ctx context.Context) ([]helpers.NetworkInterface, error) {
+	m.actions = append(m.actions, "NIC_LIST")
+	return nil, nil
+}
+func (m *MockIPUpdater) SetSecondaryPublicIPs(ctx context.Context, vmName string, count int) ([]helpers.PublicIP, error) {
+	m.actions = append(m.actions, fmt.Sprintf("IP_SET_SECONDARY_%d", count))
+	var ips []helpers.PublicIP
+	for i := 1; i <= count; i++ {
+		ips = append(ips, helpers.PublicIP{Name: helpers.GetSecondaryPublicIPName(vmName, i), Address: fmt.Sprintf("20.0.0.%d", i)})
+	}
+	return ips, nil
+}
+func (m *MockIPUpdater) DeleteSecondaryPublicIPs(ctx context.Context, vmName string) error {
+	m.actions = append(m.actions, "IP_DELETE_SECONDARY")
+	return nil
+}
+func (m *MockIPUpdater) AttachPublicIP(ctx context.Context, vmName string, ipID string) (string, error) {
+	m.actions = append(m.actions, "IP_ATTACH_"+ipID)
+	return "", nil
+}
+func (m *MockIPUpdater) DetachPublicIP(ctx context.Context, ipID string) error {
+	m.actions = append(m.actions, "IP_DETACH_"+ipID)
+	return nil
+}
+func (m *MockIPUpdater) GetPublicIPQuota(ctx context.Context) (*helpers.PublicIPQuota, error) {
+	return m.quota, nil
+}
+func (m *MockIPUpdater) GetVMState(ctx context.Context, vmName string) (helpers.VMState, error) {
+	if state, ok := m.vmStates[vmName]; ok {
+		return state, nil
+	}
+	return helpers.VMDeleted, nil
+}
+func (m *MockIPUpdater) ListOrphanedNetworkInterfaces(ctx context.Context) ([]helpers.NetworkInterface, error) {
+	m.actions = append(m.actions, "NIC_LIST_ORPHANED")
+	return nil, nil
+}
+func (m *MockIPUpdater) DeleteOrphanedNetworkInterface(ctx context.Context, nicName string) error {
+	m.actions = append(m.actions, "NIC_DELETE_"+nicName)
+	return nil
+}
+
+type MockDNSUpdater struct {
+	actions []string
+}
+
+func (m *MockDNSUpdater) CreateOrUpdateDNSRecord(ctx context.Context, recordName string, ipName string) (string, error) {
+	m.actions = append(m.actions, "DNS_CREATE_"+recordName)
+	return recordName + ".example.com", nil
+}
+func (m *MockDNSUpdater) DeleteDNSRecord(ctx context.Context, recordName string) error {
+	m.actions = append(m.actions, "DNS_DELETE_"+recordName)
+	return nil
+}
+
+type MockNSGUpdater struct {
+	actions []string
+}
+
+func (m *MockNSGUpdater) EnsureSecurityRules(ctx context.Context, vmName string, rules []helpers.SecurityRule) (string, error) {
+	m.actions = append(m.actions, "NSG_ENSURE_"+securityRulesToString(rules))
+	return "/subscriptions/X/resourceGroups/Y/providers/Microsoft.Network/networkSecurityGroups/nsg", nil
+}
+func (m *MockNSGUpdater) DeleteSecurityRules(ctx context.Context, nsgID string, vmName string) error {
+	m.actions = append(m.actions, "NSG_DELETE_"+nsgID+"_"+vmName)
+	return nil
+}
 
 func TestAddNode(t *testing.T) {
 
@@ -109,6 +206,194 @@ func TestDeleteNode(t *testing.T) {
 
 }
 
+func TestPublicIPDNSLabel(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-1"}}
+
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+
+	c, _ := f.newController(&MockIPUpdater{})
+	c.EnablePublicIPDNSLabel(template.Must(template.New("label").Parse("{{.Cluster}}-{{.NodePool}}-{{.NodeIndex}}")))
+
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if updated.Annotations[fqdnAnnotation] != "test-nodepool1-1.westeurope.cloudapp.azure.com" {
+		t.Errorf("unexpected FQDN annotation %q", updated.Annotations[fqdnAnnotation])
+	}
+}
+
+func TestPublicIPFQDNResync(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testNodeName)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName}}
+
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+	c, k8sI := f.newController(newFakeARMIPUpdate(server))
+	c.EnablePublicIPDNSLabel(template.Must(template.New("label").Parse("{{.NodePool}}-{{.NodeIndex}}")))
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+
+	// the annotation got lost, e.g. the Node update failed after the Public IP was created
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	delete(updated.Annotations, fqdnAnnotation)
+	updated.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeExternalIP, Address: "20.0.0.1"}}
+	if updated, err = f.kubeclient.CoreV1().Nodes().Update(updated); err != nil {
+		t.Fatalf("error updating node: %v", err)
+	}
+	k8sI.Core().V1().Nodes().Informer().GetIndexer().Update(updated)
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if updated, err = f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{}); err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if updated.Annotations[fqdnAnnotation] != "nodepool1-0.westeurope.cloudapp.azure.com" {
+		t.Errorf("unexpected FQDN annotation %q", updated.Annotations[fqdnAnnotation])
+	}
+}
+
+func TestDNSRecord(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-0"},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeExternalIP, Address: "1.2.3.4"}},
+		},
+	}
+
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+
+	c, k8sI := f.newController(&MockIPUpdater{})
+	dnsUpdater := &MockDNSUpdater{}
+	c.EnableDNS(dnsUpdater, template.Must(template.New("dns").Parse("{{.NodePool}}-{{.NodeIndex}}")))
+
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if len(dnsUpdater.actions) != 1 || dnsUpdater.actions[0] != "DNS_CREATE_nodepool1-0" {
+		t.Errorf("unexpected DNS actions %+v", dnsUpdater.actions)
+	}
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if updated.Annotations[dnsRecordAnnotation] != "nodepool1-0.example.com" || updated.Annotations[dnsRecordAddressAnnotation] != "1.2.3.4" {
+		t.Errorf("unexpected DNS annotations %v", updated.Annotations)
+	}
+
+	// the record is only written again when the Node's address changes
+	k8sI.Core().V1().Nodes().Informer().GetIndexer().Update(updated)
+	dnsUpdater.actions = nil
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if len(dnsUpdater.actions) != 0 {
+		t.Errorf("unexpected DNS actions %+v", dnsUpdater.actions)
+	}
+	updated.Status.Addresses[0].Address = "5.6.7.8"
+	k8sI.Core().V1().Nodes().Informer().GetIndexer().Update(updated)
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if len(dnsUpdater.actions) != 1 || dnsUpdater.actions[0] != "DNS_CREATE_nodepool1-0" {
+		t.Errorf("unexpected DNS actions %+v", dnsUpdater.actions)
+	}
+	if updated, err = f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{}); err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if updated.Annotations[dnsRecordAddressAnnotation] != "5.6.7.8" {
+		t.Errorf("unexpected %s annotation %q", dnsRecordAddressAnnotation, updated.Annotations[dnsRecordAddressAnnotation])
+	}
+
+	dnsUpdater.actions = nil
+	if err := c.deletePublicIPForNode(context.Background(), node.Name); err != nil {
+		t.Fatalf("error deleting IP for node: %v", err)
+	}
+	if len(dnsUpdater.actions) != 1 || dnsUpdater.actions[0] != "DNS_DELETE_nodepool1-0" {
+		t.Errorf("unexpected DNS actions %+v", dnsUpdater.actions)
+	}
+}
+
+func TestNSGRules(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "aks-nodepool1-26427378-0",
+			Annotations: map[string]string{nsgRulesAnnotation: "udp:7777"},
+		},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeExternalIP, Address: "1.2.3.4"}},
+		},
+	}
+
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+
+	c, k8sI := f.newController(&MockIPUpdater{})
+	nsgUpdater := &MockNSGUpdater{}
+	c.EnableNSG(nsgUpdater, []helpers.SecurityRule{{Protocol: "tcp", PortRange: "7000-8000"}})
+
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if len(nsgUpdater.actions) != 1 || nsgUpdater.actions[0] != "NSG_ENSURE_udp:7777" {
+		t.Errorf("unexpected NSG actions %+v", nsgUpdater.actions)
+	}
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if updated.Annotations[nsgAppliedRulesAnnotation] != "udp:7777" {
+		t.Errorf("unexpected applied rules annotation %q", updated.Annotations[nsgAppliedRulesAnnotation])
+	}
+
+	// the rules removed from the annotation should be removed from the NSG
+	updated.Annotations[nsgRulesAnnotation] = ""
+	k8sI.Core().V1().Nodes().Informer().GetIndexer().Update(updated)
+	nsgUpdater.actions = nil
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if len(nsgUpdater.actions) != 1 || nsgUpdater.actions[0] != "NSG_ENSURE_" {
+		t.Errorf("unexpected NSG actions %+v", nsgUpdater.actions)
+	}
+
+	// an invalid annotation is reported, retrying would not fix it
+	updated.Annotations[nsgRulesAnnotation] = "icmp:80"
+	k8sI.Core().V1().Nodes().Informer().GetIndexer().Update(updated)
+	nsgUpdater.actions = nil
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if len(nsgUpdater.actions) != 0 {
+		t.Errorf("unexpected NSG actions %+v", nsgUpdater.actions)
+	}
+
+	// the last Node is gone, so the rules should be removed
+	k8sI.Core().V1().Nodes().Informer().GetIndexer().Delete(node)
+	nsgUpdater.actions = nil
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if len(nsgUpdater.actions) != 1 || nsgUpdater.actions[0] != "NSG_DELETE_/subscriptions/X/resourceGroups/Y/providers/Microsoft.Network/networkSecurityGroups/nsg_" {
+		t.Errorf("unexpected NSG actions %+v", nsgUpdater.actions)
+	}
+}
+
 func (f *fixture) expectCreateIPAction() {
 	f.actions = append(f.actions, "IP_CREATE")
 }
@@ -125,7 +410,7 @@ func (f *fixture) runController(nodeName string, startInformers bool, expectErro
 		k8sI.Start(stopCh)
 	}
 
-	err := c.syncHandler(nodeName)
+	err := c.syncHandler(context.Background(), nodeName)
 	if !expectError && err != nil {
 		f.t.Errorf("error syncing node: %v", err)
 	} else if expectError && err == nil {
@@ -149,3 +434,572 @@ func (f *fixture) runController(nodeName string, startInformers bool, expectErro
 	}
 
 }
+
+func TestDryRun(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-0"}}
+
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+
+	dir, err := ioutil.TempDir("", "dryrun")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "plan.json")
+
+	ipUpdater := &MockIPUpdater{}
+	c, _ := f.newController(ipUpdater)
+	c.EnableDryRun(helpers.NewPlan(report))
+
+	// syncing twice must not record the same actions twice
+	for i := 0; i < 2; i++ {
+		if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+			t.Fatalf("error syncing node: %v", err)
+		}
+	}
+
+	for _, a := range ipUpdater.actions {
+		if a != "IP_GET" {
+			t.Errorf("unexpected IP action %s in dry-run mode", a)
+		}
+	}
+	for _, a := range f.kubeclient.Actions() {
+		if a.GetVerb() != "get" && a.GetVerb() != "list" && a.GetVerb() != "watch" {
+			t.Errorf("unexpected Kubernetes action %s in dry-run mode", a.GetVerb())
+		}
+	}
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatalf("error reading report: %v", err)
+	}
+	var plan helpers.Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		t.Fatalf("error parsing report: %v", err)
+	}
+	var actions []string
+	for _, a := range plan.Actions {
+		actions = append(actions, a.Action)
+	}
+	if strings.Join(actions, ",") != "create,attach,update" {
+		t.Errorf("unexpected planned actions %v", actions)
+	}
+}
+
+func TestReleaseAnnotation(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testNodeName)
+	ipUpdater := newFakeARMIPUpdate(server)
+	if _, err := ipUpdater.CreateOrUpdateVMPulicIP(context.Background(), testNodeName, helpers.GetPublicIPName(testNodeName), ""); err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        testNodeName,
+		Labels:      map[string]string{hasPublicIPLabel: "true"},
+		Annotations: map[string]string{releaseAnnotation: "true"},
+	}}
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+	c, _ := f.newController(ipUpdater)
+
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if server.Get(publicIPID()) != nil {
+		t.Errorf("Public IP was not released")
+	}
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if _, ok := updated.Labels[hasPublicIPLabel]; ok {
+		t.Errorf("released Node is still labeled")
+	}
+}
+
+// blockingIPUpdater blocks the creation of Public IPs till the context is cancelled
+type blockingIPUpdater struct {
+	MockIPUpdater
+	started chan struct{}
+}
+
+func (m *blockingIPUpdater) CreateOrUpdateVMPulicIP(ctx context.Context, vmName string, ipName string, domainNameLabel string) (string, error) {
+	close(m.started)
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestDrainAndResume(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName}}
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+
+	ipUpdater := &blockingIPUpdater{started: make(chan struct{})}
+	c, _ := f.newController(ipUpdater)
+	c.drainTimeout = 50 * time.Millisecond
+	kubeclient := f.kubeclient
+	c.journal = newOperationJournal(kubeclient, metav1.NamespaceDefault, "operations")
+	c.workqueue.Add(node.Name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx, 1) }()
+	<-ipUpdater.started
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("error running controller: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("controller did not stop after the drain timeout")
+	}
+
+	cm, err := kubeclient.CoreV1().ConfigMaps(metav1.NamespaceDefault).Get("operations", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting journal: %v", err)
+	}
+	var entry journalEntry
+	if err := json.Unmarshal([]byte(cm.Data[journalKey("test", node.Name)]), &entry); err != nil {
+		t.Fatalf("error decoding journal entry: %v", err)
+	}
+	if entry.Node != node.Name || entry.Operation != operationCreate {
+		t.Errorf("unexpected journal entry %+v", entry)
+	}
+
+	// the cancelled sync does not count as a failure
+	updated, err := kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if _, ok := updated.Annotations[syncFailedAnnotation]; ok {
+		t.Errorf("the Node was marked as failed during shutdown")
+	}
+	if attempts := c.failures.add(node.Name); attempts != 1 {
+		t.Errorf("expected the cancelled sync not to be counted, got %d failed syncs", attempts-1)
+	}
+
+	// the next leader enqueues the Node and removes it from the journal
+	// and resumes the operation even if the Node has been marked as failed since
+	node.Annotations = map[string]string{syncFailedAnnotation: "Other: the previous attempt failed"}
+	ipUpdater2 := &MockIPUpdater{}
+	next, _ := f.newController(ipUpdater2)
+	next.journal = c.journal
+	next.resumeOperations()
+	if next.workqueue.Len() != 1 {
+		t.Errorf("expected the Node to be enqueued, queue length is %d", next.workqueue.Len())
+	}
+	cm, err = kubeclient.CoreV1().ConfigMaps(metav1.NamespaceDefault).Get("operations", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting journal: %v", err)
+	}
+	if len(cm.Data) != 0 {
+		t.Errorf("expected an empty journal, got %v", cm.Data)
+	}
+	if err := next.syncHandler(context.Background(), node.Name); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if actions := strings.Join(ipUpdater2.actions, ","); actions != "IP_CREATE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+	updated, err = f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if _, ok := updated.Annotations[syncFailedAnnotation]; ok {
+		t.Errorf("expected the %s annotation to be removed", syncFailedAnnotation)
+	}
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	busy := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-0"}}
+	samePool := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-1"}}
+	otherPool := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool2-26427378-0"}}
+
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, busy, samePool, otherPool)
+	f.kubeobjects = append(f.kubeobjects, busy, samePool, otherPool)
+
+	ipUpdater := &MockIPUpdater{}
+	c, _ := f.newController(ipUpdater)
+	c.poolLimits = newConcurrencyLimits(1)
+	c.subscriptionLimits = newConcurrencyLimits(2)
+	c.subscriptionID = "sub"
+
+	// the busy Node takes the only slot of nodepool1
+	done, err := c.startARMOperation(context.Background(), busy.Name, operationCreate)
+	if err != nil {
+		t.Fatalf("error starting operation: %v", err)
+	}
+	if err := c.syncHandler(context.Background(), getKey(samePool, t)); err != errConcurrencyLimited {
+		t.Errorf("expected %v for a Node of the same pool, got %v", errConcurrencyLimited, err)
+	}
+	if err := c.syncHandler(context.Background(), getKey(otherPool, t)); err != nil {
+		t.Errorf("error syncing a Node of another pool: %v", err)
+	}
+	if len(ipUpdater.actions) != 1 {
+		t.Errorf("expected a single IP creation, got %+v", ipUpdater.actions)
+	}
+
+	// nodepool1 is free, but the 2 slots of the subscription are taken
+	done()
+	for _, nodeName := range []string{"aks-nodepool2-26427378-1", "aks-nodepool3-26427378-0"} {
+		if _, err := c.startARMOperation(context.Background(), nodeName, operationCreate); err != nil {
+			t.Fatalf("error starting operation: %v", err)
+		}
+	}
+	if err := c.syncHandler(context.Background(), getKey(samePool, t)); err != errConcurrencyLimited {
+		t.Errorf("expected %v with a full subscription, got %v", errConcurrencyLimited, err)
+	}
+	c.subscriptionLimits.release("sub")
+	if err := c.syncHandler(context.Background(), getKey(samePool, t)); err != nil {
+		t.Errorf("error syncing Node after a slot was freed: %v", err)
+	}
+}
+
+func TestSubscriptionLimitsByTarget(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-0"},
+		Status:     corev1.NodeStatus{Addresses: []corev1.NodeAddress{{Type: corev1.NodeExternalIP, Address: "20.0.0.1"}}},
+	}
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+
+	c, _ := f.newController(&MockIPUpdater{})
+	dnsUpdater := &MockDNSUpdater{}
+	c.EnableDNS(dnsUpdater, template.Must(template.New("dns").Parse("{{.NodeName}}")))
+	c.subscriptionLimits = newConcurrencyLimits(1)
+	c.subscriptionID, c.ipSubscriptionID, c.dnsSubscriptionID = "sub", "ipsub", "dnssub"
+
+	// a Public IP creation in another cluster of the same Public IP subscription takes its only slot
+	if !c.subscriptionLimits.tryAcquire("ipsub") {
+		t.Fatalf("expected a free slot in the Public IP subscription")
+	}
+	if _, err := c.startARMOperation(context.Background(), "aks-nodepool2-26427378-0", operationCreate); err != errConcurrencyLimited {
+		t.Errorf("expected %v with a full Public IP subscription, got %v", errConcurrencyLimited, err)
+	}
+	// the VMs' subscription slot taken before the Public IP one was full has been freed
+	if !c.subscriptionLimits.tryAcquire("sub") {
+		t.Errorf("expected the slot of the VMs' subscription to be freed")
+	}
+	c.subscriptionLimits.release("sub")
+	c.subscriptionLimits.release("ipsub")
+
+	// DNS records take a slot in the DNS zone's subscription
+	if !c.subscriptionLimits.tryAcquire("dnssub") {
+		t.Fatalf("expected a free slot in the DNS zone subscription")
+	}
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != errConcurrencyLimited {
+		t.Errorf("expected %v with a full DNS zone subscription, got %v", errConcurrencyLimited, err)
+	}
+	if len(dnsUpdater.actions) != 0 {
+		t.Errorf("unexpected DNS actions %v", dnsUpdater.actions)
+	}
+	c.subscriptionLimits.release("dnssub")
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	if len(dnsUpdater.actions) != 1 {
+		t.Errorf("unexpected DNS actions %v", dnsUpdater.actions)
+	}
+}
+
+// listingIPUpdater is a MockIPUpdater that lists the designated Public IPs and NICs
+type listingIPUpdater struct {
+	MockIPUpdater
+	ips  []helpers.PublicIP
+	nics []helpers.NetworkInterface
+}
+
+func (m *listingIPUpdater) ListPublicIPs(ctx context.Context) ([]helpers.PublicIP, error) {
+	return m.ips, nil
+}
+func (m *listingIPUpdater) ListNetworkInterfaces(ctx context.Context) ([]helpers.NetworkInterface, error) {
+	return m.nics, nil
+}
+
+func TestBatchSync(t *testing.T) {
+	nicID := func(nodeName string) string {
+		return "/subscriptions/X/resourceGroups/Y/providers/Microsoft.Network/networkInterfaces/" + nodeName + "-nic"
+	}
+	noIP := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-0"}}
+	attached := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-1"}}
+	detached := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-2"}}
+	released := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-3", Annotations: map[string]string{releaseAnnotation: ""}}}
+	noNIC := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-4"}}
+	nodes := []*corev1.Node{noIP, attached, detached, released, noNIC}
+
+	ipUpdater := &listingIPUpdater{
+		MockIPUpdater: MockIPUpdater{quota: &helpers.PublicIPQuota{Limit: 10}},
+		ips: []helpers.PublicIP{
+			{Name: helpers.GetPublicIPName(attached.Name), IPConfigurationID: nicID(attached.Name) + "/ipConfigurations/ipconfig1"},
+			{Name: helpers.GetPublicIPName(detached.Name)},
+			{Name: helpers.GetPublicIPName(released.Name)},
+			{Name: helpers.GetPublicIPName("aks-nodepool1-26427378-5")},
+		},
+	}
+	for _, node := range nodes[:4] {
+		ipUpdater.nics = append(ipUpdater.nics, helpers.NetworkInterface{Name: node.Name + "-nic", ID: nicID(node.Name), VMName: node.Name})
+	}
+
+	f := newFixture(t)
+	for _, node := range nodes {
+		f.nodesLister = append(f.nodesLister, node)
+		f.kubeobjects = append(f.kubeobjects, node)
+	}
+	c, _ := f.newController(ipUpdater)
+	// the mock is not safe for concurrent use
+	c.batchConcurrency = 1
+
+	diff := computeBatchDiff(nodes, ipUpdater.ips, ipUpdater.nics)
+	if len(diff.assign) != 2 || diff.assign[0] != noIP || diff.assign[1] != detached || len(diff.detached) != 1 || !diff.detached[detached.Name] {
+		t.Errorf("unexpected Nodes to assign %+v, %v detached", diff.assign, diff.detached)
+	}
+	if len(diff.orphaned) != 1 || diff.orphaned[0] != "aks-nodepool1-26427378-5" {
+		t.Errorf("unexpected orphaned Public IPs %v", diff.orphaned)
+	}
+
+	c.batchSync(context.Background())
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_CREATE,IP_CREATE,IP_DELETE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+	// reattaching the detached Public IP uses no more quota
+	if remaining := c.quota.quota.Remaining(); remaining != 9 {
+		t.Errorf("expected 9 remaining Public IPs, got %d", remaining)
+	}
+	if ops := c.inFlight.list(); len(ops) != 0 {
+		t.Errorf("expected no operations in flight, got %v", ops)
+	}
+
+	// Nodes with an operation in flight are left to the workers
+	ipUpdater.actions = nil
+	done, err := c.startARMOperation(context.Background(), noIP.Name, operationCreate)
+	if err != nil {
+		t.Fatalf("error starting operation: %v", err)
+	}
+	defer done()
+	c.batchSync(context.Background())
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_CREATE,IP_DELETE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+}
+
+func TestSecondaryPublicIPs(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-0", Annotations: map[string]string{publicIPCountAnnotation: "3"}},
+		Status:     corev1.NodeStatus{Addresses: []corev1.NodeAddress{{Type: corev1.NodeExternalIP, Address: "20.0.0.100"}}},
+	}
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+
+	ipUpdater := &MockIPUpdater{}
+	c, _ := f.newController(ipUpdater)
+	c.maxPublicIPsPerNode = 4
+
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_SET_SECONDARY_2" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting Node: %v", err)
+	}
+	if addresses := updated.Annotations[publicIPsAnnotation]; addresses != "20.0.0.100,20.0.0.1,20.0.0.2" {
+		t.Errorf("unexpected %s annotation %q", publicIPsAnnotation, addresses)
+	}
+
+	// the Node's secondary Public IPs are deleted with it
+	ipUpdater.actions = nil
+	if err := c.deletePublicIPForNode(context.Background(), node.Name); err != nil {
+		t.Fatalf("error deleting Public IPs: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_DELETE_SECONDARY,IP_DELETE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+
+	// a count above the cap is rejected
+	node.Annotations[publicIPCountAnnotation] = "5"
+	if _, err := c.getPublicIPCount(node); err == nil {
+		t.Error("expected an error for a count above the cap")
+	}
+}
+
+func TestBringYourOwnIP(t *testing.T) {
+	ipID := "/subscriptions/X/resourceGroups/partner/providers/Microsoft.Network/publicIPAddresses/reserved"
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-0", Annotations: map[string]string{publicIPIDAnnotation: ipID}}}
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+
+	ipUpdater := &MockIPUpdater{}
+	c, _ := f.newController(ipUpdater)
+	store := newBYOIPStore(f.kubeclient, metav1.NamespaceDefault, "byoips")
+	c.byoIPStore = store
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_ATTACH_"+ipID {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+
+	// the Public IP is only detached when the Node is gone, and the Public IP the controller may have created
+	// before the Node was annotated is deleted
+	ipUpdater.actions = nil
+	if err := c.deletePublicIPForNode(context.Background(), node.Name); err != nil {
+		t.Fatalf("error deleting Public IP: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_DETACH_"+ipID+",IP_DELETE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+	if ipIDs, err := store.list("test"); err != nil || len(ipIDs) != 0 {
+		t.Errorf("expected the detached Public IP to be forgotten, got %v and %v", ipIDs, err)
+	}
+
+	// after a restart, the Public IP is known from the deleted Node
+	restarted, _ := f.newController(ipUpdater)
+	restarted.handleObject(cache.DeletedFinalStateUnknown{Key: node.Name, Obj: node})
+	ipUpdater.actions = nil
+	if err := restarted.deletePublicIPForNode(context.Background(), node.Name); err != nil {
+		t.Fatalf("error deleting Public IP: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_DETACH_"+ipID+",IP_DELETE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+
+	// or from the store, if the Node was deleted while no controller was running
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	restarted, _ = f.newController(ipUpdater)
+	restarted.byoIPStore = store
+	restarted.loadBYOIPs()
+	ipUpdater.actions = nil
+	if err := restarted.deletePublicIPForNode(context.Background(), node.Name); err != nil {
+		t.Fatalf("error deleting Public IP: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_DETACH_"+ipID+",IP_DELETE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+
+	// the Public IPs of Nodes that were not annotated are never detached
+	restarted, _ = f.newController(ipUpdater)
+	restarted.byoIPStore = store
+	restarted.loadBYOIPs()
+	ipUpdater.actions = nil
+	if err := restarted.deletePublicIPForNode(context.Background(), "aks-nodepool1-26427378-1"); err != nil {
+		t.Fatalf("error deleting Public IP: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_DELETE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+}
+
+func TestDeletedNodeWithRunningVM(t *testing.T) {
+	f := newFixture(t)
+	nodeName := "aks-nodepool1-26427378-0"
+	ipUpdater := &MockIPUpdater{vmStates: map[string]helpers.VMState{nodeName: helpers.VMExists}}
+	c, _ := f.newController(ipUpdater)
+
+	// the Node object is gone but ARM still runs its VM, so its Public IP is kept
+	if err := c.syncHandler(context.Background(), nodeName); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	if len(ipUpdater.actions) != 0 {
+		t.Errorf("unexpected IP actions %v", ipUpdater.actions)
+	}
+
+	// once the VM is being deleted, the Public IP is deleted too
+	ipUpdater.vmStates[nodeName] = helpers.VMDeleting
+	if err := c.syncHandler(context.Background(), nodeName); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_DELETE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+}
+
+func TestPublicIPQuota(t *testing.T) {
+	node1 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-0"}}
+	node2 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "aks-nodepool1-26427378-1"}}
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node1, node2)
+	f.kubeobjects = append(f.kubeobjects, node1, node2)
+
+	ipUpdater := &MockIPUpdater{quota: &helpers.PublicIPQuota{Limit: 10, Used: 8}}
+	c, _ := f.newController(ipUpdater)
+	recorder := record.NewFakeRecorder(100)
+	c.recorder = recorder
+	c.publicIPQuotaThreshold = 1
+
+	// a failed creation does not use quota
+	ipUpdater.createErr = fmt.Errorf("internal server error")
+	if err := c.syncHandler(context.Background(), getKey(node1, t)); err == nil {
+		t.Fatalf("expected an error syncing Node")
+	}
+	if remaining := c.quota.quota.Remaining(); remaining != 2 {
+		t.Errorf("expected 2 remaining Public IPs, got %d", remaining)
+	}
+	ipUpdater.createErr = nil
+	ipUpdater.actions = nil
+
+	// 2 remaining, the first Node's Public IP leaves 1
+	if err := c.syncHandler(context.Background(), getKey(node1, t)); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_CREATE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+
+	// the second one would go below the threshold
+	ipUpdater.actions = nil
+	if err := c.syncHandler(context.Background(), getKey(node2, t)); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	if len(ipUpdater.actions) != 0 {
+		t.Errorf("unexpected IP actions %v", ipUpdater.actions)
+	}
+	expectEvent(t, recorder, publicIPQuotaLow, node2.Name)
+
+	// once quota is freed, the Node gets its Public IP at the next check
+	ipUpdater.quota = &helpers.PublicIPQuota{Limit: 10, Used: 5}
+	c.quota.checked = time.Time{}
+	if err := c.syncHandler(context.Background(), getKey(node2, t)); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	if actions := strings.Join(ipUpdater.actions, ","); actions != "IP_CREATE" {
+		t.Errorf("unexpected IP actions %s", actions)
+	}
+}
+
+func TestSyncBackoff(t *testing.T) {
+	c := &NodeController{syncBackoffBase: time.Second, syncBackoffMax: 5 * time.Second}
+	for attempts, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 30: 5 * time.Second} {
+		if backoff := c.syncBackoff(attempts); backoff != expected {
+			t.Errorf("attempt %d: expected a backoff of %s, got %s", attempts, expected, backoff)
+		}
+	}
+
+	// errors are retried with the backoff, except the ones that need an operator
+	if action := getSyncErrorAction(&helpers.ThrottledError{Kind: helpers.WriteRequest}); action != requeueSync {
+		t.Errorf("expected a throttled sync to be requeued, got %s", action)
+	}
+	if action := getSyncErrorAction(fmt.Errorf("invalid annotation")); action != requeueSync {
+		t.Errorf("expected a sync with an unclassified error to be requeued, got %s", action)
+	}
+	if action := getSyncErrorAction(&helpers.ClassifiedError{Class: helpers.ErrorQuotaExceeded}); action != waitForQuotaSync {
+		t.Errorf("expected a sync over quota to wait for quota, got %s", action)
+	}
+	if action := getSyncErrorAction(&helpers.ClassifiedError{Class: helpers.ErrorAuthFailure}); action != giveUpSync {
+		t.Errorf("expected a sync without permissions to give up, got %s", action)
+	}
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
-	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/annotations"
 	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
 
 	corev1 "k8s.io/api/core/v1"
@@ -31,11 +33,23 @@ import (
 const controllerAgentName = "nodes-controller"
 
 const (
-	successCreatingIP = "SuccessCreatingIP"
-	errorCreatingIP   = "ErrorCreatingIP"
+	successCreatingIP  = "SuccessCreatingIP"
+	errorCreatingIP    = "ErrorCreatingIP"
+	successReleasingIP = "SuccessReleasingIP"
+	errorReleasingIP   = "ErrorReleasingIP"
 )
 
-var ctx = context.Background()
+const (
+	hasPublicIPLabel  = annotations.HasPublicIPLabel
+	releaseAnnotation = annotations.Release
+)
+
+// orphanSyncPeriod is how often the controller looks for Public IPs whose Node no longer exists,
+// e.g. because the Node was deleted while the controller was not running
+const orphanSyncPeriod = 10 * time.Minute
+
+// defaultDrainTimeout is how long, by default, the controller waits for in-flight operations when it shuts down
+const defaultDrainTimeout = 30 * time.Second
 
 // NodeController is the Node Controller
 type NodeController struct {
@@ -53,35 +67,114 @@ type NodeController struct {
 	workqueue workqueue.RateLimitingInterface
 	// recorder is an event recorder for recording Event resources to the
 	// Kubernetes API.
-	recorder record.EventRecorder
+	recorder         record.EventRecorder
+	eventBroadcaster record.EventBroadcaster
 
 	ipUpdater helpers.IPUpdater
+
+	// clusterName is the name of the cluster this controller manages
+	clusterName string
+	// log is the logger of this controller, every line is labeled with the cluster name
+	log *log.Entry
+
+	// dnsUpdater, if set, keeps a DNS record for each Node's Public IP
+	dnsUpdater helpers.DNSUpdater
+	// dnsRecordTemplate generates the DNS record name for a Node
+	dnsRecordTemplate *template.Template
+	// publicIPLabelTemplate, if set, generates the DNS label of a Node's Public IP
+	publicIPLabelTemplate *template.Template
+
+	// nsgUpdater, if set, adds inbound rules for the Nodes' Public IPs to their NSGs
+	nsgUpdater      helpers.NSGUpdater
+	defaultNSGRules []helpers.SecurityRule
+	nsgs            nsgState
+
+	// byoIPs are the bring-your-own Public IPs of the Nodes with the publicIPIDAnnotation
+	byoIPs byoIPState
+
+	// plan, if set, means the controller runs in dry-run mode and records its writes there instead of making them
+	plan *helpers.Plan
+
+	// drainTimeout is how long Run waits for in-flight operations to complete after it has been asked to stop,
+	// before it cancels them
+	drainTimeout time.Duration
+	// inFlight are the operations the workers have started, by Node
+	inFlight operations
+	// poolLimits and subscriptionLimits cap the concurrent ARM operations per node pool and per subscription.
+	// subscriptionLimits is shared by the controllers of all clusters. An operation takes a slot in every
+	// subscription it writes to: subscriptionID for the VMs, the NICs and the NSGs, ipSubscriptionID for
+	// the Public IPs and dnsSubscriptionID for the DNS records
+	poolLimits         *concurrencyLimits
+	subscriptionLimits *concurrencyLimits
+	subscriptionID     string
+	ipSubscriptionID   string
+	dnsSubscriptionID  string
+	// journal, if set, keeps the operations that were abandoned at shutdown, for the next leader to resume them
+	journal *operationJournal
+	// byoIPStore, if set, keeps the bring-your-own Public IPs across restarts and changes of leader
+	byoIPStore *byoIPStore
+	resumed    resumedNodes
+	// batchSyncPeriod, if > 0, is how often the controller reconciles all the Nodes of the cluster at once,
+	// running up to batchConcurrency operations at the same time
+	batchSyncPeriod  time.Duration
+	batchConcurrency int
+	// defaultPublicIPsPerNode is the number of Public IPs of Nodes without the publicIPCountAnnotation, and
+	// maxPublicIPsPerNode caps the annotation. Secondary Public IPs are only managed when the cap is above 1
+	defaultPublicIPsPerNode int
+	maxPublicIPsPerNode     int
+	// publicIPQuotaThreshold is the Public IP quota the controller leaves free: it does not create Public IPs
+	// that would make the remaining quota go below it
+	publicIPQuotaThreshold int
+	quota                  quotaState
+	// failures are the failed syncs in a row of each Node. A Node is retried after a backoff that starts at
+	// syncBackoffBase and doubles up to syncBackoffMax, until it has failed maxSyncAttempts times (0 means no limit)
+	failures        nodeFailures
+	syncBackoffBase time.Duration
+	syncBackoffMax  time.Duration
+	maxSyncAttempts int
 }
 
 // NewNodeController returns a new sample controller
 func NewNodeController(
+	clusterName string,
 	kubeclientset kubernetes.Interface,
 	nodeInformer informercorev1.NodeInformer, ipARMUpdater helpers.IPUpdater) *NodeController {
 
+	logger := log.WithField("cluster", clusterName)
+
 	// Create event broadcaster
 	// Add sample-controller types to the default Kubernetes Scheme so Events can be
 	// logged for sample-controller types.
-	log.Info("Creating event broadcaster for Node-Public IP controller")
+	logger.Info("Creating event broadcaster for Node-Public IP controller")
 	eventBroadcaster := record.NewBroadcaster()
-	eventBroadcaster.StartLogging(log.Infof)
+	eventBroadcaster.StartLogging(logger.Infof)
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
 	controller := &NodeController{
-		kubeclientset: kubeclientset,
-		nodesLister:   nodeInformer.Lister(),
-		nodesSynced:   nodeInformer.Informer().HasSynced,
-		workqueue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Nodes"),
-		recorder:      recorder,
-		ipUpdater:     ipARMUpdater,
+		kubeclientset:    kubeclientset,
+		nodesLister:      nodeInformer.Lister(),
+		nodesSynced:      nodeInformer.Informer().HasSynced,
+		workqueue:        workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Nodes-"+clusterName),
+		recorder:         recorder,
+		eventBroadcaster: eventBroadcaster,
+		ipUpdater:        ipARMUpdater,
+		clusterName:      clusterName,
+		log:              logger,
+		drainTimeout:     defaultDrainTimeout,
+		inFlight:         operations{ops: make(map[string]string)},
+		resumed:          resumedNodes{nodes: make(map[string]bool)},
+		byoIPs:           byoIPState{ipIDs: make(map[string]string), saved: make(map[string]string)},
+		failures:         nodeFailures{attempts: make(map[string]int)},
+		syncBackoffBase:  defaultSyncBackoffBase,
+		syncBackoffMax:   defaultSyncBackoffMax,
+		maxSyncAttempts:  defaultMaxSyncAttempts,
+
+		defaultPublicIPsPerNode: 1,
+		maxPublicIPsPerNode:     1,
 	}
 
-	log.Info("Setting up event handlers for Node-Public IP controller")
+	logger.Info("Setting up event handlers for Node-Public IP controller")
 	// Set up an event handler for when Node resources change
 
 	// Set up an event handler for when Node resources change. This
@@ -108,46 +201,111 @@ func NewNodeController(
 }
 
 // Run will set up the event handlers for types we are interested in, as well
-// as syncing informer caches and starting workers. It will block until stopCh
-// is closed, at which point it will shutdown the workqueue and wait for
-// workers to finish processing their current work items.
-func (c *NodeController) Run(threadiness int, stopCh <-chan struct{}) error {
+// as syncing informer caches and starting workers. It will block until ctx
+// is cancelled, at which point it will shutdown the workqueue and wait, up to
+// drainTimeout, for workers to finish processing their current work items.
+// The operations that did not finish are recorded to the journal.
+func (c *NodeController) Run(ctx context.Context, threadiness int) error {
 	defer runtime.HandleCrash()
 	defer c.workqueue.ShutDown()
+	// a new controller is created every time leadership is acquired, this one won't be used again
+	defer c.eventBroadcaster.Shutdown()
 
 	// Start the informer factories to begin populating the informer caches
-	log.Info("Starting Node-Public IP controller")
+	c.log.Info("Starting Node-Public IP controller")
 
 	// Wait for the caches to be synced before starting workers
-	log.Info("Waiting for informer caches to sync for Node-Public IP controller")
-	if ok := cache.WaitForCacheSync(stopCh, c.nodesSynced); !ok {
+	c.log.Info("Waiting for informer caches to sync for Node-Public IP controller")
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.nodesSynced); !ok {
+		if ctx.Err() != nil {
+			// stopped before the caches synced, e.g. leadership was lost
+			return nil
+		}
 		return fmt.Errorf("failed to wait for caches to sync for Node-Public IP controller")
 	}
 
-	log.Info("Starting workers for Node-Public IP controller")
+	c.loadBYOIPs()
+	c.resumeOperations()
+
+	// ARM calls get their own context, so that they are not cancelled as soon as ctx is,
+	// but only if they don't complete within drainTimeout
+	opCtx, cancelOps := context.WithCancel(context.Background())
+	defer cancelOps()
+
+	c.log.Info("Starting workers for Node-Public IP controller")
 	// Launch workers to process Node resources
+	var workers sync.WaitGroup
 	for i := 0; i < threadiness; i++ {
-		go wait.Until(c.runWorker, time.Second, stopCh)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(func() { c.runWorker(opCtx) }, time.Second, ctx.Done())
+		}()
+	}
+	go wait.UntilWithContext(ctx, c.enqueueOrphanedPublicIPs, orphanSyncPeriod)
+	// keeps the quota metric up to date even when no Public IP is created
+	go wait.UntilWithContext(ctx, c.refreshPublicIPQuota, publicIPQuotaCheckPeriod)
+	if c.batchSyncPeriod > 0 {
+		// the batch sync runs its operations like a worker, so it is drained with them
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(func() { c.batchSync(opCtx) }, c.batchSyncPeriod, ctx.Done())
+		}()
 	}
 
-	log.Info("Started workers for Node-Public IP controller")
-	<-stopCh
-	log.Info("Shutting down workers for Node-Public IP controller")
+	c.log.Info("Started workers for Node-Public IP controller")
+	<-ctx.Done()
+	c.log.Infof("Shutting down workers for Node-Public IP controller, waiting up to %s for in-flight operations", c.drainTimeout)
+
+	// workers return as soon as they finish their current item
+	c.workqueue.ShutDown()
+	drained := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(c.drainTimeout):
+		c.log.Warnf("In-flight operations did not complete within %s, cancelling them", c.drainTimeout)
+		cancelOps()
+		<-drained
+	}
 
+	c.recordOperations()
 	return nil
 }
 
+// enqueueOrphanedPublicIPs adds to the workqueue the Nodes that have a Public IP but do not exist anymore,
+// so that the syncHandler deletes their Public IPs
+func (c *NodeController) enqueueOrphanedPublicIPs(ctx context.Context) {
+	ips, err := c.ipUpdater.ListPublicIPs(ctx)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("error listing Public IPs: %s", err.Error()))
+		return
+	}
+	for _, ip := range ips {
+		nodeName := helpers.GetNodeNameFromPublicIPName(ip.Name)
+		_, err := c.nodesLister.Get(nodeName)
+		if errors.IsNotFound(err) {
+			c.log.Infof("Public IP %s is orphaned, Node %s does not exist", ip.Name, nodeName)
+			c.workqueue.Add(nodeName)
+		}
+	}
+}
+
 // runWorker is a long-running function that will continually call the
 // processNextWorkItem function in order to read and process a message on the
 // workqueue.
-func (c *NodeController) runWorker() {
-	for c.processNextWorkItem() {
+func (c *NodeController) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
 	}
 }
 
 // processNextWorkItem will read a single work item off the workqueue and
 // attempt to process it, by calling the syncHandler.
-func (c *NodeController) processNextWorkItem() bool {
+func (c *NodeController) processNextWorkItem(ctx context.Context) bool {
 	obj, shutdown := c.workqueue.Get()
 
 	if shutdown {
@@ -180,12 +338,30 @@ func (c *NodeController) processNextWorkItem() bool {
 		}
 		// Run the syncHandler, passing it the namespace/name string of the
 		// Node resource to be synced.
-		if err := c.syncHandler(key); err != nil {
+		err := c.syncHandler(ctx, key)
+		if err == errConcurrencyLimited {
+			c.workqueue.AddAfter(key, concurrencyRetryDelay)
+			return nil
+		}
+		if helpers.ClassifyError(err) == helpers.ErrorThrottled {
+			// throttling is not the Node's failure, it is retried once the backoff is over
+			retryAfter := helpers.GetRetryAfter(err)
+			if retryAfter <= 0 {
+				retryAfter = c.syncBackoffBase
+			}
+			c.log.Infof("ARM is throttling requests, retrying Node %s in %s", key, retryAfter)
+			throttledRequeues.WithLabelValues(c.clusterName).Inc()
+			c.workqueue.AddAfter(key, retryAfter)
+			return nil
+		}
+		if err != nil {
+			c.handleSyncError(key, err)
 			return fmt.Errorf("error syncing '%s': %s", key, err.Error())
 		}
 		// Finally, if no error occurs we Forget this item so it does not
 		// get queued again until another change happens.
 		c.workqueue.Forget(obj)
+		c.failures.reset(key)
 		//log.Infof("Successfully synced '%s'", key)
 		return nil
 	}(obj)
@@ -201,7 +377,7 @@ func (c *NodeController) processNextWorkItem() bool {
 // syncHandler compares the actual state with the desired, and attempts to
 // converge the two. It then updates the Status block of the Node resource
 // with the current status of the resource.
-func (c *NodeController) syncHandler(key string) error {
+func (c *NodeController) syncHandler(ctx context.Context, key string) error {
 	// Convert the namespace/name string into a distinct namespace and name
 	_, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
@@ -218,47 +394,182 @@ func (c *NodeController) syncHandler(key string) error {
 		// processing.
 		if errors.IsNotFound(err) {
 			runtime.HandleError(fmt.Errorf("Node '%s' in work queue no longer exists in Node-Public IP controller", name))
-			errDelete := c.deletePublicIPForNode(name)
-			if errDelete != nil {
-				log.Infof("Error deleting IP for Node %s: %v", name, errDelete.Error())
-				return errDelete
-			}
-			log.Infof("Successfully deleted IP for Node %s", name)
-			return nil
+			return c.syncDeletedNode(ctx, name)
 		}
 
 		return err // cannot list nodes
 	}
 
+	_, failed := node.Annotations[syncFailedAnnotation]
+	resumed := c.resumed.take(node.Name)
+	if _, ok := node.Annotations[retryAnnotation]; ok {
+		c.log.Infof("Node %s has the %s annotation, retrying it", node.Name, retryAnnotation)
+		if err := c.clearSyncFailure(node); err != nil {
+			return err
+		}
+	} else if resumed && failed {
+		// the operation the previous leader abandoned must not be left half done
+		c.log.Infof("Resuming the abandoned operation of Node %s, that was marked as failed", node.Name)
+		if err := c.clearSyncFailure(node); err != nil {
+			return err
+		}
+	} else if failed {
+		// the controller gave up on the Node, until an operator sets the retryAnnotation
+		return nil
+	}
+
+	if ipID, ok := node.Annotations[publicIPIDAnnotation]; ok {
+		if err := c.saveBYOIP(node.Name, ipID); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := node.Annotations[releaseAnnotation]; ok {
+		return c.releasePublicIP(ctx, node)
+	}
+
 	if !nodeHasPublicIP(node) {
 		//node does not have a Public IP
-		log.Infof("Node with name %s does not have a Public IP, trying to create one", node.Name)
-		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			err := c.ipUpdater.CreateOrUpdateVMPulicIP(ctx, node.Name, helpers.GetPublicIPName(node.Name))
+		// the Node's sync does not look its Public IP up, an existing one is counted till the quota is checked again
+		if err := c.assignPublicIP(ctx, node, false); err != nil {
+			return err
+		}
+	}
+
+	if c.secondaryPublicIPsEnabled() && nodeHasPublicIP(node) {
+		if err := c.ensureSecondaryPublicIPs(ctx, node); err != nil {
+			// returned as is, so that its class decides whether the Node is retried
+			return err
+		}
+	}
+
+	if c.publicIPLabelTemplate != nil && nodeHasPublicIP(node) {
+		if err := c.ensurePublicIPFQDN(ctx, node); err != nil {
+			return err
+		}
+	}
+
+	// the Node's address is reported by the cloud provider some time after the Public IP has been attached
+	if c.dnsUpdater != nil && nodeHasPublicIP(node) {
+		if err := c.ensureDNSRecord(ctx, node); err != nil {
+			return err
+		}
+	}
+
+	if c.nsgUpdater != nil && nodeHasPublicIP(node) {
+		if err := c.ensureNSGRules(ctx, node); err != nil {
+			return err
+		}
+	}
+
+	//c.recorder.Event(node, corev1.EventTypeNormal, successSynced, messageResourceSynced)
+	return nil
+}
+
+// syncDeletedNode deletes the Public IP of a Node that no longer exists
+func (c *NodeController) syncDeletedNode(ctx context.Context, nodeName string) error {
+	deleted, err := c.vmDeleted(ctx, nodeName)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		// the Node object is gone but its VM is still running, e.g. it will register again, so its Public IP is kept.
+		// The orphan sync looks at it again later
+		c.log.Infof("Node %s does not exist but its VM does, keeping its Public IP", nodeName)
+		return nil
+	}
+
+	done, err := c.startARMOperation(ctx, nodeName, operationDelete)
+	if err != nil {
+		return err
+	}
+	defer done()
+	errDelete := c.deletePublicIPForNode(ctx, nodeName)
+	if errDelete != nil {
+		c.log.Infof("Error deleting IP for Node %s: %v", nodeName, errDelete.Error())
+		return errDelete
+	}
+	c.log.Infof("Successfully deleted IP for Node %s", nodeName)
+	return nil
+}
+
+// vmDeleted returns whether ARM reports the Node's VM as deleted or being deleted
+func (c *NodeController) vmDeleted(ctx context.Context, nodeName string) (bool, error) {
+	state, err := c.ipUpdater.GetVMState(ctx, nodeName)
+	if err != nil {
+		return false, err
+	}
+	return state != helpers.VMExists, nil
+}
+
+// assignPublicIP creates the Public IP of the Node and attaches it to the Node's NIC.
+// Failures are reported as Events on the Node, and returned for the Node's backoff.
+// ipExists tells that the Node's Public IP exists already and only has to be attached, so it uses no more quota
+func (c *NodeController) assignPublicIP(ctx context.Context, node *corev1.Node, ipExists bool) error {
+	done, err := c.startARMOperation(ctx, node.Name, operationCreate)
+	if err != nil {
+		return err
+	}
+	defer done()
+	_, byoIP := node.Annotations[publicIPIDAnnotation]
+	reserved := !byoIP && !ipExists
+	if reserved && !c.reservePublicIPQuota(ctx, node, 1) {
+		// the Node is requeued for when the quota is checked again
+		return nil
+	}
+	created := false
+	c.log.Infof("Node with name %s does not have a Public IP, trying to create one", node.Name)
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var fqdn string
+		var err error
+		if ipID, ok := node.Annotations[publicIPIDAnnotation]; ok {
+			fqdn, err = c.ipUpdater.AttachPublicIP(ctx, node.Name, ipID)
 			if err != nil {
-				log.Errorf("Error in creating Public IP: %s", err)
+				c.log.Errorf("Error in attaching Public IP %s: %s", ipID, err)
 				return err
 			}
-			log.Infof("Trying to set Label to the Node %s", node.Name)
-			err = c.setLabelToNode(node.Name)
+		} else {
+			var domainNameLabel string
+			domainNameLabel, err = c.getPublicIPDNSLabel(node.Name)
 			if err != nil {
 				return err
 			}
-			return nil
-		})
-		if retryErr != nil {
-			runtime.HandleError(fmt.Errorf("Error in creating IP %s, for Node %s", err.Error(), node.Name))
-			c.recorder.Event(node, corev1.EventTypeWarning, errorCreatingIP, err.Error())
-			return nil
+			fqdn, err = c.ipUpdater.CreateOrUpdateVMPulicIP(ctx, node.Name, helpers.GetPublicIPName(node.Name), domainNameLabel)
+			if err != nil {
+				c.log.Errorf("Error in creating Public IP: %s", err)
+				return err
+			}
+			created = true
+		}
+		c.log.Infof("Trying to set Label to the Node %s", node.Name)
+		err = c.setLabelToNode(node.Name)
+		if err != nil {
+			return err
 		}
+		if fqdn != "" {
+			return c.setAnnotationToNode(node.Name, fqdnAnnotation, fqdn)
+		}
+		return nil
+	})
+	if retryErr != nil {
+		if reserved && !created {
+			c.releasePublicIPQuota(1)
+		}
+		runtime.HandleError(fmt.Errorf("Error in creating IP %s, for Node %s", retryErr.Error(), node.Name))
+		c.recorder.Event(node, corev1.EventTypeWarning, errorCreatingIP, retryErr.Error())
+		return retryErr
+	}
+	if c.plan == nil {
 		c.recorder.Event(node, corev1.EventTypeNormal, successCreatingIP, fmt.Sprintf("Successfully created IP for Node %s", node.Name))
 	}
-
-	//c.recorder.Event(node, corev1.EventTypeNormal, successSynced, messageResourceSynced)
 	return nil
 }
 
 func (c *NodeController) setLabelToNode(nodename string) error {
+	if c.plan != nil {
+		c.planAction(helpers.PlannedAction{Node: nodename, Action: helpers.PlannedUpdate, Resource: "Node " + nodename, Details: "label HasPublicIP=true"})
+		return nil
+	}
 	node, err := c.kubeclientset.CoreV1().Nodes().Get(nodename, metav1.GetOptions{})
 	if err != nil {
 		return err
@@ -266,7 +577,7 @@ func (c *NodeController) setLabelToNode(nodename string) error {
 	if node.Labels == nil {
 		node.Labels = make(map[string]string)
 	}
-	node.Labels["HasPublicIP"] = "true"
+	node.Labels[hasPublicIPLabel] = "true"
 	_, err = c.kubeclientset.CoreV1().Nodes().Update(node)
 	if err != nil {
 		return err
@@ -274,6 +585,75 @@ func (c *NodeController) setLabelToNode(nodename string) error {
 	return nil
 }
 
+// releasePublicIP detaches and deletes the Public IP of a Node that has the releaseAnnotation
+func (c *NodeController) releasePublicIP(ctx context.Context, node *corev1.Node) error {
+	ipName := helpers.GetPublicIPName(node.Name)
+	if ipID, ok := node.Annotations[publicIPIDAnnotation]; ok {
+		if _, ok := node.Labels[hasPublicIPLabel]; !ok {
+			// already released
+			return nil
+		}
+		ipName = ipID
+	} else {
+		ip, err := c.ipUpdater.GetPublicIP(ctx, ipName)
+		if err != nil {
+			return err
+		}
+		if ip == nil {
+			// already released
+			return c.removeLabelFromNode(node.Name)
+		}
+	}
+
+	done, err := c.startARMOperation(ctx, node.Name, operationRelease)
+	if err != nil {
+		return err
+	}
+	defer done()
+	c.log.Infof("Node %s has the %s annotation, releasing its Public IP", node.Name, releaseAnnotation)
+	if err := c.deletePublicIPForNode(ctx, node.Name); err != nil {
+		c.recorder.Event(node, corev1.EventTypeWarning, errorReleasingIP, err.Error())
+		return err
+	}
+	if err := c.removeLabelFromNode(node.Name); err != nil {
+		return err
+	}
+	if err := c.removeAnnotationFromNode(node.Name, publicIPsAnnotation); err != nil {
+		return err
+	}
+	if c.nsgUpdater != nil {
+		// the Node's rules have been deleted, they are added again if the Node gets a new Public IP
+		if err := c.removeAnnotationFromNode(node.Name, nsgAnnotation); err != nil {
+			return err
+		}
+		if err := c.removeAnnotationFromNode(node.Name, nsgAppliedRulesAnnotation); err != nil {
+			return err
+		}
+	}
+	if c.plan == nil {
+		c.recorder.Event(node, corev1.EventTypeNormal, successReleasingIP, fmt.Sprintf("Successfully released IP %s for Node %s", ipName, node.Name))
+	}
+	return nil
+}
+
+// removeLabelFromNode removes the HasPublicIP label, after the Node's Public IP has been released
+func (c *NodeController) removeLabelFromNode(nodename string) error {
+	if c.plan != nil {
+		c.planAction(helpers.PlannedAction{Node: nodename, Action: helpers.PlannedUpdate, Resource: "Node " + nodename, Details: "remove label HasPublicIP"})
+		return nil
+	}
+	node, err := c.kubeclientset.CoreV1().Nodes().Get(nodename, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, ok := node.Labels[hasPublicIPLabel]; !ok {
+		return nil
+	}
+	delete(node.Labels, hasPublicIPLabel)
+	_, err = c.kubeclientset.CoreV1().Nodes().Update(node)
+	return err
+}
+
 func (c *NodeController) handleObject(obj interface{}) {
 	var object metav1.Object
 	var ok bool
@@ -288,21 +668,68 @@ func (c *NodeController) handleObject(obj interface{}) {
 			runtime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
 			return
 		}
-		log.Infof("Recovered deleted object '%s' from tombstone", object.GetName())
+		c.log.Infof("Recovered deleted object '%s' from tombstone", object.GetName())
 	}
 	//log.Infof("Processing object: %s", object.GetName())
 
+	if ipID, ok := object.GetAnnotations()[publicIPIDAnnotation]; ok {
+		// the delete path only has the Node's name, once the Node is gone
+		c.byoIPs.set(object.GetName(), ipID)
+	}
 	c.enqueueNode(object)
 }
 
-func (c *NodeController) deletePublicIPForNode(nodeName string) error {
-	log.Infof("Node with name %s has been deleted, trying to delete its Public IP", nodeName)
+func (c *NodeController) deletePublicIPForNode(ctx context.Context, nodeName string) error {
+	c.log.Infof("Node with name %s has been deleted, trying to delete its Public IP", nodeName)
+
+	if c.dnsUpdater != nil {
+		if err := c.deleteDNSRecordForNode(ctx, nodeName); err != nil {
+			runtime.HandleError(fmt.Errorf("Could not delete DNS record for node %s due to error %s", nodeName, err.Error()))
+			return err
+		}
+	}
+	if c.secondaryPublicIPsEnabled() {
+		if err := c.ipUpdater.DeleteSecondaryPublicIPs(ctx, nodeName); err != nil {
+			runtime.HandleError(fmt.Errorf("Could not delete secondary Public IPs for node %s due to error %s", nodeName, err.Error()))
+			return err
+		}
+	}
+
+	// the Node may have been deleted while the controller was not running, e.g. before a restart
+	// or a change of leader, in which case its bring-your-own Public IP is known from the byoIPStore
+	if ipID, ok := c.byoIPs.get(nodeName); ok {
+		// bring-your-own Public IPs are only detached, never deleted
+		if err := c.ipUpdater.DetachPublicIP(ctx, ipID); err != nil {
+			runtime.HandleError(fmt.Errorf("Could not detach Public IP %s for node %s due to error %s", ipID, nodeName, err.Error()))
+			return err
+		}
+		if err := c.forgetBYOIP(nodeName); err != nil {
+			runtime.HandleError(err)
+			return err
+		}
+		c.log.Infof("Successfully detached Public IP %s from Node with name %s", ipID, nodeName)
+	}
+	// the Node may also have had a Public IP of the controller, e.g. from before it was annotated
+	if err := c.deleteOwnPublicIP(ctx, nodeName); err != nil {
+		return err
+	}
+
+	if c.nsgUpdater != nil {
+		if err := c.cleanupNSGRules(ctx, nodeName); err != nil {
+			runtime.HandleError(fmt.Errorf("Could not clean up NSG rules after deleting node %s due to error %s", nodeName, err.Error()))
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOwnPublicIP deletes the Public IP the controller created for the Node
+func (c *NodeController) deleteOwnPublicIP(ctx context.Context, nodeName string) error {
 	err := c.ipUpdater.DeletePublicIP(ctx, helpers.GetPublicIPName(nodeName))
 
-	// there is a chance that NIC is still alive so IP Address is still associated and we'll get an error
-	// this is the error message:
-	// Failure sending request: StatusCode=0 -- Original Error: autorest/azure: Service returned an error. Status=400 Code="PublicIPAddressCannotBeDeleted" Message="Public IP address /subscriptions/XXX/resourceGroups/XXX/providers/Microsoft.Network/publicIPAddresses/XXX can not be deleted since it is still allocated
-	if err != nil && strings.Contains(err.Error(), `Code="PublicIPAddressCannotBeDeleted"`) {
+	// there is a chance that NIC is still alive so IP Address is still associated and ARM refuses the delete,
+	// e.g. with a PublicIPAddressCannotBeDeleted error
+	if err != nil && helpers.ClassifyError(err) == helpers.ErrorConflict {
 		// try to disassociate the Public IP
 		errDis := c.ipUpdater.DisassociatePublicIPForNode(ctx, nodeName)
 		if errDis != nil {
@@ -320,7 +747,7 @@ func (c *NodeController) deletePublicIPForNode(nodeName string) error {
 		return err
 	}
 
-	log.Infof("Successfully deleted Public IP for Node with name %s", nodeName)
+	c.log.Infof("Successfully deleted Public IP for Node with name %s", nodeName)
 	return nil
 }
 
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/annotations"
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+const (
+	dnsRecordAnnotation        = annotations.DNSRecord
+	dnsRecordAddressAnnotation = annotations.DNSRecordAddress
+	fqdnAnnotation             = annotations.FQDN
+
+	successCreatingDNSRecord = "SuccessCreatingDNSRecord"
+	errorCreatingDNSRecord   = "ErrorCreatingDNSRecord"
+)
+
+// dnsRecordData is passed to the DNS record name and the Public IP DNS label templates
+type dnsRecordData struct {
+	Cluster   string
+	NodeName  string
+	NodePool  string
+	NodeIndex string
+}
+
+// EnableDNS makes the controller keep a DNS record, named after recordTemplate, for each Node's Public IP
+func (c *NodeController) EnableDNS(dnsUpdater helpers.DNSUpdater, recordTemplate *template.Template) {
+	c.dnsUpdater = dnsUpdater
+	c.dnsRecordTemplate = recordTemplate
+}
+
+// EnablePublicIPDNSLabel makes the controller set a DNS label, named after labelTemplate, on each Public IP it creates
+func (c *NodeController) EnablePublicIPDNSLabel(labelTemplate *template.Template) {
+	c.publicIPLabelTemplate = labelTemplate
+}
+
+// getDNSRecordName executes the DNS record template for the designated Node
+func (c *NodeController) getDNSRecordName(nodeName string) (string, error) {
+	return c.executeNodeTemplate(c.dnsRecordTemplate, nodeName)
+}
+
+// getPublicIPDNSLabel executes the Public IP DNS label template for the designated Node.
+// It returns an empty string if Public IP DNS labels are disabled
+func (c *NodeController) getPublicIPDNSLabel(nodeName string) (string, error) {
+	if c.publicIPLabelTemplate == nil {
+		return "", nil
+	}
+	return c.executeNodeTemplate(c.publicIPLabelTemplate, nodeName)
+}
+
+// executeNodeTemplate executes a DNS name template for the designated Node
+// Pool and index are derived from the Node name only, since the Node object is gone when we delete the record
+func (c *NodeController) executeNodeTemplate(t *template.Template, nodeName string) (string, error) {
+	pool, index := getNodePoolAndIndex(nodeName)
+	var b bytes.Buffer
+	err := t.Execute(&b, dnsRecordData{
+		Cluster:   c.clusterName,
+		NodeName:  nodeName,
+		NodePool:  pool,
+		NodeIndex: index,
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot execute template %s for Node %s: %v", t.Name(), nodeName, err)
+	}
+	return strings.ToLower(b.String()), nil
+}
+
+// ensureDNSRecord creates or updates the DNS record for a Node that has a Public IP
+// The record's FQDN and address are kept in annotations on the Node, so we only call ARM when the record name
+// or the Node's address changes, e.g. when a dynamic Public IP gets a new address
+func (c *NodeController) ensureDNSRecord(ctx context.Context, node *corev1.Node) error {
+	recordName, err := c.getDNSRecordName(node.Name)
+	if err != nil {
+		return err
+	}
+
+	previousFQDN := node.Annotations[dnsRecordAnnotation]
+	address := getNodeExternalIP(node)
+	if previousFQDN != "" && strings.HasPrefix(previousFQDN, recordName+".") && node.Annotations[dnsRecordAddressAnnotation] == address {
+		return nil
+	}
+
+	done, err := c.startARMOperation(ctx, node.Name, operationDNS)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if previousFQDN != "" && !strings.HasPrefix(previousFQDN, recordName+".") {
+		// record template has changed, remove the old record
+		previousRecordName := strings.SplitN(previousFQDN, ".", 2)[0]
+		if err := c.dnsUpdater.DeleteDNSRecord(ctx, previousRecordName); err != nil {
+			return err
+		}
+	}
+
+	ipName := helpers.GetPublicIPName(node.Name)
+	if ipID, ok := node.Annotations[publicIPIDAnnotation]; ok {
+		ipName = ipID
+	}
+	fqdn, err := c.dnsUpdater.CreateOrUpdateDNSRecord(ctx, recordName, ipName)
+	if err != nil {
+		c.recorder.Event(node, corev1.EventTypeWarning, errorCreatingDNSRecord, err.Error())
+		return err
+	}
+
+	if err := c.setAnnotationToNode(node.Name, dnsRecordAddressAnnotation, address); err != nil {
+		return err
+	}
+	if err := c.setAnnotationToNode(node.Name, dnsRecordAnnotation, fqdn); err != nil {
+		return err
+	}
+	if c.plan == nil {
+		c.recorder.Event(node, corev1.EventTypeNormal, successCreatingDNSRecord, fmt.Sprintf("Successfully set DNS record %s to %s for Node %s", fqdn, address, node.Name))
+	}
+	return nil
+}
+
+// ensurePublicIPFQDN sets the fqdnAnnotation of a Node whose Public IP has a DNS label, if it is missing,
+// e.g. because the Node could not be updated after the Public IP was created
+func (c *NodeController) ensurePublicIPFQDN(ctx context.Context, node *corev1.Node) error {
+	if _, ok := node.Annotations[fqdnAnnotation]; ok {
+		return nil
+	}
+	if _, ok := node.Annotations[publicIPIDAnnotation]; ok {
+		// bring-your-own Public IPs keep their own DNS label
+		return nil
+	}
+	ip, err := c.ipUpdater.GetPublicIP(ctx, helpers.GetPublicIPName(node.Name))
+	if err != nil {
+		return err
+	}
+	if ip == nil || ip.FQDN == "" {
+		return nil
+	}
+	return c.setAnnotationToNode(node.Name, fqdnAnnotation, ip.FQDN)
+}
+
+// getNodeExternalIP returns the first external address the Node reports, "" if it has none
+func getNodeExternalIP(node *corev1.Node) string {
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeExternalIP {
+			return address.Address
+		}
+	}
+	return ""
+}
+
+// deleteDNSRecordForNode deletes the DNS record of a Node that no longer exists
+func (c *NodeController) deleteDNSRecordForNode(ctx context.Context, nodeName string) error {
+	recordName, err := c.getDNSRecordName(nodeName)
+	if err != nil {
+		return err
+	}
+	return c.dnsUpdater.DeleteDNSRecord(ctx, recordName)
+}
+
+func (c *NodeController) setAnnotationToNode(nodename, key, value string) error {
+	if c.plan != nil {
+		c.planAction(helpers.PlannedAction{Node: nodename, Action: helpers.PlannedUpdate, Resource: "Node " + nodename, Details: "annotation " + key + "=" + value})
+		return nil
+	}
+	node, err := c.kubeclientset.CoreV1().Nodes().Get(nodename, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	node.Annotations[key] = value
+	_, err = c.kubeclientset.CoreV1().Nodes().Update(node)
+	return err
+}
+
+// removeAnnotationFromNode removes the annotation, if the Node has it
+func (c *NodeController) removeAnnotationFromNode(nodename, key string) error {
+	node, err := c.kubeclientset.CoreV1().Nodes().Get(nodename, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, ok := node.Annotations[key]; !ok {
+		return nil
+	}
+	if c.plan != nil {
+		c.planAction(helpers.PlannedAction{Node: nodename, Action: helpers.PlannedUpdate, Resource: "Node " + nodename, Details: "remove annotation " + key})
+		return nil
+	}
+	delete(node.Annotations, key)
+	_, err = c.kubeclientset.CoreV1().Nodes().Update(node)
+	return err
+}
+
+// getNodePoolAndIndex accepts an AKS Node name like aks-nodepool1-26427378-0
+// and returns its pool (nodepool1) and its index (0)
+// For names that do not follow this convention, it returns empty strings
+func getNodePoolAndIndex(nodeName string) (string, string) {
+	parts := strings.Split(nodeName, "-")
+	if len(parts) < 4 || parts[0] != "aks" {
+		return "", ""
+	}
+	return strings.Join(parts[1:len(parts)-2], "-"), parts[len(parts)-1]
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+const plannedAction = "DryRunPlannedAction"
+
+// EnableDryRun makes the controller record the ARM and Node writes it would make to the plan, instead of making them.
+// It must be called after EnableDNS and EnableNSG, so that their updaters are replaced too
+func (c *NodeController) EnableDryRun(plan *helpers.Plan) {
+	c.plan = plan
+	c.ipUpdater = helpers.NewDryRunIPUpdate(c.ipUpdater, c.planAction)
+	if c.dnsUpdater != nil {
+		c.dnsUpdater = helpers.NewDryRunDNSUpdate(c.planAction)
+	}
+	if c.nsgUpdater != nil {
+		c.nsgUpdater = helpers.NewDryRunNSGUpdate(c.planAction)
+	}
+	c.log.Info("Running in dry-run mode, no changes will be made to Azure or to the Nodes")
+}
+
+// planAction records a planned action, logs it and, if it is for a Node, emits an Event on it
+func (c *NodeController) planAction(a helpers.PlannedAction) {
+	a.Cluster = c.clusterName
+	added, err := c.plan.Add(a)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("error recording planned action %s: %s", a, err.Error()))
+	}
+	if !added {
+		return
+	}
+
+	c.log.Infof("Dry run: would %s", a)
+	if a.Node != "" {
+		node, err := c.nodesLister.Get(a.Node)
+		if err != nil {
+			// the Node is gone, the Event is still useful
+			node = &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: a.Node}}
+		}
+		c.recorder.Event(node, corev1.EventTypeNormal, plannedAction, fmt.Sprintf("Dry run: would %s", a))
+	}
+}
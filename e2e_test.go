@@ -0,0 +1,385 @@
+//go:build e2e
+// +build e2e
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/fakearm"
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+// The e2e tests run the whole controller against a local API server (envtest) and the fake ARM server.
+// They need the etcd and kube-apiserver binaries, see KUBEBUILDER_ASSETS in the envtest docs, and run with
+//   go test -tags e2e -run E2E -v .
+
+const (
+	e2eTimeout      = 30 * time.Second
+	e2ePollInterval = 100 * time.Millisecond
+)
+
+var e2eKubeClient kubernetes.Interface
+
+func TestMain(m *testing.M) {
+	testEnv := &envtest.Environment{}
+	config, err := testEnv.Start()
+	if err != nil {
+		log.Fatalf("cannot start the test API server: %v", err)
+	}
+	e2eKubeClient = kubernetes.NewForConfigOrDie(config)
+
+	// short leases, so that failover doesn't slow the tests down
+	leaderElectionLeaseDuration = 2 * time.Second
+	leaderElectionRenewDeadline = time.Second
+	leaderElectionRetryPeriod = 200 * time.Millisecond
+	drainTimeout = time.Second
+
+	code := m.Run()
+
+	if err := testEnv.Stop(); err != nil {
+		log.Errorf("cannot stop the test API server: %v", err)
+	}
+	os.Exit(code)
+}
+
+// e2eEnv is a single cluster, whose Nodes live in the test API server and whose VMs live in a fake ARM server
+type e2eEnv struct {
+	t       *testing.T
+	server  *fakearm.Server
+	cluster *cluster
+	nodes   []string
+}
+
+func newE2EEnv(t *testing.T) *e2eEnv {
+	server := fakearm.NewServer()
+	return &e2eEnv{
+		t:      t,
+		server: server,
+		cluster: &cluster{
+			name:       t.Name(),
+			kubeClient: e2eKubeClient,
+			ipUpdater:  newFakeARMIPUpdate(server),
+		},
+	}
+}
+
+// close deletes the Nodes the test has created and stops the fake ARM server.
+// Controllers must be stopped before, so that they do not react to the deletions
+func (e *e2eEnv) close() {
+	for _, name := range e.nodes {
+		err := e2eKubeClient.CoreV1().Nodes().Delete(name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			e.t.Errorf("error deleting node %s: %v", name, err)
+		}
+	}
+	e.server.Close()
+}
+
+// startController runs the controller of the cluster, like OnStartedLeading does, and returns a function that stops it
+func (e *e2eEnv) startController() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := runCluster(ctx, e.cluster); err != nil {
+			e.t.Errorf("error running controller: %v", err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// startCandidate runs a leader election candidate for the cluster and returns a function that stops it
+func (e *e2eEnv) startCandidate(id, lockName string) func() {
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, metav1.NamespaceDefault, lockName,
+		e2eKubeClient.CoreV1(), e2eKubeClient.CoordinationV1(), resourcelock.ResourceLockConfig{
+			Identity:      id,
+			EventRecorder: &record.FakeRecorder{},
+		})
+	if err != nil {
+		e.t.Fatalf("error creating lock: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := runLeaderElection(leaderCtx, id, lock, []*cluster{e.cluster}); err != nil {
+			e.t.Errorf("error running candidate %s: %v", id, err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// getLeader returns the identity of the current holder of the designated Lease
+func (e *e2eEnv) getLeader(lockName string) string {
+	lease, err := e2eKubeClient.CoordinationV1().Leases(metav1.NamespaceDefault).Get(lockName, metav1.GetOptions{})
+	if err != nil || lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// addNode adds a VM to the fake ARM server and the corresponding Node to the API server
+func (e *e2eEnv) addNode(name string) {
+	e.server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, name)
+	e.nodes = append(e.nodes, name)
+	_, err := e2eKubeClient.CoreV1().Nodes().Create(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	if err != nil {
+		e.t.Fatalf("error creating node %s: %v", name, err)
+	}
+}
+
+// scaleIn removes a Node the way the cluster autoscaler does, the VM goes away first and then the Node
+func (e *e2eEnv) scaleIn(name string) {
+	e.server.Delete(fakearm.VirtualMachineID(testSubscription, testResourceGroup, name))
+	if err := e2eKubeClient.CoreV1().Nodes().Delete(name, &metav1.DeleteOptions{}); err != nil {
+		e.t.Fatalf("error deleting node %s: %v", name, err)
+	}
+}
+
+// waitFor fails the test if the condition is not met in e2eTimeout
+func (e *e2eEnv) waitFor(description string, condition func() bool) {
+	err := wait.PollImmediate(e2ePollInterval, e2eTimeout, func() (bool, error) {
+		return condition(), nil
+	})
+	if err != nil {
+		e.t.Fatalf("timed out waiting for %s", description)
+	}
+}
+
+// getPublicIP returns the Public IP of the designated Node from the fake ARM server, or nil
+func (e *e2eEnv) getPublicIP(nodeName string) fakearm.Resource {
+	return e.server.Get(fakearm.PublicIPID(testSubscription, testResourceGroup, helpers.GetPublicIPName(nodeName)))
+}
+
+// hasPublicIP returns whether the Node's Public IP exists and is attached, and the Node is labeled
+func (e *e2eEnv) hasPublicIP(nodeName string) bool {
+	ip := e.getPublicIP(nodeName)
+	if ip == nil || ip.Properties()["ipConfiguration"] == nil {
+		return false
+	}
+	node, err := e2eKubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	return err == nil && node.Labels["HasPublicIP"] == "true"
+}
+
+// waitForPublicIP waits until the Node has a Public IP and then reports its address in the Node's status,
+// which is what the Azure cloud provider does in a real cluster
+func (e *e2eEnv) waitForPublicIP(nodeName string) {
+	e.waitFor("Public IP of node "+nodeName, func() bool { return e.hasPublicIP(nodeName) })
+
+	address, _ := e.getPublicIP(nodeName).Properties()["ipAddress"].(string)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := e2eKubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		node.Status.Addresses = append(node.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: address})
+		_, err = e2eKubeClient.CoreV1().Nodes().UpdateStatus(node)
+		return err
+	})
+	if err != nil {
+		e.t.Fatalf("error updating status of node %s: %v", nodeName, err)
+	}
+}
+
+// countPublicIPs returns the number of Public IPs in the fake ARM server
+func (e *e2eEnv) countPublicIPs() int {
+	return len(e.server.List(testSubscription, testResourceGroup, "publicIPAddresses"))
+}
+
+func TestE2ENodeAdd(t *testing.T) {
+	e := newE2EEnv(t)
+	defer e.close()
+	stop := e.startController()
+	defer stop()
+
+	nodeName := "aks-add-12345678-0"
+	e.addNode(nodeName)
+	e.waitForPublicIP(nodeName)
+
+	ip := e.getPublicIP(nodeName)
+	tags, _ := ip["tags"].(map[string]interface{})
+	if tags["aksnodepublicip-owner"] != testResourceGroup {
+		t.Errorf("Public IP is not tagged with its owner: %v", ip["tags"])
+	}
+	if n := e.countPublicIPs(); n != 1 {
+		t.Errorf("expected 1 Public IP, got %d", n)
+	}
+}
+
+func TestE2EScaleIn(t *testing.T) {
+	e := newE2EEnv(t)
+	defer e.close()
+	stop := e.startController()
+	defer stop()
+
+	e.addNode("aks-scalein-12345678-0")
+	e.addNode("aks-scalein-12345678-1")
+	e.waitForPublicIP("aks-scalein-12345678-0")
+	e.waitForPublicIP("aks-scalein-12345678-1")
+
+	e.scaleIn("aks-scalein-12345678-1")
+	e.waitFor("Public IP of the removed node to be deleted", func() bool {
+		return e.getPublicIP("aks-scalein-12345678-1") == nil
+	})
+
+	if !e.hasPublicIP("aks-scalein-12345678-0") {
+		t.Errorf("Public IP of the remaining node was modified")
+	}
+	if n := e.countPublicIPs(); n != 1 {
+		t.Errorf("expected 1 Public IP, got %d", n)
+	}
+}
+
+func TestE2ERestartMidOperation(t *testing.T) {
+	e := newE2EEnv(t)
+	defer e.close()
+
+	// attaching the Public IP to the NIC never completes, so the controller is stopped in the middle of it
+	e.server.AddFault(fakearm.LROTimeout(http.MethodPut, "networkInterfaces", 0))
+	stop := e.startController()
+
+	nodeName := "aks-restart-12345678-0"
+	e.addNode(nodeName)
+	e.waitFor("NIC update to start", func() bool {
+		for _, r := range e.server.Requests() {
+			if strings.HasPrefix(r, http.MethodPut) && strings.Contains(strings.ToLower(r), "networkinterfaces") {
+				return true
+			}
+		}
+		return false
+	})
+	stop()
+
+	// a new controller must pick up where the old one stopped
+	e.server.ClearFaults()
+	stop = e.startController()
+	defer stop()
+	e.waitForPublicIP(nodeName)
+
+	if n := e.countPublicIPs(); n != 1 {
+		t.Errorf("expected 1 Public IP, got %d", n)
+	}
+}
+
+func TestE2ELeaderFailover(t *testing.T) {
+	e := newE2EEnv(t)
+	defer e.close()
+	lockName := "e2e-leader-failover"
+
+	stopFirst := e.startCandidate("first", lockName)
+	firstStopped := false
+	defer func() {
+		if !firstStopped {
+			stopFirst()
+		}
+	}()
+	e.waitFor("first candidate to lead", func() bool { return e.getLeader(lockName) == "first" })
+
+	stopSecond := e.startCandidate("second", lockName)
+	defer stopSecond()
+
+	e.addNode("aks-failover-12345678-0")
+	e.waitForPublicIP("aks-failover-12345678-0")
+
+	// the leader goes away without releasing the lock, the second candidate takes over once the lease expires
+	stopFirst()
+	firstStopped = true
+	e.waitFor("second candidate to lead", func() bool { return e.getLeader(lockName) == "second" })
+
+	e.addNode("aks-failover-12345678-1")
+	e.waitForPublicIP("aks-failover-12345678-1")
+
+	if !e.hasPublicIP("aks-failover-12345678-0") {
+		t.Errorf("Public IP of the first node was modified")
+	}
+	if n := e.countPublicIPs(); n != 2 {
+		t.Errorf("expected 2 Public IPs, got %d", n)
+	}
+}
+
+func TestE2ELeaderReacquire(t *testing.T) {
+	e := newE2EEnv(t)
+	defer e.close()
+	lockName := "e2e-leader-reacquire"
+
+	stop := e.startCandidate("only", lockName)
+	defer stop()
+	e.waitFor("candidate to lead", func() bool { return e.getLeader(lockName) == "only" })
+
+	// another holder steals the lease, the candidate steps down instead of exiting
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		lease, err := e2eKubeClient.CoordinationV1().Leases(metav1.NamespaceDefault).Get(lockName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		holder := "thief"
+		now := metav1.NewMicroTime(time.Now())
+		lease.Spec.HolderIdentity = &holder
+		lease.Spec.RenewTime = &now
+		_, err = e2eKubeClient.CoordinationV1().Leases(metav1.NamespaceDefault).Update(lease)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error updating lease: %v", err)
+	}
+
+	// the thief never renews, so the candidate acquires the lease again and resumes managing the Nodes
+	e.waitFor("candidate to lead again", func() bool { return e.getLeader(lockName) == "only" })
+	e.addNode("aks-reacquire-12345678-0")
+	e.waitForPublicIP("aks-reacquire-12345678-0")
+}
+
+func TestE2EOrphanCleanup(t *testing.T) {
+	e := newE2EEnv(t)
+	defer e.close()
+
+	// the Node of this Public IP was deleted while the controller was not running
+	orphanID := fakearm.PublicIPID(testSubscription, testResourceGroup, helpers.GetPublicIPName("aks-orphan-12345678-9"))
+	e.server.Put(orphanID, fakearm.Resource{
+		"location": testLocation,
+		"tags":     map[string]interface{}{"aksnodepublicip-owner": testResourceGroup},
+	})
+	// this one belongs to another cluster that shares the Public IP resource group
+	foreignID := fakearm.PublicIPID(testSubscription, testResourceGroup, helpers.GetPublicIPName("aks-other-12345678-0"))
+	e.server.Put(foreignID, fakearm.Resource{
+		"location": testLocation,
+		"tags":     map[string]interface{}{"aksnodepublicip-owner": "MC_other_cluster_westeurope"},
+	})
+
+	e.addNode("aks-orphan-12345678-0")
+	stop := e.startController()
+	defer stop()
+
+	e.waitForPublicIP("aks-orphan-12345678-0")
+	e.waitFor("orphaned Public IP to be deleted", func() bool { return e.server.Get(orphanID) == nil })
+
+	if e.server.Get(foreignID) == nil {
+		t.Errorf("Public IP of another cluster was deleted")
+	}
+}
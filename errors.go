@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+// syncErrorAction is what the controller does with a Node whose sync failed, depending on the class of the error
+type syncErrorAction string
+
+const (
+	// requeueSync retries the Node with its backoff, till it has failed maxSyncAttempts times in a row
+	requeueSync syncErrorAction = "requeue"
+	// giveUpSync marks the Node as failed, as retrying would fail the same way until an operator fixes the cause,
+	// e.g. grants a role to the Service Principal
+	giveUpSync syncErrorAction = "give_up"
+	// waitForQuotaSync retries the Node after the longest backoff, without counting it as a failure,
+	// as quota is freed when other resources are deleted, or raised by an operator
+	waitForQuotaSync syncErrorAction = "wait_for_quota"
+)
+
+// syncFailed is the reason of the Events recorded when the controller gives up on a Node
+const syncFailed = "SyncFailed"
+
+// permanentErrorClasses are the classes of errors that only go away once an operator fixes their cause,
+// the controller gives up on the Node right away
+var permanentErrorClasses = map[helpers.ErrorClass]bool{
+	helpers.ErrorAuthFailure: true,
+}
+
+// getSyncErrorAction returns what to do with a Node whose sync failed with err
+func getSyncErrorAction(err error) syncErrorAction {
+	class := helpers.ClassifyError(err)
+	if class == helpers.ErrorQuotaExceeded {
+		return waitForQuotaSync
+	}
+	if permanentErrorClasses[class] {
+		return giveUpSync
+	}
+	return requeueSync
+}
+
+// handleSyncError retries the Node whose sync failed after its backoff, or gives up on it once it has failed
+// maxSyncAttempts times in a row, or right away if retrying would not help. Nodes over quota are retried
+// after syncBackoffMax, for as long as it takes.
+// Syncs cancelled because the controller is stopping are requeued without counting as a failure,
+// and the Node is never marked as failed then: the next leader resumes its operation from the journal
+func (c *NodeController) handleSyncError(key string, err error) {
+	if helpers.ClassifyError(err) == helpers.ErrorCanceled || c.workqueue.ShuttingDown() {
+		c.log.Infof("Sync of Node %s was cancelled, requeueing it", key)
+		c.workqueue.AddRateLimited(key)
+		return
+	}
+	// the Node's backoff replaces the workqueue's own
+	c.workqueue.Forget(key)
+	action := getSyncErrorAction(err)
+	if action == waitForQuotaSync {
+		syncErrors.WithLabelValues(c.clusterName, string(helpers.ClassifyError(err)), string(action)).Inc()
+		// the quota ARM reports is read again before the next creation, rather than trusting the local count
+		c.expirePublicIPQuota()
+		c.log.Infof("Sync of Node %s is over quota, retrying in %s", key, c.syncBackoffMax)
+		c.workqueue.AddAfter(key, c.syncBackoffMax)
+		return
+	}
+	if action == requeueSync {
+		attempts := c.failures.add(key)
+		if c.maxSyncAttempts <= 0 || attempts < c.maxSyncAttempts {
+			syncErrors.WithLabelValues(c.clusterName, string(helpers.ClassifyError(err)), string(action)).Inc()
+			backoff := c.syncBackoff(attempts)
+			c.log.Infof("Sync of Node %s failed %d time(s), retrying in %s", key, attempts, backoff)
+			c.workqueue.AddAfter(key, backoff)
+			return
+		}
+		action = giveUpSync
+	}
+	syncErrors.WithLabelValues(c.clusterName, string(helpers.ClassifyError(err)), string(action)).Inc()
+	c.failures.reset(key)
+	c.markSyncFailed(key, err)
+}
+
+// markSyncFailed records the error on the Node with the syncFailedAnnotation and a Warning Event.
+// Nodes that no longer exist are left to the orphan sync
+func (c *NodeController) markSyncFailed(key string, err error) {
+	node, errGet := c.nodesLister.Get(key)
+	if errGet != nil {
+		return
+	}
+	message := fmt.Sprintf("%s: %s", helpers.ClassifyError(err), err.Error())
+	c.log.Warnf("Giving up on Node %s, set the %s annotation to retry: %s", node.Name, retryAnnotation, message)
+	if c.plan == nil {
+		c.recorder.Event(node, corev1.EventTypeWarning, syncFailed, message)
+	}
+	if errSet := c.setAnnotationToNode(node.Name, syncFailedAnnotation, message); errSet != nil {
+		runtime.HandleError(fmt.Errorf("cannot mark Node %s as failed: %s", node.Name, errSet.Error()))
+	}
+}
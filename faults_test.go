@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+
+	log "github.com/Sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/fakearm"
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+const (
+	testSubscription  = "sub"
+	testResourceGroup = "MC_rg_aks_westeurope"
+	testLocation      = "westeurope"
+	testNodeName      = "aks-nodepool1-26427378-0"
+)
+
+// newFakeARMIPUpdate returns an ARM backed IPUpdate that talks to the fake ARM server,
+// without retries and with short polling, so that faults surface quickly.
+// Like in the controller, its own rate limiter returns the throttled requests as errors
+func newFakeARMIPUpdate(server *fakearm.Server) *helpers.IPUpdate {
+	u := helpers.NewIPUpdate(&helpers.ServicePrincipalDetails{
+		SubscriptionID:          testSubscription,
+		Location:                testLocation,
+		ResourceGroup:           testResourceGroup,
+		IPSubscriptionID:        testSubscription,
+		IPResourceGroup:         testResourceGroup,
+		ResourceManagerEndpoint: server.URL,
+	}, log.WithField("cluster", "test"))
+	u.SetAuthorizer(autorest.NullAuthorizer{})
+	u.SetClientOptions(helpers.ClientOptions{
+		RetryAttempts:   1,
+		RetryDuration:   time.Millisecond,
+		PollingDelay:    time.Millisecond,
+		PollingDuration: 500 * time.Millisecond,
+	})
+	u.SetRateLimiter(helpers.NewARMRateLimiter(0, 0, 0, 0))
+	return u
+}
+
+// newFaultFixture returns a controller with a single Node, backed by the fake ARM server
+func newFaultFixture(t *testing.T, server *fakearm.Server) (*fixture, *NodeController, *record.FakeRecorder, *corev1.Node) {
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testNodeName)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName}}
+
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+
+	c, _ := f.newController(newFakeARMIPUpdate(server))
+	recorder := record.NewFakeRecorder(100)
+	c.recorder = recorder
+	return f, c, recorder, node
+}
+
+// expectEvent fails the test if no recorded event contains all the designated strings
+func expectEvent(t *testing.T, recorder *record.FakeRecorder, contains ...string) {
+	for {
+		select {
+		case e := <-recorder.Events:
+			found := true
+			for _, s := range contains {
+				if !strings.Contains(e, s) {
+					found = false
+				}
+			}
+			if found {
+				return
+			}
+		default:
+			t.Errorf("no event contains %v", contains)
+			return
+		}
+	}
+}
+
+func publicIPID() string {
+	return fakearm.PublicIPID(testSubscription, testResourceGroup, helpers.GetPublicIPName(testNodeName))
+}
+
+func TestCreateIPThrottled(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	f, c, recorder, node := newFaultFixture(t, server)
+
+	server.AddFault(fakearm.Throttled(http.MethodPut, "publicIPAddresses", 0))
+	if err := c.syncHandler(context.Background(), getKey(node, t)); helpers.ClassifyError(err) != helpers.ErrorThrottled {
+		t.Fatalf("expected a throttling error, so that the Node is requeued, got %v", err)
+	}
+	expectEvent(t, recorder, corev1.EventTypeWarning, errorCreatingIP, "TooManyRequests")
+	if server.Get(publicIPID()) != nil {
+		t.Errorf("Public IP should not have been created while throttled")
+	}
+
+	// throttling is over, next sync should succeed
+	server.ClearFaults()
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	expectEvent(t, recorder, corev1.EventTypeNormal, successCreatingIP)
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting node: %v", err)
+	}
+	if updated.Labels["HasPublicIP"] != "true" {
+		t.Errorf("Node was not labeled")
+	}
+}
+
+func TestCreateIPAnotherOperationInProgress(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	_, c, recorder, node := newFaultFixture(t, server)
+
+	server.AddFault(fakearm.AnotherOperationInProgress(http.MethodPut, "networkInterfaces", 0))
+	if err := c.syncHandler(context.Background(), getKey(node, t)); helpers.ClassifyError(err) != helpers.ErrorTransient {
+		t.Fatalf("expected a transient error, so that the Node is requeued, got %v", err)
+	}
+	expectEvent(t, recorder, corev1.EventTypeWarning, errorCreatingIP, "AnotherOperationInProgress")
+
+	server.ClearFaults()
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+	expectEvent(t, recorder, corev1.EventTypeNormal, successCreatingIP)
+	ip := server.Get(publicIPID())
+	if ip == nil || ip.Properties()["ipConfiguration"] == nil {
+		t.Errorf("Public IP was not attached: %v", ip)
+	}
+}
+
+func TestDeleteIPStillAllocated(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	_, c, _, node := newFaultFixture(t, server)
+
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing node: %v", err)
+	}
+
+	// the Node is gone but its NIC is still around, so the first delete fails and the IP must be disassociated
+	if err := c.deletePublicIPForNode(context.Background(), node.Name); err != nil {
+		t.Fatalf("error deleting IP for node: %v", err)
+	}
+	if server.Get(publicIPID()) != nil {
+		t.Errorf("Public IP was not deleted")
+	}
+
+	var deletes int
+	for _, r := range server.Requests() {
+		if strings.HasPrefix(r, http.MethodDelete) && strings.Contains(strings.ToLower(r), "publicipaddresses") {
+			deletes++
+		}
+	}
+	if deletes != 2 {
+		t.Errorf("expected 2 Public IP DELETE requests, got %d", deletes)
+	}
+}
+
+func TestDeleteIPInjectedCannotBeDeleted(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	_, c, _, node := newFaultFixture(t, server)
+
+	// Public IP is not attached, but ARM still reports it as allocated for the first two attempts
+	server.Put(publicIPID(), fakearm.Resource{"location": testLocation})
+	server.AddFault(fakearm.PublicIPAddressCannotBeDeleted(2))
+
+	if err := c.deletePublicIPForNode(context.Background(), node.Name); err == nil {
+		t.Fatalf("expected an error, so that the Node is requeued")
+	}
+	if server.Get(publicIPID()) == nil {
+		t.Fatalf("Public IP should not have been deleted yet")
+	}
+
+	if err := c.deletePublicIPForNode(context.Background(), node.Name); err != nil {
+		t.Fatalf("error deleting IP for node: %v", err)
+	}
+	if server.Get(publicIPID()) != nil {
+		t.Errorf("Public IP was not deleted")
+	}
+}
+
+func TestDeleteIPLROTimeout(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	_, c, _, node := newFaultFixture(t, server)
+
+	server.Put(publicIPID(), fakearm.Resource{"location": testLocation})
+	server.AddFault(fakearm.LROTimeout(http.MethodDelete, "publicIPAddresses", 0))
+
+	if err := c.deletePublicIPForNode(context.Background(), node.Name); err == nil {
+		t.Fatalf("expected a timeout error, so that the Node is requeued")
+	}
+}
+
+func TestThrottledSyncIsRequeued(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	f, c, _, node := newFaultFixture(t, server)
+	c.maxSyncAttempts = 1
+
+	// throttling does not count as a failure of the Node
+	fault := fakearm.Throttled(http.MethodPut, "publicIPAddresses", 0)
+	fault.RetryAfter = "60"
+	server.AddFault(fault)
+	c.workqueue.Add(getKey(node, t))
+	c.processNextWorkItem(context.Background())
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting Node: %v", err)
+	}
+	if message, ok := updated.Annotations[syncFailedAnnotation]; ok {
+		t.Errorf("expected the throttled Node not to be marked as failed, got %q", message)
+	}
+	if attempts := c.failures.add(node.Name); attempts != 1 {
+		t.Errorf("expected the throttled sync not to count as a failure, got %d failures", attempts-1)
+	}
+}
+
+func TestQuotaExceededSyncIsRequeued(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	f, c, _, node := newFaultFixture(t, server)
+	c.maxSyncAttempts = 1
+	c.quota.checked = time.Now()
+
+	// the Node waits for quota, it is neither given up on nor counted as failing
+	server.AddFault(&fakearm.Fault{
+		Method:       http.MethodPut,
+		ResourceType: "publicIPAddresses",
+		StatusCode:   http.StatusBadRequest,
+		Code:         "PublicIPCountLimitReached",
+		Message:      "Cannot create more than 10 public IP addresses for this subscription in this region.",
+	})
+	c.workqueue.Add(getKey(node, t))
+	c.processNextWorkItem(context.Background())
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting Node: %v", err)
+	}
+	if message, ok := updated.Annotations[syncFailedAnnotation]; ok {
+		t.Errorf("expected the Node over quota not to be marked as failed, got %q", message)
+	}
+	if attempts := c.failures.add(node.Name); attempts != 1 {
+		t.Errorf("expected the sync over quota not to count as a failure, got %d failures", attempts-1)
+	}
+	if !c.quota.checked.IsZero() {
+		t.Error("expected the Public IP quota to be read again before the next creation")
+	}
+}
+
+func TestGiveUpAfterMaxSyncAttempts(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testNodeName)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName}}
+	f := newFixture(t)
+	f.nodesLister = append(f.nodesLister, node)
+	f.kubeobjects = append(f.kubeobjects, node)
+	c, k8sI := f.newController(newFakeARMIPUpdate(server))
+	recorder := record.NewFakeRecorder(100)
+	c.recorder = recorder
+	c.maxSyncAttempts = 3
+	c.syncBackoffBase, c.syncBackoffMax = time.Millisecond, time.Millisecond
+
+	// the NIC keeps being modified, so the Public IP is never attached
+	server.AddFault(fakearm.AnotherOperationInProgress(http.MethodPut, "networkInterfaces", 0))
+	c.workqueue.Add(getKey(node, t))
+	for i := 0; i < c.maxSyncAttempts; i++ {
+		c.processNextWorkItem(context.Background())
+	}
+	if c.workqueue.Len() != 0 {
+		t.Errorf("expected the Node not to be requeued after %d attempts", c.maxSyncAttempts)
+	}
+	expectEvent(t, recorder, corev1.EventTypeWarning, syncFailed, "AnotherOperationInProgress")
+	updated, err := f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting Node: %v", err)
+	}
+	if message := updated.Annotations[syncFailedAnnotation]; !strings.Contains(message, "AnotherOperationInProgress") {
+		t.Errorf("unexpected %s annotation %q", syncFailedAnnotation, message)
+	}
+
+	// the failed Node is not synced again, even once the fault is gone
+	server.ClearFaults()
+	k8sI.Core().V1().Nodes().Informer().GetIndexer().Update(updated)
+	requests := len(server.Requests())
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	if len(server.Requests()) != requests {
+		t.Errorf("expected no ARM request for a failed Node, got %v", server.Requests()[requests:])
+	}
+
+	// until an operator sets the retry annotation
+	updated.Annotations[retryAnnotation] = "2020-01-01T00:00:00Z"
+	if updated, err = f.kubeclient.CoreV1().Nodes().Update(updated); err != nil {
+		t.Fatalf("error updating Node: %v", err)
+	}
+	k8sI.Core().V1().Nodes().Informer().GetIndexer().Update(updated)
+	if err := c.syncHandler(context.Background(), getKey(node, t)); err != nil {
+		t.Fatalf("error syncing Node: %v", err)
+	}
+	if ip := server.Get(publicIPID()); ip == nil || ip.Properties()["ipConfiguration"] == nil {
+		t.Errorf("Public IP was not attached: %v", ip)
+	}
+	if updated, err = f.kubeclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{}); err != nil {
+		t.Fatalf("error getting Node: %v", err)
+	}
+	for _, annotation := range []string{syncFailedAnnotation, retryAnnotation} {
+		if _, ok := updated.Annotations[annotation]; ok {
+			t.Errorf("expected the %s annotation to be removed", annotation)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// the operations a worker can leave unfinished at shutdown
+const (
+	operationCreate  = "create"
+	operationDelete  = "delete"
+	operationRelease = "release"
+	operationDNS     = "dns"
+	operationNSG     = "nsg"
+)
+
+// operations keeps the operation each worker is running, by Node
+type operations struct {
+	lock sync.Mutex
+	ops  map[string]string
+}
+
+// start marks the operation as in flight, or returns false if another operation is in flight for the Node
+func (o *operations) start(nodeName, operation string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if _, ok := o.ops[nodeName]; ok {
+		return false
+	}
+	o.ops[nodeName] = operation
+	return true
+}
+
+func (o *operations) finish(nodeName string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.ops, nodeName)
+}
+
+func (o *operations) list() map[string]string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	ops := make(map[string]string, len(o.ops))
+	for nodeName, operation := range o.ops {
+		ops[nodeName] = operation
+	}
+	return ops
+}
+
+// resumedNodes are the Nodes whose operations the previous leader abandoned, till they are synced
+type resumedNodes struct {
+	lock  sync.Mutex
+	nodes map[string]bool
+}
+
+func (r *resumedNodes) add(nodeName string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nodes[nodeName] = true
+}
+
+// take returns whether the Node has an abandoned operation, which is then considered resumed
+func (r *resumedNodes) take(nodeName string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.nodes[nodeName] {
+		return false
+	}
+	delete(r.nodes, nodeName)
+	return true
+}
+
+// journalEntry is an operation that was abandoned at shutdown
+type journalEntry struct {
+	Cluster   string    `json:"cluster"`
+	Node      string    `json:"node"`
+	Operation string    `json:"operation"`
+	Time      time.Time `json:"time"`
+}
+
+// operationJournal keeps the abandoned operations of all clusters in a ConfigMap, next to the leader election lock,
+// so that the next leader resumes them as soon as it starts
+type operationJournal struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	name       string
+}
+
+// newOperationJournal returns a journal kept in the designated ConfigMap, which is created when needed
+func newOperationJournal(kubeClient kubernetes.Interface, namespace, name string) *operationJournal {
+	return &operationJournal{kubeClient: kubeClient, namespace: namespace, name: name}
+}
+
+var invalidConfigMapKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+
+// journalKey returns the ConfigMap key of a Node's entry
+func journalKey(cluster, nodeName string) string {
+	return invalidConfigMapKeyChars.ReplaceAllString(cluster, "-") + "." + nodeName
+}
+
+// add records the entries, replacing any previous entries for the same Nodes
+func (j *operationJournal) add(entries []journalEntry) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := j.kubeClient.CoreV1().ConfigMaps(j.namespace).Get(j.name, metav1.GetOptions{})
+		create := errors.IsNotFound(err)
+		if create {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: j.name, Namespace: j.namespace}}
+		} else if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		for _, e := range entries {
+			value, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			cm.Data[journalKey(e.Cluster, e.Node)] = string(value)
+		}
+		if create {
+			_, err = j.kubeClient.CoreV1().ConfigMaps(j.namespace).Create(cm)
+		} else {
+			_, err = j.kubeClient.CoreV1().ConfigMaps(j.namespace).Update(cm)
+		}
+		return err
+	})
+}
+
+// take removes the entries of the designated cluster from the journal and returns them, oldest first
+func (j *operationJournal) take(cluster string) ([]journalEntry, error) {
+	var entries []journalEntry
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		entries = nil
+		cm, err := j.kubeClient.CoreV1().ConfigMaps(j.namespace).Get(j.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for key, value := range cm.Data {
+			var e journalEntry
+			if err := json.Unmarshal([]byte(value), &e); err != nil {
+				runtime.HandleError(fmt.Errorf("ignoring invalid journal entry %s: %s", key, err.Error()))
+				continue
+			}
+			if e.Cluster == cluster {
+				entries = append(entries, e)
+				delete(cm.Data, key)
+			}
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		_, err = j.kubeClient.CoreV1().ConfigMaps(j.namespace).Update(cm)
+		return err
+	})
+	sort.Slice(entries, func(i, k int) bool { return entries[i].Time.Before(entries[k].Time) })
+	return entries, err
+}
+
+// recordOperations writes the operations that are still in flight to the journal
+func (c *NodeController) recordOperations() {
+	ops := c.inFlight.list()
+	if len(ops) == 0 {
+		return
+	}
+	var entries []journalEntry
+	for nodeName, operation := range ops {
+		c.log.Warnf("Abandoned %s operation for Node %s", operation, nodeName)
+		entries = append(entries, journalEntry{Cluster: c.clusterName, Node: nodeName, Operation: operation, Time: time.Now().UTC()})
+	}
+	if c.journal == nil {
+		return
+	}
+	if err := c.journal.add(entries); err != nil {
+		runtime.HandleError(fmt.Errorf("cannot record the abandoned operations to the journal: %s", err.Error()))
+	}
+}
+
+// resumeOperations enqueues the Nodes whose operations were abandoned by the previous leader.
+// The syncHandler is idempotent, so enqueueing the Node is enough to resume its operation,
+// even if the Node has been marked as failed since
+func (c *NodeController) resumeOperations() {
+	if c.journal == nil {
+		return
+	}
+	entries, err := c.journal.take(c.clusterName)
+	if err != nil {
+		runtime.HandleError(fmt.Errorf("cannot read the abandoned operations from the journal: %s", err.Error()))
+		return
+	}
+	for _, e := range entries {
+		c.log.Infof("Resuming %s operation for Node %s, abandoned at %s", e.Operation, e.Node, e.Time.Format(time.RFC3339))
+		c.resumed.add(e.Node)
+		c.workqueue.Add(e.Node)
+	}
+}
@@ -3,8 +3,13 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -28,30 +33,150 @@ import (
 )
 
 var (
-	masterURL  string
-	kubeconfig string
-)
+	masterURL          string
+	kubeconfig         string
+	clusterContexts    string
+	azureConfigDir     string
+	defaultClusterName string
+
+	dnsZoneName          string
+	dnsZoneResourceGroup string
+	dnsZoneSubscription  string
+	dnsRecordTemplate    string
+	dnsRecordTTL         int64
+	// dnsRecordNameTemplate is the parsed dnsRecordTemplate
+	dnsRecordNameTemplate *template.Template
+
+	publicIPDNSLabelTemplate string
+	// publicIPLabelTemplate is the parsed publicIPDNSLabelTemplate, nil if Public IP DNS labels are disabled
+	publicIPLabelTemplate *template.Template
+
+	manageNSG       bool
+	nsgRules        string
+	nsgTarget       string
+	nsgBasePriority int
+	// defaultNSGRules are the parsed nsgRules
+	defaultNSGRules []helpers.SecurityRule
+
+	dryRun       bool
+	dryRunReport string
+	// dryRunPlan collects the actions of all clusters in dry-run mode, nil otherwise
+	dryRunPlan *helpers.Plan
+
+	leaderElectionLockType      string
+	leaderElectionLockName      string
+	leaderElectionNamespace     string
+	leaderElectionLeaseDuration time.Duration
+	leaderElectionRenewDeadline time.Duration
+	leaderElectionRetryPeriod   time.Duration
+
+	drainTimeout time.Duration
+	// journal keeps the operations abandoned at shutdown, nil when running a command
+	journal *operationJournal
+	// byoIPs keeps the bring-your-own Public IPs of the Nodes, nil when running a command
+	byoIPs *byoIPStore
+
+	workers                      int
+	maxConcurrentPerPool         int
+	maxConcurrentPerSubscription int
+	// subscriptionLimits is shared by all clusters, as clusters may share a subscription
+	subscriptionLimits *concurrencyLimits
 
-const (
-	configMapName = "leaderlockpublicip"
+	armReadQPS    float64
+	armReadBurst  int
+	armWriteQPS   float64
+	armWriteBurst int
+	// armRateLimiter is shared by the ARM clients of all clusters
+	armRateLimiter *helpers.ARMRateLimiter
+
+	metricsAddress string
+
+	nicCacheTTL time.Duration
+
+	batchSyncPeriod  time.Duration
+	batchConcurrency int
+
+	nicNamePattern        string
+	ipConfigNamePattern   string
+	ipConfigSubnet        string
+	secondaryIPConfigName string
+	// ipConfigSelector selects the NIC and IP configuration of the Public IPs of all clusters
+	ipConfigSelector helpers.IPConfigSelector
+
+	publicIPsPerNode    int
+	maxPublicIPsPerNode int
+
+	publicIPQuotaThreshold int
+
+	syncBackoffBase time.Duration
+	syncBackoffMax  time.Duration
+	maxSyncAttempts int
 )
 
+// cluster contains everything a NodeController needs to manage a single AKS cluster
+type cluster struct {
+	name string
+	// subscriptionID is the subscription of the cluster's VMs
+	subscriptionID string
+	// ipSubscriptionID and dnsSubscriptionID are the subscriptions of the Public IPs and of the DNS zone
+	ipSubscriptionID  string
+	dnsSubscriptionID string
+	kubeClient        kubernetes.Interface
+	ipUpdater         helpers.IPUpdater
+	// dnsUpdater is nil when DNS integration is disabled
+	dnsUpdater helpers.DNSUpdater
+	// nsgUpdater is nil when NSG management is disabled
+	nsgUpdater helpers.NSGUpdater
+}
+
 func main() {
 	id, err := os.Hostname()
 	if err != nil {
 		log.Fatalf("cannot get hostname because of %s", err.Error())
 	}
 
-	err = helpers.InitializeServicePrincipalDetails()
+	flag.Parse()
 
-	if err != nil {
-		log.Fatalf("cannot initialize Service Principal credentials: %s", err.Error())
+	if err = parseDNSFlags(); err != nil {
+		log.Fatalf("invalid DNS configuration: %s", err.Error())
 	}
 
-	flag.Parse()
+	if err = parseNSGFlags(); err != nil {
+		log.Fatalf("invalid NSG configuration: %s", err.Error())
+	}
 
-	// set up signals so we handle the first shutdown signal gracefully
-	stopCh := signals.SetupSignalHandler()
+	if err = parseIPConfigFlags(); err != nil {
+		log.Fatalf("invalid IP configuration selection: %s", err.Error())
+	}
+
+	if err = parseLeaderElectionFlags(); err != nil {
+		log.Fatalf("invalid leader election configuration: %s", err.Error())
+	}
+
+	if workers < 1 {
+		log.Fatalf("--workers must be at least 1")
+	}
+	if batchConcurrency < 1 {
+		log.Fatalf("--batch-concurrency must be at least 1")
+	}
+	if publicIPsPerNode < 1 || publicIPsPerNode > maxPublicIPsPerNode {
+		log.Fatalf("--public-ips-per-node must be between 1 and --max-public-ips-per-node")
+	}
+	if publicIPQuotaThreshold < 0 {
+		log.Fatalf("--public-ip-quota-threshold must not be negative")
+	}
+	if syncBackoffBase <= 0 || syncBackoffMax < syncBackoffBase {
+		log.Fatalf("--sync-backoff-base must be greater than zero, and not greater than --sync-backoff-max")
+	}
+	if maxSyncAttempts < 0 {
+		log.Fatalf("--max-sync-attempts must not be negative")
+	}
+	subscriptionLimits = newConcurrencyLimits(maxConcurrentPerSubscription)
+	armRateLimiter = helpers.NewARMRateLimiter(armReadQPS, armReadBurst, armWriteQPS, armWriteBurst)
+
+	if dryRun {
+		dryRunPlan = helpers.NewPlan(dryRunReport)
+	}
 
 	var config *rest.Config
 	if len(kubeconfig) > 0 {
@@ -63,75 +188,412 @@ func main() {
 		log.Fatalf("failed to create client: %v", err)
 	}
 
-	namespace := os.Getenv("POD_NAMESPACE")
-	if namespace == "" {
-		namespace = metav1.NamespaceDefault
+	kubeClient := kubernetes.NewForConfigOrDie(config)
+
+	clusters, err := getClusters(kubeClient)
+	if err != nil {
+		log.Fatalf("cannot initialize clusters: %s", err.Error())
 	}
 
-	kubeClient := kubernetes.NewForConfigOrDie(config)
+	// set up signals so we handle the first shutdown signal gracefully
+	ctx := signals.SetupSignalContext()
+
+	// a subcommand runs a one-off operation instead of the controller
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(ctx, clusters, flag.Args()))
+	}
+
+	if metricsAddress != "" {
+		go serveMetrics(metricsAddress)
+	}
+
+	journal = newOperationJournal(kubeClient, leaderElectionNamespace, leaderElectionLockName+"-operations")
+	byoIPs = newBYOIPStore(kubeClient, leaderElectionNamespace, leaderElectionLockName+"-byoips")
 
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(log.Infof)
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: id})
 
-	// we use the ConfigMap lock type since edits to ConfigMaps are less common
-	// and fewer objects in the cluster watch "all ConfigMaps" (unlike the older
-	// Endpoints lock type, where quite a few system agents like the kube-proxy
-	// and ingress controllers must watch endpoints).
-	lock := &resourcelock.ConfigMapLock{
-		ConfigMapMeta: metav1.ObjectMeta{
-			Namespace: namespace,
-			Name:      configMapName,
-		},
-		Client: kubeClient.CoreV1(),
-		LockConfig: resourcelock.ResourceLockConfig{
+	// Lease locks are the default, the ConfigMap lock of older versions is still available,
+	// as well as the configmapsleases multi-lock that holds both while migrating from one to the other
+	lock, err := resourcelock.New(leaderElectionLockType, leaderElectionNamespace, leaderElectionLockName,
+		kubeClient.CoreV1(), kubeClient.CoordinationV1(), resourcelock.ResourceLockConfig{
 			Identity:      id,
 			EventRecorder: recorder,
-		},
+		})
+	if err != nil {
+		log.Fatalf("cannot create leader election lock: %s", err.Error())
 	}
 
-	// start the leader election code loop
-	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
-		Lock:          lock,
-		LeaseDuration: 60 * time.Second,
-		RenewDeadline: 15 * time.Second,
-		RetryPeriod:   5 * time.Second,
-		Callbacks: leaderelection.LeaderCallbacks{
-			OnStartedLeading: func(_ context.Context) {
-				// we're notified when we start - this is where you would
-				// usually put your code
-				log.Printf("%s: leading - leader election", id)
-				sharedInformers := informers.NewSharedInformerFactory(kubeClient, 10*time.Minute)
+	if err := runLeaderElection(ctx, id, lock, clusters); err != nil {
+		log.Errorf("%s: %s", id, err.Error())
+		os.Exit(1)
+	}
+	log.Printf("%s: done - leader election", id)
+}
+
+// runLeaderElection takes part in the leader election till ctx is cancelled, and runs the controllers while leading.
+// When leadership is lost, the controllers stop and the process tries to acquire it again.
+// It returns an error only if a controller failed
+func runLeaderElection(ctx context.Context, id string, lock resourcelock.Interface, clusters []*cluster) error {
+	for {
+		termCtx, cancel := context.WithCancel(ctx)
+		run := &leaderRun{cancel: cancel}
+		elector, err := leaderelection.NewLeaderElector(newLeaderElectionConfig(id, lock, clusters, run))
+		if err != nil {
+			cancel()
+			return fmt.Errorf("invalid leader election configuration: %s", err.Error())
+		}
+		elector.Run(termCtx)
+		cancel()
+
+		if run.err != nil {
+			return run.err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("%s: trying to acquire leadership again - leader election", id)
+	}
+}
+
+// leaderRun tracks the controllers started by OnStartedLeading, so that OnStoppedLeading can wait for them to drain
+type leaderRun struct {
+	lock    sync.Mutex
+	stopped bool
+	running sync.WaitGroup
+	// cancel gives up leadership, it is called when a controller fails
+	cancel context.CancelFunc
+	// err is the first controller failure
+	err error
+}
+
+// start returns false if leadership has already been lost, in which case the controllers must not start
+func (r *leaderRun) start() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return false
+	}
+	r.running.Add(1)
+	return true
+}
 
-				controller := NewNodeController(kubeClient, sharedInformers.Core().V1().Nodes(), &helpers.IPUpdate{})
+// stop waits for the controllers to drain
+func (r *leaderRun) stop() {
+	r.lock.Lock()
+	r.stopped = true
+	r.lock.Unlock()
+	r.running.Wait()
+}
 
-				go sharedInformers.Start(stopCh)
+// fail records the failure of a controller and gives up leadership, which stops the controllers of the other clusters
+func (r *leaderRun) fail(err error) {
+	r.lock.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.lock.Unlock()
+	r.cancel()
+}
 
-				if err = controller.Run(1, stopCh); err != nil {
-					log.Fatalf("Error running controller: %s", err.Error())
+// newLeaderElectionConfig returns the leader election configuration that runs the controllers of all the clusters while leading.
+// The controllers stop when leadership is lost, and the elector only returns once they have drained
+func newLeaderElectionConfig(id string, lock resourcelock.Interface, clusters []*cluster, run *leaderRun) leaderelection.LeaderElectionConfig {
+	return leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaderElectionLeaseDuration,
+		RenewDeadline: leaderElectionRenewDeadline,
+		RetryPeriod:   leaderElectionRetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				if !run.start() {
+					return
+				}
+				defer run.running.Done()
+				log.Printf("%s: leading - leader election", id)
+				var wg sync.WaitGroup
+				for _, cl := range clusters {
+					wg.Add(1)
+					go func(cl *cluster) {
+						defer wg.Done()
+						if err := runCluster(ctx, cl); err != nil {
+							run.fail(fmt.Errorf("error running controller of cluster %s: %s", cl.name, err.Error()))
+						}
+					}(cl)
 				}
+				wg.Wait()
 			},
 			OnStoppedLeading: func() {
-				// we can do cleanup here, or after the RunOrDie method
-				// returns
-				log.Printf("%s: lost - leader election", id)
+				log.Printf("%s: not leading - leader election", id)
+				run.stop()
 			},
 		},
-	})
+	}
+}
 
-	// because the context is closed, the client should report errors
-	_, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(configMapName, metav1.GetOptions{})
-	if err == nil || !strings.Contains(err.Error(), "the leader is shutting down") {
-		log.Fatalf("%s: expected to get an error when trying to make a client call: %v", id, err)
+// getClusters returns the clusters this process will manage
+// By default, this is only the cluster the controller runs in, using the kubeClient and the Service Principal of this cluster.
+// If --contexts is set, each kubeconfig context is a separate cluster, with its Service Principal details
+// read from <azure-config-dir>/<context>.json
+func getClusters(kubeClient kubernetes.Interface) ([]*cluster, error) {
+	if clusterContexts == "" {
+		sp, err := helpers.InitializeServicePrincipalDetails()
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialize Service Principal credentials: %s", err.Error())
+		}
+		return []*cluster{newCluster(defaultClusterName, kubeClient, sp)}, nil
 	}
 
-	// we no longer hold the lease, so perform any cleanup and then
-	// exit
-	log.Printf("%s: done - leader election", id)
+	var clusters []*cluster
+	for _, contextName := range strings.Split(clusterContexts, ",") {
+		contextName = strings.TrimSpace(contextName)
+		if contextName == "" {
+			continue
+		}
+
+		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+			&clientcmd.ConfigOverrides{CurrentContext: contextName}).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("cannot create client for context %s: %s", contextName, err.Error())
+		}
+		contextClient, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create client for context %s: %s", contextName, err.Error())
+		}
+
+		sp, err := helpers.LoadServicePrincipalDetails(filepath.Join(azureConfigDir, contextName+".json"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialize Service Principal credentials for context %s: %s", contextName, err.Error())
+		}
+
+		clusters = append(clusters, newCluster(contextName, contextClient, sp))
+	}
+
+	if len(clusters) == 0 {
+		return nil, fmt.Errorf("no kubeconfig contexts found in --contexts")
+	}
+	return clusters, nil
+}
+
+// parseDNSFlags validates the DNS integration and Public IP DNS label flags
+func parseDNSFlags() error {
+	if publicIPDNSLabelTemplate != "" {
+		var err error
+		publicIPLabelTemplate, err = template.New("label").Parse(publicIPDNSLabelTemplate)
+		if err != nil {
+			return fmt.Errorf("cannot parse --public-ip-dns-label-template: %s", err.Error())
+		}
+	}
+
+	if dnsZoneName == "" {
+		return nil
+	}
+	if dnsZoneResourceGroup == "" {
+		return fmt.Errorf("--dns-zone-resource-group is required when --dns-zone is set")
+	}
+	var err error
+	dnsRecordNameTemplate, err = template.New("dns").Parse(dnsRecordTemplate)
+	if err != nil {
+		return fmt.Errorf("cannot parse --dns-record-template: %s", err.Error())
+	}
+	return nil
+}
+
+// parseNSGFlags validates the NSG management flags, if NSG management is enabled
+func parseNSGFlags() error {
+	if !manageNSG {
+		return nil
+	}
+	if nsgTarget != helpers.NSGTargetAuto && nsgTarget != helpers.NSGTargetNIC && nsgTarget != helpers.NSGTargetSubnet {
+		return fmt.Errorf("--nsg-target must be one of %s, %s or %s", helpers.NSGTargetAuto, helpers.NSGTargetNIC, helpers.NSGTargetSubnet)
+	}
+	if nsgBasePriority < 100 || nsgBasePriority > 4096 {
+		return fmt.Errorf("--nsg-rule-priority must be between 100 and 4096")
+	}
+	var err error
+	defaultNSGRules, err = helpers.ParseSecurityRules(nsgRules)
+	if err != nil {
+		return fmt.Errorf("cannot parse --nsg-rules: %s", err.Error())
+	}
+	return nil
+}
+
+// parseIPConfigFlags compiles the NIC and IP configuration selection flags
+func parseIPConfigFlags() error {
+	ipConfigSelector = helpers.IPConfigSelector{Subnet: ipConfigSubnet, SecondaryIPConfigName: secondaryIPConfigName}
+	var err error
+	if nicNamePattern != "" {
+		if ipConfigSelector.NICName, err = regexp.Compile(nicNamePattern); err != nil {
+			return fmt.Errorf("cannot parse --nic-name-pattern: %s", err.Error())
+		}
+	}
+	if ipConfigNamePattern != "" {
+		if ipConfigSelector.IPConfigName, err = regexp.Compile(ipConfigNamePattern); err != nil {
+			return fmt.Errorf("cannot parse --ipconfig-name-pattern: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func parseLeaderElectionFlags() error {
+	switch leaderElectionLockType {
+	case resourcelock.LeasesResourceLock, resourcelock.ConfigMapsResourceLock, resourcelock.ConfigMapsLeasesResourceLock:
+	default:
+		return fmt.Errorf("--leader-elect-lock-type must be one of %s, %s or %s", resourcelock.LeasesResourceLock,
+			resourcelock.ConfigMapsResourceLock, resourcelock.ConfigMapsLeasesResourceLock)
+	}
+	if leaderElectionLockName == "" {
+		return fmt.Errorf("--leader-elect-lock-name must not be empty")
+	}
+	if leaderElectionNamespace == "" {
+		leaderElectionNamespace = os.Getenv("POD_NAMESPACE")
+	}
+	if leaderElectionNamespace == "" {
+		leaderElectionNamespace = metav1.NamespaceDefault
+	}
+	// the same checks leaderelection.NewLeaderElector does, so we fail with a clear message instead of a panic
+	if leaderElectionRetryPeriod <= 0 {
+		return fmt.Errorf("--leader-elect-retry-period must be greater than zero")
+	}
+	if leaderElectionLeaseDuration <= leaderElectionRenewDeadline {
+		return fmt.Errorf("--leader-elect-lease-duration must be greater than --leader-elect-renew-deadline")
+	}
+	if leaderElectionRenewDeadline <= time.Duration(leaderelection.JitterFactor*float64(leaderElectionRetryPeriod)) {
+		return fmt.Errorf("--leader-elect-renew-deadline must be greater than %.1f times --leader-elect-retry-period", leaderelection.JitterFactor)
+	}
+	// a new leader may take over once the lease expires, the old one must have stopped by then
+	if drainTimeout < 0 || drainTimeout >= leaderElectionLeaseDuration {
+		return fmt.Errorf("--drain-timeout must be between 0 and --leader-elect-lease-duration")
+	}
+	return nil
+}
+
+// newCluster creates the ARM updaters for a cluster
+func newCluster(name string, kubeClient kubernetes.Interface, sp *helpers.ServicePrincipalDetails) *cluster {
+	ipUpdate := helpers.NewIPUpdate(sp, log.WithField("cluster", name))
+	ipUpdate.SetRateLimiter(armRateLimiter)
+	ipUpdate.SetNICCacheTTL(nicCacheTTL)
+	ipUpdate.SetIPConfigSelector(ipConfigSelector)
+	cl := &cluster{
+		name:              name,
+		subscriptionID:    sp.SubscriptionID,
+		ipSubscriptionID:  sp.IPSubscriptionID,
+		dnsSubscriptionID: dnsZoneSubscription,
+		kubeClient:        kubeClient,
+		ipUpdater:         ipUpdate,
+	}
+	if cl.ipSubscriptionID == "" {
+		cl.ipSubscriptionID = sp.SubscriptionID
+	}
+	if cl.dnsSubscriptionID == "" {
+		cl.dnsSubscriptionID = sp.SubscriptionID
+	}
+	if dnsZoneName != "" {
+		cl.dnsUpdater = helpers.NewDNSUpdate(ipUpdate, helpers.DNSZoneDetails{
+			Name:           dnsZoneName,
+			ResourceGroup:  dnsZoneResourceGroup,
+			SubscriptionID: dnsZoneSubscription,
+			TTL:            dnsRecordTTL,
+		})
+	}
+	if manageNSG {
+		cl.nsgUpdater = helpers.NewNSGUpdate(ipUpdate, nsgTarget, int32(nsgBasePriority))
+	}
+	return cl
+}
+
+// runCluster creates an independent informer factory and NodeController for the designated cluster
+// and blocks till ctx is cancelled and the controller has drained
+func runCluster(ctx context.Context, cl *cluster) error {
+	sharedInformers := informers.NewSharedInformerFactory(cl.kubeClient, 10*time.Minute)
+	controller := newClusterController(cl, sharedInformers)
+
+	go sharedInformers.Start(ctx.Done())
+
+	return controller.Run(ctx, workers)
+}
+
+// newClusterController returns a NodeController for the designated cluster, configured from the command line flags
+func newClusterController(cl *cluster, sharedInformers informers.SharedInformerFactory) *NodeController {
+	controller := NewNodeController(cl.name, cl.kubeClient, sharedInformers.Core().V1().Nodes(), cl.ipUpdater)
+	if cl.dnsUpdater != nil {
+		controller.EnableDNS(cl.dnsUpdater, dnsRecordNameTemplate)
+	}
+	if publicIPLabelTemplate != nil {
+		controller.EnablePublicIPDNSLabel(publicIPLabelTemplate)
+	}
+	if cl.nsgUpdater != nil {
+		controller.EnableNSG(cl.nsgUpdater, defaultNSGRules)
+	}
+	controller.drainTimeout = drainTimeout
+	controller.poolLimits = newConcurrencyLimits(maxConcurrentPerPool)
+	controller.subscriptionLimits = subscriptionLimits
+	controller.subscriptionID = cl.subscriptionID
+	controller.ipSubscriptionID = cl.ipSubscriptionID
+	controller.dnsSubscriptionID = cl.dnsSubscriptionID
+	controller.journal = journal
+	controller.byoIPStore = byoIPs
+	controller.batchSyncPeriod = batchSyncPeriod
+	controller.batchConcurrency = batchConcurrency
+	controller.defaultPublicIPsPerNode = publicIPsPerNode
+	controller.maxPublicIPsPerNode = maxPublicIPsPerNode
+	controller.publicIPQuotaThreshold = publicIPQuotaThreshold
+	controller.syncBackoffBase = syncBackoffBase
+	controller.syncBackoffMax = syncBackoffMax
+	controller.maxSyncAttempts = maxSyncAttempts
+	if dryRunPlan != nil {
+		controller.EnableDryRun(dryRunPlan)
+	}
+	return controller
 }
 
 func init() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	flag.StringVar(&clusterContexts, "contexts", "", "Comma separated list of kubeconfig contexts, each one of them is managed as a separate cluster. If empty, only the current cluster is managed.")
+	flag.StringVar(&azureConfigDir, "azure-config-dir", "/akssp", "Directory containing a <context>.json file (azure.json format) with the Service Principal details of each cluster in --contexts.")
+	flag.StringVar(&defaultClusterName, "cluster-name", "default", "Name of the current cluster, used in logs. Ignored when --contexts is set.")
+	flag.StringVar(&dnsZoneName, "dns-zone", "", "Azure DNS zone that will hold an A/AAAA record for each Node's Public IP. DNS integration is disabled if empty.")
+	flag.StringVar(&dnsZoneResourceGroup, "dns-zone-resource-group", "", "Resource Group of the Azure DNS zone.")
+	flag.StringVar(&dnsZoneSubscription, "dns-zone-subscription", "", "Subscription of the Azure DNS zone. Defaults to the cluster's Subscription.")
+	flag.StringVar(&dnsRecordTemplate, "dns-record-template", "{{.NodeName}}", "Go template for the DNS record name. Available fields are .Cluster, .NodeName, .NodePool and .NodeIndex.")
+	flag.Int64Var(&dnsRecordTTL, "dns-record-ttl", 300, "TTL, in seconds, of the DNS records.")
+	flag.BoolVar(&manageNSG, "manage-nsg", false, "Add inbound rules for the Nodes' Public IPs to the NSG of their NIC or subnet.")
+	flag.StringVar(&nsgRules, "nsg-rules", "", "Comma separated list of protocol:portRange inbound rules, e.g. tcp:7000-8000,udp:7777. Nodes can override it via the aksnodepublicip/nsg-rules annotation.")
+	flag.StringVar(&nsgTarget, "nsg-target", helpers.NSGTargetAuto, "NSG that gets the rules, one of auto (NIC's NSG, or subnet's NSG if the NIC has none), nic or subnet.")
+	flag.IntVar(&nsgBasePriority, "nsg-rule-priority", 2000, "Priority of the first rule the controller creates, next rules get the next free priorities.")
+	flag.StringVar(&leaderElectionLockType, "leader-elect-lock-type", resourcelock.LeasesResourceLock, "Leader election lock, one of leases, configmaps (used by older versions) or configmapsleases (holds both, to migrate from configmaps to leases).")
+	flag.StringVar(&leaderElectionLockName, "leader-elect-lock-name", "leaderlockpublicip", "Name of the leader election Lease and/or ConfigMap.")
+	flag.StringVar(&leaderElectionNamespace, "leader-elect-namespace", "", "Namespace of the leader election lock. Defaults to the POD_NAMESPACE environment variable, or default.")
+	flag.DurationVar(&leaderElectionLeaseDuration, "leader-elect-lease-duration", 60*time.Second, "How long a standby waits, after the last renewal, before it takes over leadership.")
+	flag.DurationVar(&leaderElectionRenewDeadline, "leader-elect-renew-deadline", 15*time.Second, "How long the leader keeps trying to renew its lease before it gives up leadership.")
+	flag.DurationVar(&leaderElectionRetryPeriod, "leader-elect-retry-period", 5*time.Second, "How long the candidates wait between attempts to acquire or renew the lease.")
+	flag.IntVar(&workers, "workers", 1, "Number of Nodes each cluster's controller processes at the same time.")
+	flag.IntVar(&maxConcurrentPerPool, "max-concurrent-per-pool", 5, "Maximum number of Public IP creations and deletions that run at the same time in a node pool. 0 means no limit.")
+	flag.IntVar(&maxConcurrentPerSubscription, "max-concurrent-per-subscription", 10, "Maximum number of Public IP creations and deletions that run at the same time in a subscription, across all clusters. 0 means no limit.")
+	flag.Float64Var(&armReadQPS, "arm-read-qps", 5, "Sustained ARM read requests per second in each subscription, shared by all clusters. 0 means no limit.")
+	flag.IntVar(&armReadBurst, "arm-read-burst", 50, "Burst of ARM read requests above --arm-read-qps.")
+	flag.Float64Var(&armWriteQPS, "arm-write-qps", 1, "Sustained ARM write requests per second in each subscription, shared by all clusters. 0 means no limit.")
+	flag.IntVar(&armWriteBurst, "arm-write-burst", 20, "Burst of ARM write requests above --arm-write-qps.")
+	flag.DurationVar(&nicCacheTTL, "nic-cache-ttl", 10*time.Minute, "How long the NIC of each VM is cached. The cache is filled with a single List of the cluster's VMs. 0 disables it.")
+	flag.StringVar(&nicNamePattern, "nic-name-pattern", "", "Regular expression the name of the NIC a Node's Public IP is attached to must match. Defaults to the VM's primary NIC.")
+	flag.StringVar(&ipConfigNamePattern, "ipconfig-name-pattern", "", "Regular expression the name of the IP configuration a Node's Public IP is attached to must match. Defaults to the NIC's primary IP configuration.")
+	flag.StringVar(&ipConfigSubnet, "subnet", "", "Name or ID of the subnet of the NIC and IP configuration a Node's Public IP is attached to.")
+	flag.StringVar(&secondaryIPConfigName, "secondary-ipconfig-name", "", "If set, the Public IP is attached to a secondary IP configuration with this name, which the controller creates in the subnet of the selected IP configuration, leaving the other IP configurations alone.")
+	flag.IntVar(&publicIPsPerNode, "public-ips-per-node", 1, "Number of Public IPs of the Nodes without the aksnodepublicip/public-ip-count annotation.")
+	flag.IntVar(&maxPublicIPsPerNode, "max-public-ips-per-node", 1, "Maximum number of Public IPs a Node can request with the aksnodepublicip/public-ip-count annotation. Secondary Public IPs are only managed when this is greater than 1.")
+	flag.IntVar(&publicIPQuotaThreshold, "public-ip-quota-threshold", 0, "Public IP quota of the subscription to leave free. The controller does not create Public IPs that would make the remaining quota, reported by the Network usage API, go below it.")
+	flag.DurationVar(&syncBackoffBase, "sync-backoff-base", defaultSyncBackoffBase, "How long a Node waits before it is retried after a failed sync. The wait doubles with every failure in a row, up to --sync-backoff-max.")
+	flag.DurationVar(&syncBackoffMax, "sync-backoff-max", defaultSyncBackoffMax, "Longest wait before a Node whose syncs keep failing is retried.")
+	flag.IntVar(&maxSyncAttempts, "max-sync-attempts", defaultMaxSyncAttempts, "Number of syncs of a Node that can fail in a row before the controller gives up on it and sets its aksnodepublicip/sync-failed annotation. 0 means no limit.")
+	flag.DurationVar(&batchSyncPeriod, "batch-sync-period", 0, "How often all the Nodes, NICs and Public IPs of each cluster are listed at once and reconciled, on top of the per-Node syncs. 0 disables the batch sync.")
+	flag.IntVar(&batchConcurrency, "batch-concurrency", defaultBatchConcurrency, "Number of operations the batch sync runs at the same time, still subject to the per pool and per subscription limits.")
+	flag.StringVar(&metricsAddress, "metrics-address", ":8080", "Address the Prometheus metrics are served on, at /metrics. Disabled if empty.")
+	flag.DurationVar(&drainTimeout, "drain-timeout", defaultDrainTimeout, "How long the controller waits for in-flight Azure operations when it shuts down or loses leadership, before it cancels them and records them for the next leader. Keep it below --leader-elect-lease-duration.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log and record as Events the changes the controller would make to Azure and to the Nodes, without making them.")
+	flag.StringVar(&dryRunReport, "dry-run-report", "/tmp/aksnodepublicip-plan.json", "Path of the JSON report with the planned changes in --dry-run mode. Disabled if empty.")
+	flag.StringVar(&publicIPDNSLabelTemplate, "public-ip-dns-label-template", "", "Go template for the DNS label of the Public IPs, which gives them a <label>.<region>.cloudapp.azure.com FQDN. Uses the same fields as --dns-record-template. Disabled if empty.")
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var throttledRequeues = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "aksnodepublicip_throttled_requeues_total",
+	Help: "Nodes that were requeued because ARM was throttling requests, by cluster.",
+}, []string{"cluster"})
+
+var batchSyncOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "aksnodepublicip_batch_sync_operations_total",
+	Help: "Operations started by the batch sync, by cluster and operation (create or delete).",
+}, []string{"cluster", "operation"})
+
+var syncErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "aksnodepublicip_sync_errors_total",
+	Help: "Failed Node syncs, by cluster, error class and action (requeue, give_up or wait_for_quota).",
+}, []string{"cluster", "class", "action"})
+
+var publicIPQuotaRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "aksnodepublicip_public_ip_quota_remaining",
+	Help: "Public IPs that can still be created in the subscription and location of the cluster's Public IPs, by cluster.",
+}, []string{"cluster"})
+
+var publicIPQuotaRefusals = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "aksnodepublicip_public_ip_quota_refusals_total",
+	Help: "Public IP creations the controller did not start because the remaining quota was below the threshold, by cluster.",
+}, []string{"cluster"})
+
+func init() {
+	prometheus.MustRegister(throttledRequeues, batchSyncOperations, syncErrors, publicIPQuotaRemaining, publicIPQuotaRefusals)
+}
+
+// serveMetrics serves the Prometheus metrics of the controller and of the ARM clients
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("Serving metrics on %s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Errorf("cannot serve metrics: %s", err.Error())
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/annotations"
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+const (
+	nsgRulesAnnotation        = annotations.NSGRules
+	nsgAnnotation             = annotations.NSG
+	nsgAppliedRulesAnnotation = annotations.NSGAppliedRules
+
+	successCreatingNSGRules = "SuccessCreatingNSGRules"
+	errorCreatingNSGRules   = "ErrorCreatingNSGRules"
+)
+
+// nsgState keeps the NSGs the controller has added rules to, so they can be cleaned up
+// when the last Node that uses them is gone
+type nsgState struct {
+	lock        sync.Mutex
+	managedNSGs map[string]struct{}
+}
+
+// EnableNSG makes the controller add inbound rules to the Nodes' NSGs. defaultRules are used
+// for Nodes without the nsgRulesAnnotation
+func (c *NodeController) EnableNSG(nsgUpdater helpers.NSGUpdater, defaultRules []helpers.SecurityRule) {
+	c.nsgUpdater = nsgUpdater
+	c.defaultNSGRules = defaultRules
+	c.nsgs.managedNSGs = make(map[string]struct{})
+}
+
+// getNSGRules returns the rules for the designated Node
+func (c *NodeController) getNSGRules(node *corev1.Node) ([]helpers.SecurityRule, error) {
+	if r, ok := node.Annotations[nsgRulesAnnotation]; ok {
+		return helpers.ParseSecurityRules(r)
+	}
+	return c.defaultNSGRules, nil
+}
+
+// ensureNSGRules makes the rules of a Node that has a Public IP the only rules of the Node in its NSG,
+// so rules removed from the nsgRulesAnnotation are deleted as well.
+// The NSG and the applied rules are kept in annotations on the Node, so we don't call ARM on every sync
+func (c *NodeController) ensureNSGRules(ctx context.Context, node *corev1.Node) error {
+	rules, err := c.getNSGRules(node)
+	if err != nil {
+		// requeueing does not help till the annotation is fixed
+		c.recorder.Event(node, corev1.EventTypeWarning, errorCreatingNSGRules, err.Error())
+		return nil
+	}
+
+	appliedRules := securityRulesToString(rules)
+	if nsgID, ok := node.Annotations[nsgAnnotation]; ok && node.Annotations[nsgAppliedRulesAnnotation] == appliedRules {
+		c.nsgs.add(nsgID)
+		return nil
+	}
+
+	if _, ok := node.Annotations[nsgAnnotation]; !ok && len(rules) == 0 {
+		return nil
+	}
+
+	done, err := c.startARMOperation(ctx, node.Name, operationNSG)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	nsgID, err := c.nsgUpdater.EnsureSecurityRules(ctx, node.Name, rules)
+	if err != nil {
+		c.recorder.Event(node, corev1.EventTypeWarning, errorCreatingNSGRules, err.Error())
+		return err
+	}
+	c.nsgs.add(nsgID)
+
+	if err := c.setAnnotationToNode(node.Name, nsgAnnotation, nsgID); err != nil {
+		return err
+	}
+	if err := c.setAnnotationToNode(node.Name, nsgAppliedRulesAnnotation, appliedRules); err != nil {
+		return err
+	}
+	if c.plan == nil {
+		c.recorder.Event(node, corev1.EventTypeNormal, successCreatingNSGRules, fmt.Sprintf("Successfully added NSG rules %s for Node %s", appliedRules, node.Name))
+	}
+	return nil
+}
+
+// cleanupNSGRules removes the rules of the designated Node, that has been deleted or has released its Public IP,
+// from the NSGs that other Nodes still use, and all the cluster's rules from the NSGs that no other Node uses
+func (c *NodeController) cleanupNSGRules(ctx context.Context, nodeName string) error {
+	nodes, err := c.nodesLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	inUse := make(map[string]bool)
+	for _, node := range nodes {
+		if node.Name == nodeName {
+			continue
+		}
+		if nsgID, ok := node.Annotations[nsgAnnotation]; ok {
+			inUse[nsgID] = true
+		}
+	}
+
+	for _, nsgID := range c.nsgs.list() {
+		if inUse[nsgID] {
+			c.log.Infof("Trying to delete the rules of Node %s from NSG %s", nodeName, nsgID)
+			if err := c.nsgUpdater.DeleteSecurityRules(ctx, nsgID, nodeName); err != nil {
+				return fmt.Errorf("cannot delete the rules of Node %s from NSG %s: %s", nodeName, nsgID, err.Error())
+			}
+			continue
+		}
+		c.log.Infof("No Nodes with a Public IP use NSG %s, trying to delete its rules", nsgID)
+		if err := c.nsgUpdater.DeleteSecurityRules(ctx, nsgID, ""); err != nil {
+			return fmt.Errorf("cannot delete rules from NSG %s: %s", nsgID, err.Error())
+		}
+		c.nsgs.remove(nsgID)
+	}
+	return nil
+}
+
+func (s *nsgState) add(nsgID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.managedNSGs[nsgID] = struct{}{}
+}
+
+func (s *nsgState) remove(nsgID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.managedNSGs, nsgID)
+}
+
+func (s *nsgState) list() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var nsgIDs []string
+	for nsgID := range s.managedNSGs {
+		nsgIDs = append(nsgIDs, nsgID)
+	}
+	return nsgIDs
+}
+
+func securityRulesToString(rules []helpers.SecurityRule) string {
+	var s []string
+	for _, r := range rules {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, ",")
+}
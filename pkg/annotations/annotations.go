@@ -0,0 +1,42 @@
+// Package annotations has the names of the Node labels and annotations the controller uses,
+// so that other tools, like the kubectl-nodeip plugin, can read and set them
+package annotations
+
+const (
+	// HasPublicIPLabel is set to true on the Nodes that got a Public IP from the controller
+	HasPublicIPLabel = "HasPublicIP"
+
+	// DNSRecord holds the FQDN of the DNS record that points to the Node's Public IP
+	DNSRecord = "aksnodepublicip/dns-record"
+	// DNSRecordAddress holds the address the DNS record was last set to
+	DNSRecordAddress = "aksnodepublicip/dns-record-address"
+	// FQDN holds the <label>.<region>.cloudapp.azure.com FQDN of the Node's Public IP
+	FQDN = "aksnodepublicip/fqdn"
+
+	// NSGRules can be set on a Node to override the default NSG rules, e.g. tcp:7000-8000,udp:7777
+	NSGRules = "aksnodepublicip/nsg-rules"
+	// NSG holds the ID of the NSG the Node's rules were added to
+	NSG = "aksnodepublicip/nsg"
+	// NSGAppliedRules holds the rules that have been added to the NSG for this Node
+	NSGAppliedRules = "aksnodepublicip/nsg-applied-rules"
+
+	// PublicIPCount can be set on a Node to request more than one Public IP, e.g. 3. The additional Public IPs are attached
+	// to secondary IP configurations of the Node's NIC
+	PublicIPCount = "aksnodepublicip/public-ip-count"
+	// PublicIPs holds the addresses of all the Node's Public IPs, comma separated, the primary one first
+	PublicIPs = "aksnodepublicip/public-ips"
+
+	// PublicIPID can be set on a Node to the resource ID of an existing Public IP, which the controller attaches
+	// instead of creating one. The controller only detaches it, and never deletes it
+	PublicIPID = "aksnodepublicip/public-ip-id"
+
+	// Release can be set on a Node to make the controller detach and delete its Public IP.
+	// The Node does not get a Public IP again until the annotation is removed
+	Release = "aksnodepublicip/release"
+	// Retry can be set on a Node, to any value (e.g. a timestamp), to make the controller reconcile it right away,
+	// also when it has given up on it. The controller removes it, along with SyncFailed
+	Retry = "aksnodepublicip/retry"
+	// SyncFailed holds the last error of a Node the controller has given up on, after its retries were exhausted or
+	// because of an error that retrying would not fix. The controller does not sync the Node again until Retry is set
+	SyncFailed = "aksnodepublicip/sync-failed"
+)
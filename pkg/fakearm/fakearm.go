@@ -0,0 +1,632 @@
+// Package fakearm contains an in-process fake of the Azure Resource Manager API, used for hermetic testing.
+// It stores resources as plain JSON objects keyed by their ID and implements the behavior of
+// Virtual Machines, Network Interfaces and Public IPs that the controller depends on,
+// including Azure-AsyncOperation polling for long-running operations.
+package fakearm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	typeNetworkInterface = "networkinterfaces"
+	typePublicIP         = "publicipaddresses"
+	typeVirtualMachine   = "virtualmachines"
+
+	operationsPath = "/fakearm/operations/"
+)
+
+// Resource is an ARM resource, as it is serialized on the wire
+type Resource map[string]interface{}
+
+// Properties returns the "properties" object of the resource, creating it if it does not exist
+func (r Resource) Properties() map[string]interface{} {
+	p, ok := r["properties"].(map[string]interface{})
+	if !ok {
+		p = make(map[string]interface{})
+		r["properties"] = p
+	}
+	return p
+}
+
+// Server is a fake Azure Resource Manager
+type Server struct {
+	// URL is the base URI of the server, to be used as the ARM endpoint
+	URL string
+
+	// PollsBeforeDone is the number of times a long-running operation reports InProgress before it succeeds
+	PollsBeforeDone int
+
+	server *httptest.Server
+
+	lock       sync.Mutex
+	resources  map[string]Resource
+	operations map[string]*operation
+	nextOpID   int
+	nextIP     int
+	// nextPrivateIP starts at 4, as Azure reserves the first addresses of a subnet
+	nextPrivateIP int
+	requests      []string
+	faults        []*Fault
+	rand          *rand.Rand
+}
+
+// operation is a long-running operation
+type operation struct {
+	// remaining is the number of polls before the operation completes
+	remaining int
+	// fault, if set, changes how the operation completes
+	fault *Fault
+}
+
+// NewServer starts a new fake ARM server. Call Close when done
+func NewServer() *Server {
+	s := &Server{
+		PollsBeforeDone: 1,
+		resources:       make(map[string]Resource),
+		operations:      make(map[string]*operation),
+		nextIP:          1,
+		nextPrivateIP:   4,
+		rand:            rand.New(rand.NewSource(1)),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Requests returns the "METHOD path" of every request the server has received
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// VirtualMachineID returns the ID of a Virtual Machine
+func VirtualMachineID(subscriptionID, resourceGroup, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s", subscriptionID, resourceGroup, name)
+}
+
+// NetworkInterfaceID returns the ID of a NIC
+func NetworkInterfaceID(subscriptionID, resourceGroup, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/networkInterfaces/%s", subscriptionID, resourceGroup, name)
+}
+
+// PublicIPID returns the ID of a Public IP
+func PublicIPID(subscriptionID, resourceGroup, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/publicIPAddresses/%s", subscriptionID, resourceGroup, name)
+}
+
+// AddVirtualMachine adds a VM with a single NIC (with a single ipconfig1 IP configuration), like the ones AKS creates
+// It returns the ID of the NIC
+func (s *Server) AddVirtualMachine(subscriptionID, resourceGroup, location, name string) string {
+	nicName := name + "-nic"
+	nicID := NetworkInterfaceID(subscriptionID, resourceGroup, nicName)
+	subnetID := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet", subscriptionID, resourceGroup)
+
+	vmID := VirtualMachineID(subscriptionID, resourceGroup, name)
+
+	s.Put(nicID, Resource{
+		"location": location,
+		"properties": map[string]interface{}{
+			"primary":        true,
+			"virtualMachine": map[string]interface{}{"id": vmID},
+			"ipConfigurations": []interface{}{
+				map[string]interface{}{
+					"name": "ipconfig1",
+					"properties": map[string]interface{}{
+						"primary":                   true,
+						"privateIPAllocationMethod": "Dynamic",
+						"subnet":                    map[string]interface{}{"id": subnetID},
+					},
+				},
+			},
+		},
+	})
+	s.Put(vmID, Resource{
+		"location": location,
+		"properties": map[string]interface{}{
+			"networkProfile": map[string]interface{}{
+				"networkInterfaces": []interface{}{
+					map[string]interface{}{
+						"id":         nicID,
+						"properties": map[string]interface{}{"primary": true},
+					},
+				},
+			},
+			"instanceView": map[string]interface{}{
+				"statuses": []interface{}{
+					map[string]interface{}{"code": "ProvisioningState/succeeded"},
+					map[string]interface{}{"code": "PowerState/running"},
+				},
+			},
+		},
+	})
+	return nicID
+}
+
+// AddNetworkInterface adds a secondary NIC to an existing VM, with a single ipconfig1 IP configuration in the designated subnet
+// of the VM's virtual network. It returns the ID of the NIC
+func (s *Server) AddNetworkInterface(subscriptionID, resourceGroup, location, vmName, name, subnet string) string {
+	nicID := NetworkInterfaceID(subscriptionID, resourceGroup, name)
+	vmID := VirtualMachineID(subscriptionID, resourceGroup, vmName)
+	subnetID := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/virtualNetworks/vnet/subnets/%s", subscriptionID, resourceGroup, subnet)
+
+	s.Put(nicID, Resource{
+		"location": location,
+		"properties": map[string]interface{}{
+			"primary":        false,
+			"virtualMachine": map[string]interface{}{"id": vmID},
+			"ipConfigurations": []interface{}{
+				map[string]interface{}{
+					"name": "ipconfig1",
+					"properties": map[string]interface{}{
+						"primary":                   true,
+						"privateIPAllocationMethod": "Dynamic",
+						"subnet":                    map[string]interface{}{"id": subnetID},
+					},
+				},
+			},
+		},
+	})
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if vm, ok := s.resources[strings.ToLower(vmID)]; ok {
+		networkProfile, _ := vm.Properties()["networkProfile"].(map[string]interface{})
+		if networkProfile != nil {
+			nics, _ := networkProfile["networkInterfaces"].([]interface{})
+			networkProfile["networkInterfaces"] = append(nics, map[string]interface{}{
+				"id":         nicID,
+				"properties": map[string]interface{}{"primary": false},
+			})
+		}
+	}
+	return nicID
+}
+
+// SetUsage sets a usage of the Network usage API, e.g. PublicIPAddresses, of the designated Subscription and location
+func (s *Server) SetUsage(subscriptionID, location, name string, currentValue, limit int64) {
+	id := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Network/locations/%s/usages/%s", subscriptionID, location, name)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// usages are not resources, their name is an object
+	s.resources[strings.ToLower(id)] = Resource{
+		"name":         map[string]interface{}{"value": name, "localizedValue": name},
+		"unit":         "Count",
+		"currentValue": currentValue,
+		"limit":        limit,
+	}
+}
+
+// Get returns a copy of the resource with the designated ID, or nil if it does not exist
+func (s *Server) Get(id string) Resource {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.resources[strings.ToLower(id)]
+	if !ok {
+		return nil
+	}
+	return copyResource(r)
+}
+
+// Put stores a resource, applying the same side effects as a PUT request
+func (s *Server) Put(id string, r Resource) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.put(id, r)
+}
+
+// Delete removes a resource, applying the same side effects as a DELETE request
+func (s *Server) Delete(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.delete(id)
+}
+
+// List returns copies of all the resources of the designated type (e.g. publicIPAddresses) in the designated Resource Group
+func (s *Server) List(subscriptionID, resourceGroup, resourceType string) []Resource {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.list(fmt.Sprintf("/subscriptions/%s/resourcegroups/%s/", subscriptionID, resourceGroup), resourceType)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	if strings.HasPrefix(r.URL.Path, operationsPath) {
+		s.handleOperation(w, r)
+		return
+	}
+
+	fault := s.matchFault(r)
+	if fault != nil && fault.LRO == LRONone {
+		if fault.RetryAfter != "" {
+			w.Header().Set("Retry-After", fault.RetryAfter)
+		}
+		writeError(w, fault.StatusCode, fault.Code, fault.Message)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// /subscriptions/X/providers/Microsoft.Network/locations/Y/CheckDnsNameAvailability
+	if r.Method == http.MethodGet && strings.EqualFold(segments[len(segments)-1], "CheckDnsNameAvailability") {
+		s.handleCheckDNSNameAvailability(w, r)
+		return
+	}
+
+	providersIndex := -1
+	for i, segment := range segments {
+		if strings.EqualFold(segment, "providers") {
+			providersIndex = i
+		}
+	}
+	if providersIndex == -1 || len(segments) < providersIndex+3 {
+		writeError(w, http.StatusBadRequest, "InvalidResourceID", fmt.Sprintf("Path %s is not a valid resource path", r.URL.Path))
+		return
+	}
+
+	// /providers/Namespace/type/name/subtype/subname...: an even number of segments after the namespace is a resource,
+	// an odd one is a collection
+	if (len(segments)-providersIndex-2)%2 == 1 {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not allowed on a collection", r.Method))
+			return
+		}
+		// top level collections are listed per Resource Group (or Subscription), child collections per parent
+		prefixSegments := segments[:len(segments)-1]
+		if len(segments)-providersIndex-2 == 1 {
+			prefixSegments = segments[:providersIndex]
+		}
+		prefix := strings.ToLower("/" + strings.Join(prefixSegments, "/") + "/")
+		writeJSON(w, http.StatusOK, map[string]interface{}{"value": s.list(prefix, segments[len(segments)-1])})
+		return
+	}
+
+	id := "/" + strings.Join(segments, "/")
+	switch r.Method {
+	case http.MethodGet:
+		res, ok := s.resources[strings.ToLower(id)]
+		if !ok {
+			writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("The Resource '%s' was not found.", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+			return
+		}
+		var res Resource
+		if err := json.Unmarshal(body, &res); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", err.Error())
+			return
+		}
+		_, existed := s.resources[strings.ToLower(id)]
+		if code, message := s.validatePut(id, res); code != "" {
+			writeError(w, http.StatusBadRequest, code, message)
+			return
+		}
+		stored := s.put(id, res)
+		status := http.StatusCreated
+		if existed {
+			status = http.StatusOK
+		}
+		s.writeAsyncOperation(w, status, stored, fault)
+	case http.MethodDelete:
+		if _, ok := s.resources[strings.ToLower(id)]; !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if code, message := s.validateDelete(id); code != "" {
+			writeError(w, http.StatusBadRequest, code, message)
+			return
+		}
+		s.delete(id)
+		s.writeAsyncOperation(w, http.StatusAccepted, nil, fault)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not allowed", r.Method))
+	}
+}
+
+// writeAsyncOperation starts a long-running operation, that the client will poll via the Azure-AsyncOperation header
+// The state change has already been applied, a fault only changes what polling the operation returns
+func (s *Server) writeAsyncOperation(w http.ResponseWriter, status int, body interface{}, fault *Fault) {
+	s.nextOpID++
+	opID := fmt.Sprintf("%d", s.nextOpID)
+	s.operations[opID] = &operation{remaining: s.PollsBeforeDone, fault: fault}
+
+	w.Header().Set("Azure-AsyncOperation", s.URL+operationsPath+opID)
+	w.Header().Set("Retry-After", "0")
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, body)
+}
+
+func (s *Server) handleOperation(w http.ResponseWriter, r *http.Request) {
+	opID := strings.TrimPrefix(r.URL.Path, operationsPath)
+	op, ok := s.operations[opID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "OperationNotFound", fmt.Sprintf("Operation %s was not found", opID))
+		return
+	}
+	w.Header().Set("Retry-After", "0")
+	if op.remaining > 0 || (op.fault != nil && op.fault.LRO == LRONeverCompletes) {
+		op.remaining--
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "InProgress"})
+		return
+	}
+	delete(s.operations, opID)
+	if op.fault != nil && op.fault.LRO == LROFailed {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "Failed",
+			"error": map[string]interface{}{
+				"code":    op.fault.Code,
+				"message": op.fault.Message,
+			},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "Succeeded"})
+}
+
+func (s *Server) handleCheckDNSNameAvailability(w http.ResponseWriter, r *http.Request) {
+	label := strings.ToLower(r.URL.Query().Get("domainNameLabel"))
+	available := true
+	for _, res := range s.resources {
+		if dnsSettings, ok := res.Properties()["dnsSettings"].(map[string]interface{}); ok {
+			if l, _ := dnsSettings["domainNameLabel"].(string); strings.ToLower(l) == label {
+				available = false
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"available": available})
+}
+
+// validatePut returns an ARM error code and message if the PUT should be rejected
+func (s *Server) validatePut(id string, res Resource) (string, string) {
+	if resourceType(id) != typeNetworkInterface {
+		return "", ""
+	}
+	for _, ipConfig := range getIPConfigurations(res) {
+		ipID := getPublicIPIDOfIPConfiguration(ipConfig)
+		if ipID == "" {
+			continue
+		}
+		ip, ok := s.resources[strings.ToLower(ipID)]
+		if !ok {
+			return "InvalidResourceReference", fmt.Sprintf("Resource %s referenced by resource %s was not found.", ipID, id)
+		}
+		if attachedTo := getIPConfigurationOfPublicIP(ip); attachedTo != "" && !strings.HasPrefix(strings.ToLower(attachedTo), strings.ToLower(id)+"/") {
+			return "PublicIPAddressInUse", fmt.Sprintf("Resource %s is referencing public IP address %s that is already allocated to resource %s.", id, ipID, attachedTo)
+		}
+	}
+	return "", ""
+}
+
+// validateDelete returns an ARM error code and message if the DELETE should be rejected
+func (s *Server) validateDelete(id string) (string, string) {
+	if resourceType(id) != typePublicIP {
+		return "", ""
+	}
+	if attachedTo := getIPConfigurationOfPublicIP(s.resources[strings.ToLower(id)]); attachedTo != "" {
+		return "PublicIPAddressCannotBeDeleted", fmt.Sprintf("Public IP address %s can not be deleted since it is still allocated to resource %s.", id, attachedTo)
+	}
+	return "", ""
+}
+
+// put stores the resource and applies the side effects of the resource type. It returns the stored resource
+func (s *Server) put(id string, res Resource) Resource {
+	res = copyResource(res)
+	key := strings.ToLower(id)
+	segments := strings.Split(strings.Trim(id, "/"), "/")
+	res["id"] = id
+	res["name"] = segments[len(segments)-1]
+	res["type"] = segments[len(segments)-3] + "/" + segments[len(segments)-2]
+	props := res.Properties()
+	props["provisioningState"] = "Succeeded"
+
+	switch resourceType(id) {
+	case typePublicIP:
+		// these are set by the platform, so we keep them from the existing resource
+		if existing, ok := s.resources[key]; ok {
+			existingProps := existing.Properties()
+			for _, p := range []string{"ipConfiguration", "ipAddress"} {
+				if v, ok := existingProps[p]; ok {
+					props[p] = v
+				}
+			}
+		}
+		if props["publicIPAllocationMethod"] == "Static" && props["ipAddress"] == nil {
+			props["ipAddress"] = s.allocateIPAddress()
+		}
+		if dnsSettings, ok := props["dnsSettings"].(map[string]interface{}); ok {
+			if label, _ := dnsSettings["domainNameLabel"].(string); label != "" {
+				location, _ := res["location"].(string)
+				dnsSettings["fqdn"] = fmt.Sprintf("%s.%s.cloudapp.azure.com", label, location)
+			}
+		}
+	case typeNetworkInterface:
+		// detach the Public IPs the NIC no longer references
+		referenced := make(map[string]bool)
+		for _, ipConfig := range getIPConfigurations(res) {
+			referenced[strings.ToLower(getPublicIPIDOfIPConfiguration(ipConfig))] = true
+		}
+		if existing, ok := s.resources[key]; ok {
+			for _, ipConfig := range getIPConfigurations(existing) {
+				if ipID := getPublicIPIDOfIPConfiguration(ipConfig); !referenced[strings.ToLower(ipID)] {
+					s.detachPublicIP(ipID)
+				}
+			}
+		}
+		for _, ipConfig := range getIPConfigurations(res) {
+			name, _ := ipConfig["name"].(string)
+			ipConfigID := id + "/ipConfigurations/" + name
+			ipConfig["id"] = ipConfigID
+			if ipConfigProps, ok := ipConfig["properties"].(map[string]interface{}); ok && ipConfigProps["privateIPAddress"] == nil {
+				ipConfigProps["privateIPAddress"] = s.allocatePrivateIPAddress()
+			}
+			ipID := getPublicIPIDOfIPConfiguration(ipConfig)
+			if ipID == "" {
+				continue
+			}
+			if ip, ok := s.resources[strings.ToLower(ipID)]; ok {
+				ipProps := ip.Properties()
+				ipProps["ipConfiguration"] = map[string]interface{}{"id": ipConfigID}
+				if ipProps["ipAddress"] == nil {
+					// dynamic Public IPs get an address when they are attached
+					ipProps["ipAddress"] = s.allocateIPAddress()
+				}
+			}
+		}
+	}
+
+	s.resources[key] = res
+	return res
+}
+
+// delete removes the resource and applies the side effects of the resource type
+func (s *Server) delete(id string) {
+	key := strings.ToLower(id)
+	switch resourceType(id) {
+	case typeNetworkInterface:
+		if existing, ok := s.resources[key]; ok {
+			for _, ipConfig := range getIPConfigurations(existing) {
+				s.detachPublicIP(getPublicIPIDOfIPConfiguration(ipConfig))
+			}
+		}
+	case typeVirtualMachine:
+		// the NICs of a deleted VM are kept, but no longer reference it
+		for k, res := range s.resources {
+			if resourceType(k) != typeNetworkInterface {
+				continue
+			}
+			props := res.Properties()
+			if vm, _ := props["virtualMachine"].(map[string]interface{}); vm != nil && strings.EqualFold(fmt.Sprint(vm["id"]), id) {
+				delete(props, "virtualMachine")
+			}
+		}
+	}
+	delete(s.resources, key)
+}
+
+func (s *Server) detachPublicIP(ipID string) {
+	if ipID == "" {
+		return
+	}
+	ip, ok := s.resources[strings.ToLower(ipID)]
+	if !ok {
+		return
+	}
+	ipProps := ip.Properties()
+	delete(ipProps, "ipConfiguration")
+	if ipProps["publicIPAllocationMethod"] != "Static" {
+		// dynamic Public IPs lose their address when they are detached
+		delete(ipProps, "ipAddress")
+	}
+}
+
+func (s *Server) allocateIPAddress() string {
+	ip := fmt.Sprintf("20.%d.%d.%d", (s.nextIP>>16)&0xff, (s.nextIP>>8)&0xff, s.nextIP&0xff)
+	s.nextIP++
+	return ip
+}
+
+func (s *Server) allocatePrivateIPAddress() string {
+	ip := fmt.Sprintf("10.240.%d.%d", (s.nextPrivateIP>>8)&0xff, s.nextPrivateIP&0xff)
+	s.nextPrivateIP++
+	return ip
+}
+
+// list returns copies of all the resources of the designated type whose (lowercase) ID starts with prefix
+func (s *Server) list(prefix string, resourceTypeName string) []Resource {
+	var keys []string
+	for key := range s.resources {
+		if strings.HasPrefix(key, strings.ToLower(prefix)) && resourceType(key) == strings.ToLower(resourceTypeName) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := []Resource{}
+	for _, key := range keys {
+		result = append(result, copyResource(s.resources[key]))
+	}
+	return result
+}
+
+// resourceType returns the lowercase type of the resource, e.g. publicipaddresses
+func resourceType(id string) string {
+	segments := strings.Split(strings.Trim(strings.ToLower(id), "/"), "/")
+	if len(segments) < 2 {
+		return ""
+	}
+	return segments[len(segments)-2]
+}
+
+func getIPConfigurations(nic Resource) []map[string]interface{} {
+	var ipConfigs []map[string]interface{}
+	list, _ := nic.Properties()["ipConfigurations"].([]interface{})
+	for _, i := range list {
+		if ipConfig, ok := i.(map[string]interface{}); ok {
+			ipConfigs = append(ipConfigs, ipConfig)
+		}
+	}
+	return ipConfigs
+}
+
+func getPublicIPIDOfIPConfiguration(ipConfig map[string]interface{}) string {
+	props, _ := ipConfig["properties"].(map[string]interface{})
+	ip, _ := props["publicIPAddress"].(map[string]interface{})
+	id, _ := ip["id"].(string)
+	return id
+}
+
+func getIPConfigurationOfPublicIP(ip Resource) string {
+	if ip == nil {
+		return ""
+	}
+	ipConfig, _ := ip.Properties()["ipConfiguration"].(map[string]interface{})
+	id, _ := ipConfig["id"].(string)
+	return id
+}
+
+func copyResource(r Resource) Resource {
+	b, _ := json.Marshal(r)
+	var c Resource
+	_ = json.Unmarshal(b, &c)
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+		},
+	})
+}
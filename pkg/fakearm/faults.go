@@ -0,0 +1,147 @@
+package fakearm
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// LROBehavior is how a long-running operation started by a faulty request behaves
+type LROBehavior int
+
+const (
+	// LRONone means the request itself fails with the Fault's status and code
+	LRONone LROBehavior = iota
+	// LROFailed means the request is accepted, but polling its operation returns a Failed status with the Fault's code
+	LROFailed
+	// LRONeverCompletes means the request is accepted, but its operation stays InProgress forever
+	LRONeverCompletes
+)
+
+// Fault describes an error the server returns instead of handling a request
+// Faults are evaluated in the order they were added, the first one that matches a request is injected
+type Fault struct {
+	// Method is the HTTP method to match, empty matches all methods
+	Method string
+	// ResourceType is the resource type to match (e.g. publicIPAddresses), empty matches all types
+	ResourceType string
+	// NameContains matches only resources whose name contains this string, empty matches all names
+	NameContains string
+
+	// StatusCode, Code and Message describe the ARM error
+	StatusCode int
+	Code       string
+	Message    string
+	// RetryAfter, if set, is returned in the Retry-After header
+	RetryAfter string
+
+	// LRO, if set, makes the request succeed and the long-running operation it starts misbehave
+	LRO LROBehavior
+
+	// Skip is the number of matching requests that are handled normally before the fault starts being injected
+	Skip int
+	// Times is the number of times the fault is injected, 0 means forever
+	Times int
+	// Rate is the probability (0 to 1] a matching request gets the fault. 0 means always
+	Rate float64
+
+	injected int
+}
+
+// Throttled returns a Fault for an ARM 429 throttling error
+func Throttled(method, resourceType string, times int) *Fault {
+	return &Fault{
+		Method:       method,
+		ResourceType: resourceType,
+		StatusCode:   http.StatusTooManyRequests,
+		Code:         "TooManyRequests",
+		Message:      "The request is being throttled.",
+		RetryAfter:   "0",
+		Times:        times,
+	}
+}
+
+// AnotherOperationInProgress returns a Fault for the ARM 409 error that happens when a resource is being modified concurrently
+func AnotherOperationInProgress(method, resourceType string, times int) *Fault {
+	return &Fault{
+		Method:       method,
+		ResourceType: resourceType,
+		StatusCode:   http.StatusConflict,
+		Code:         "AnotherOperationInProgress",
+		Message:      "Another operation on this or dependent resource is in progress.",
+		Times:        times,
+	}
+}
+
+// PublicIPAddressCannotBeDeleted returns a Fault for the ARM 400 error that happens when a Public IP that is still attached is deleted
+func PublicIPAddressCannotBeDeleted(times int) *Fault {
+	return &Fault{
+		Method:       http.MethodDelete,
+		ResourceType: "publicIPAddresses",
+		StatusCode:   http.StatusBadRequest,
+		Code:         "PublicIPAddressCannotBeDeleted",
+		Message:      "Public IP address can not be deleted since it is still allocated to resource.",
+		Times:        times,
+	}
+}
+
+// LROTimeout returns a Fault that makes long-running operations started by matching requests never complete
+func LROTimeout(method, resourceType string, times int) *Fault {
+	return &Fault{
+		Method:       method,
+		ResourceType: resourceType,
+		LRO:          LRONeverCompletes,
+		Times:        times,
+	}
+}
+
+// AddFault adds a fault to the server
+func (s *Server) AddFault(f *Fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = append(s.faults, f)
+}
+
+// ClearFaults removes all faults
+func (s *Server) ClearFaults() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = nil
+}
+
+// SetSeed sets the seed of the random generator used for the Fault rates, so that tests are repeatable
+func (s *Server) SetSeed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rand = rand.New(rand.NewSource(seed))
+}
+
+// matchFault returns the fault that should be injected for the designated request, if any
+func (s *Server) matchFault(r *http.Request) *Fault {
+	id := strings.ToLower(r.URL.Path)
+	segments := strings.Split(strings.Trim(id, "/"), "/")
+	for _, f := range s.faults {
+		if f.Method != "" && !strings.EqualFold(f.Method, r.Method) {
+			continue
+		}
+		if f.ResourceType != "" && resourceType(id) != strings.ToLower(f.ResourceType) {
+			continue
+		}
+		if f.NameContains != "" && !strings.Contains(segments[len(segments)-1], strings.ToLower(f.NameContains)) {
+			continue
+		}
+		if f.Skip > 0 {
+			f.Skip--
+			continue
+		}
+		if f.Times > 0 && f.injected >= f.Times {
+			continue
+		}
+		if f.Rate > 0 && s.rand.Float64() >= f.Rate {
+			continue
+		}
+		f.injected++
+		return f
+	}
+	return nil
+}
@@ -3,72 +3,248 @@ package helpers
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2017-03-30/compute"
+	"github.com/Azure/azure-sdk-for-go/services/dns/mgmt/2017-10-01/dns"
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
 
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/to"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-func getIPClient() (*network.PublicIPAddressesClient, error) {
-	ipClient := network.NewPublicIPAddressesClient(spDetails.SubscriptionID)
-	auth, err := GetResourceManagementAuthorizer()
-	if err != nil {
-		return nil, fmt.Errorf("error in getIPClient %s", err.Error())
+const (
+	// maxDomainNameLabelAttempts is the number of suffixed variations we try when a DNS label is taken
+	maxDomainNameLabelAttempts = 10
+	// minDomainNameLabelLength and maxDomainNameLabelLength are the min and max lengths of a Public IP DNS label
+	minDomainNameLabelLength = 3
+	maxDomainNameLabelLength = 63
+
+	// ownerTag is set on every Public IP the controller creates, with the resource group of the cluster's VMs as value,
+	// so that clusters sharing a Public IP resource group only clean up their own Public IPs
+	ownerTag = "aksnodepublicip-owner"
+)
+
+// clients are the ARM clients of an IPUpdate. They are created on first use and reused by all requests,
+// autorest clients are safe for concurrent use
+type clients struct {
+	ipClient      *network.PublicIPAddressesClient
+	vmClient      *compute.VirtualMachinesClient
+	nicClient     *network.InterfacesClient
+	networkClient *network.BaseClient
+	usagesClient  *network.UsagesClient
+
+	// the clients of resources that may live in any Subscription, keyed by the lowercase Subscription ID
+	foreignIPClients     map[string]*network.PublicIPAddressesClient
+	securityRulesClients map[string]*network.SecurityRulesClient
+	subnetsClients       map[string]*network.SubnetsClient
+	recordSetsClients    map[string]*dns.RecordSetsClient
+}
+
+func (u *IPUpdate) getIPClient() (*network.PublicIPAddressesClient, error) {
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	if u.clients.ipClient != nil {
+		return u.clients.ipClient, nil
 	}
-	ipClient.Authorizer = auth
+	// Public IPs may live in a different Subscription than the VMs and the NICs
+	ipClient := network.NewPublicIPAddressesClientWithBaseURI(u.baseURI(), u.sp.IPSubscriptionID)
+	if err := u.configureClient(&ipClient.Client); err != nil {
+		return nil, wrapError(err, "error in getIPClient")
+	}
+	u.clients.ipClient = &ipClient
 	return &ipClient, nil
 }
 
-func getVMClient() (*compute.VirtualMachinesClient, error) {
-	vmClient := compute.NewVirtualMachinesClient(spDetails.SubscriptionID)
-	auth, err := GetResourceManagementAuthorizer()
-	if err != nil {
-		return nil, fmt.Errorf("error in getVMClient %s", err.Error())
+func (u *IPUpdate) getVMClient() (*compute.VirtualMachinesClient, error) {
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	if u.clients.vmClient != nil {
+		return u.clients.vmClient, nil
+	}
+	vmClient := compute.NewVirtualMachinesClientWithBaseURI(u.baseURI(), u.sp.SubscriptionID)
+	if err := u.configureClient(&vmClient.Client); err != nil {
+		return nil, wrapError(err, "error in getVMClient")
 	}
-	vmClient.Authorizer = auth
+	u.clients.vmClient = &vmClient
 	return &vmClient, nil
 }
 
-func getNicClient() (*network.InterfacesClient, error) {
-	nicClient := network.NewInterfacesClient(spDetails.SubscriptionID)
-	auth, err := GetResourceManagementAuthorizer()
-	if err != nil {
-		return nil, fmt.Errorf("error in getNicClient %s", err.Error())
+func (u *IPUpdate) getNicClient() (*network.InterfacesClient, error) {
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	if u.clients.nicClient != nil {
+		return u.clients.nicClient, nil
+	}
+	nicClient := network.NewInterfacesClientWithBaseURI(u.baseURI(), u.sp.SubscriptionID)
+	if err := u.configureClient(&nicClient.Client); err != nil {
+		return nil, wrapError(err, "error in getNicClient")
 	}
-	nicClient.Authorizer = auth
+	u.clients.nicClient = &nicClient
 	return &nicClient, nil
 }
 
-func createPublicIP(ctx context.Context, ipName string) (*network.PublicIPAddress, error) {
-	ipClient, err := getIPClient()
+func (u *IPUpdate) getNetworkClient() (*network.BaseClient, error) {
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	if u.clients.networkClient != nil {
+		return u.clients.networkClient, nil
+	}
+	networkClient := network.NewWithBaseURI(u.baseURI(), u.sp.IPSubscriptionID)
+	if err := u.configureClient(&networkClient.Client); err != nil {
+		return nil, wrapError(err, "error in getNetworkClient")
+	}
+	u.clients.networkClient = &networkClient
+	return &networkClient, nil
+}
+
+func (u *IPUpdate) getUsagesClient() (*network.UsagesClient, error) {
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	if u.clients.usagesClient != nil {
+		return u.clients.usagesClient, nil
+	}
+	// the quota that matters is the one of the Subscription the Public IPs are created in
+	usagesClient := network.NewUsagesClientWithBaseURI(u.baseURI(), u.sp.IPSubscriptionID)
+	if err := u.configureClient(&usagesClient.Client); err != nil {
+		return nil, wrapError(err, "error in getUsagesClient")
+	}
+	u.clients.usagesClient = &usagesClient
+	return &usagesClient, nil
+}
+
+// getIPClientFor returns the Public IP client of the designated Subscription,
+// which is the client of getIPClient for the Subscription of the Public IPs
+func (u *IPUpdate) getIPClientFor(subscriptionID string) (*network.PublicIPAddressesClient, error) {
+	if strings.EqualFold(subscriptionID, u.sp.IPSubscriptionID) {
+		return u.getIPClient()
+	}
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	key := strings.ToLower(subscriptionID)
+	if ipClient, ok := u.clients.foreignIPClients[key]; ok {
+		return ipClient, nil
+	}
+	ipClient := network.NewPublicIPAddressesClientWithBaseURI(u.baseURI(), subscriptionID)
+	if err := u.configureClient(&ipClient.Client); err != nil {
+		return nil, wrapError(err, "error in getIPClientFor")
+	}
+	if u.clients.foreignIPClients == nil {
+		u.clients.foreignIPClients = make(map[string]*network.PublicIPAddressesClient)
+	}
+	u.clients.foreignIPClients[key] = &ipClient
+	return &ipClient, nil
+}
+
+func (u *IPUpdate) getSecurityRulesClient(subscriptionID string) (*network.SecurityRulesClient, error) {
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	key := strings.ToLower(subscriptionID)
+	if rulesClient, ok := u.clients.securityRulesClients[key]; ok {
+		return rulesClient, nil
+	}
+	rulesClient := network.NewSecurityRulesClientWithBaseURI(u.baseURI(), subscriptionID)
+	if err := u.configureClient(&rulesClient.Client); err != nil {
+		return nil, wrapError(err, "error in getSecurityRulesClient")
+	}
+	if u.clients.securityRulesClients == nil {
+		u.clients.securityRulesClients = make(map[string]*network.SecurityRulesClient)
+	}
+	u.clients.securityRulesClients[key] = &rulesClient
+	return &rulesClient, nil
+}
+
+func (u *IPUpdate) getSubnetsClient(subscriptionID string) (*network.SubnetsClient, error) {
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	key := strings.ToLower(subscriptionID)
+	if subnetsClient, ok := u.clients.subnetsClients[key]; ok {
+		return subnetsClient, nil
+	}
+	subnetsClient := network.NewSubnetsClientWithBaseURI(u.baseURI(), subscriptionID)
+	if err := u.configureClient(&subnetsClient.Client); err != nil {
+		return nil, wrapError(err, "error in getSubnetsClient")
+	}
+	if u.clients.subnetsClients == nil {
+		u.clients.subnetsClients = make(map[string]*network.SubnetsClient)
+	}
+	u.clients.subnetsClients[key] = &subnetsClient
+	return &subnetsClient, nil
+}
+
+func (u *IPUpdate) getRecordSetsClient(subscriptionID string) (*dns.RecordSetsClient, error) {
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	key := strings.ToLower(subscriptionID)
+	if recordSetsClient, ok := u.clients.recordSetsClients[key]; ok {
+		return recordSetsClient, nil
+	}
+	recordSetsClient := dns.NewRecordSetsClientWithBaseURI(u.baseURI(), subscriptionID)
+	if err := u.configureClient(&recordSetsClient.Client); err != nil {
+		return nil, wrapError(err, "error in getRecordSetsClient")
+	}
+	if u.clients.recordSetsClients == nil {
+		u.clients.recordSetsClients = make(map[string]*dns.RecordSetsClient)
+	}
+	u.clients.recordSetsClients[key] = &recordSetsClient
+	return &recordSetsClient, nil
+}
+
+// resetClients makes the next requests use new clients, after the client configuration has changed
+func (u *IPUpdate) resetClients() {
+	u.clientsLock.Lock()
+	defer u.clientsLock.Unlock()
+	u.clients = clients{}
+}
+
+// createPublicIP creates the designated Public IP. If domainNameLabel is not empty, the IP will also get
+// a <label>.<region>.cloudapp.azure.com FQDN
+func (u *IPUpdate) createPublicIP(ctx context.Context, ipName string, domainNameLabel string) (*network.PublicIPAddress, error) {
+	ipClient, err := u.getIPClient()
 	if err != nil {
 		return nil, err
 	}
+
+	properties := &network.PublicIPAddressPropertiesFormat{
+		PublicIPAddressVersion:   network.IPv4,
+		PublicIPAllocationMethod: network.Dynamic, // IPv4 address created is a dynamic one
+	}
+
+	if domainNameLabel != "" {
+		label, err := u.getAvailableDomainNameLabel(ctx, ipName, domainNameLabel)
+		if err != nil {
+			return nil, err
+		}
+		properties.DNSSettings = &network.PublicIPAddressDNSSettings{
+			DomainNameLabel: to.StringPtr(label),
+		}
+	}
+
 	future, err := ipClient.CreateOrUpdate(
 		ctx,
-		spDetails.ResourceGroup,
+		u.sp.IPResourceGroup,
 		ipName,
 		network.PublicIPAddress{
-			Name:     to.StringPtr(ipName),
-			Location: &spDetails.Location,
-			PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
-				PublicIPAddressVersion:   network.IPv4,
-				PublicIPAllocationMethod: network.Dynamic, // IPv4 address created is a dynamic one
-			},
+			Name:                            to.StringPtr(ipName),
+			Location:                        &u.sp.Location,
+			Tags:                            map[string]*string{ownerTag: to.StringPtr(u.sp.ResourceGroup)},
+			PublicIPAddressPropertiesFormat: properties,
 		},
 	)
 
 	if err != nil {
-		return nil, fmt.Errorf("cannot create Public IP address: %v", err)
+		return nil, wrapError(err, "cannot create Public IP address")
 	}
 
 	err = future.WaitForCompletion(ctx, ipClient.Client)
 	if err != nil {
-		return nil, fmt.Errorf("cannot get Public IP address CreateOrUpdate method response: %v", err)
+		return nil, wrapError(err, "cannot get Public IP address CreateOrUpdate method response")
 	}
 
 	ipAddr, err := future.Result(*ipClient)
@@ -78,188 +254,590 @@ func createPublicIP(ctx context.Context, ipName string) (*network.PublicIPAddres
 	return &ipAddr, nil
 }
 
-func getVM(ctx context.Context, vmName string) (*compute.VirtualMachine, error) {
-	vmClient, err := getVMClient()
+// invalidDomainNameLabelChars are the characters a Public IP DNS label cannot contain
+var invalidDomainNameLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// sanitizeDomainNameLabel turns label into a valid Public IP DNS label: lowercase letters, digits and dashes,
+// starting with a letter, ending with a letter or a digit, and at most maxDomainNameLabelLength long
+func sanitizeDomainNameLabel(label string) (string, error) {
+	sanitized := invalidDomainNameLabelChars.ReplaceAllString(strings.ToLower(label), "-")
+	sanitized = strings.TrimLeft(sanitized, "-0123456789")
+	if len(sanitized) > maxDomainNameLabelLength {
+		sanitized = sanitized[:maxDomainNameLabelLength]
+	}
+	sanitized = strings.TrimRight(sanitized, "-")
+	if len(sanitized) < minDomainNameLabelLength {
+		return "", fmt.Errorf("DNS label %q is not valid, it needs at least %d letters, digits or dashes, starting with a letter", label, minDomainNameLabelLength)
+	}
+	return sanitized, nil
+}
+
+// getAvailableDomainNameLabel returns the designated label, sanitized, if it is available in the region.
+// If it is already taken, a numeric suffix is appended till we find one that is available
+func (u *IPUpdate) getAvailableDomainNameLabel(ctx context.Context, ipName string, label string) (string, error) {
+	label, err := sanitizeDomainNameLabel(label)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	ipClient, err := u.getIPClient()
+	if err != nil {
+		return "", err
 	}
-	vm, err := vmClient.Get(ctx, spDetails.ResourceGroup, vmName, compute.InstanceView)
 
+	// the Public IP may already exist (e.g. when we retry), so we keep its label
+	existingIP, err := ipClient.Get(ctx, u.sp.IPResourceGroup, ipName, "")
+	if err == nil && existingIP.PublicIPAddressPropertiesFormat != nil && existingIP.DNSSettings != nil &&
+		existingIP.DNSSettings.DomainNameLabel != nil && *existingIP.DNSSettings.DomainNameLabel != "" {
+		return *existingIP.DNSSettings.DomainNameLabel, nil
+	}
+
+	networkClient, err := u.getNetworkClient()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return &vm, nil
+	for i := 0; i < maxDomainNameLabelAttempts; i++ {
+		candidate := label
+		if i > 0 {
+			suffix := fmt.Sprintf("-%d", i)
+			if len(candidate)+len(suffix) > maxDomainNameLabelLength {
+				candidate = strings.TrimRight(candidate[:maxDomainNameLabelLength-len(suffix)], "-")
+			}
+			candidate += suffix
+		}
+
+		result, err := networkClient.CheckDNSNameAvailability(ctx, u.sp.Location, candidate)
+		if err != nil {
+			return "", wrapError(err, "cannot check availability of DNS label %s", candidate)
+		}
+		if result.Available != nil && *result.Available {
+			return candidate, nil
+		}
+		u.log.Infof("DNS label %s is already taken in %s", candidate, u.sp.Location)
+	}
+
+	return "", fmt.Errorf("cannot find an available DNS label for %s after %d attempts", label, maxDomainNameLabelAttempts)
 }
 
-func getNetworkInterface(ctx context.Context, vmName string) (*network.Interface, error) {
-	log.Infof("Trying to get VM with name %s", vmName)
-	vm, err := getVM(ctx, vmName)
+// getNetworkInterface returns the NIC of the VM the Public IP goes to. The NIC ID comes from the nicCache, which is filled
+// with a single List of the VMs in the resource group, so that a scale-out doesn't GET each VM
+func (u *IPUpdate) getNetworkInterface(ctx context.Context, vmName string) (*network.Interface, error) {
+	nicID, err := u.getNICID(ctx, vmName)
 	if err != nil {
 		return nil, err
 	}
-	log.Infof("Gotten VM with name %s", vmName)
+	u.log.Infof("NIC of VM %s is %s", vmName, nicID)
 
-	if vm.NetworkProfile == nil || len(*vm.NetworkProfile.NetworkInterfaces) == 0 {
-		return nil, fmt.Errorf("Error. Network profile for VM %s is %v and len(vm.NetworkInterfaces)=%d", vmName, vm.NetworkProfile, len(*vm.NetworkProfile.NetworkInterfaces))
+	nicClient, err := u.getNicClient()
+	if err != nil {
+		return nil, err
 	}
 
-	// let's get the first NIC
-	// this will be something like /subscriptions/6bd0e514-c783-4dac-92d2-6788744eee7a/resourceGroups/MC_akslala_akslala_westeurope/providers/Microsoft.Network/networkInterfaces/aks-nodepool1-26427378-nic-0
-	nicFullName := (*vm.NetworkProfile.NetworkInterfaces)[0].ID
+	networkInterface, err := nicClient.Get(ctx, getResourceGroupFromID(nicID), getResourceName(nicID), "")
+	if err != nil {
+		// e.g. the VM was recreated with a new NIC
+		u.nics.invalidate(vmName)
+		return nil, err
+	}
+	return &networkInterface, nil
+}
 
-	log.Infof("NICFullName is %s", *nicFullName)
+// getNICID returns the ID of the NIC the ipConfigs selector picks for the VM, from the nicCache if possible
+func (u *IPUpdate) getNICID(ctx context.Context, vmName string) (string, error) {
+	if nicID, ok := u.nics.get(vmName); ok {
+		nicCacheLookups.WithLabelValues("hit").Inc()
+		return nicID, nil
+	}
+	nicCacheLookups.WithLabelValues("miss").Inc()
+
+	// a single worker lists the VMs, the others wait for it and then use the cache
+	u.nics.refreshLock.Lock()
+	defer u.nics.refreshLock.Unlock()
+	if nicID, ok := u.nics.get(vmName); ok {
+		return nicID, nil
+	}
+	if u.nics.ttl > 0 {
+		if u.ipConfigs.selectsNIC() {
+			// the selection depends on the NICs' names and subnets, which a VM does not have.
+			// Listing the selected NICs fills the cache
+			if _, err := u.ListNetworkInterfaces(ctx); err != nil {
+				return "", err
+			}
+		} else {
+			nicIDs, err := u.listNICIDs(ctx)
+			if err != nil {
+				return "", err
+			}
+			u.nics.fill(nicIDs)
+		}
+		if nicID, ok := u.nics.get(vmName); ok {
+			return nicID, nil
+		}
+	}
 
-	nicName := getResourceName(*nicFullName)
+	// not in the list, e.g. the cache is disabled or the VM is brand new
+	u.log.Infof("Trying to get VM with name %s", vmName)
+	vmClient, err := u.getVMClient()
+	if err != nil {
+		return "", err
+	}
+	vm, err := vmClient.Get(ctx, u.sp.ResourceGroup, vmName, "")
+	if err != nil {
+		return "", err
+	}
+	var nicID string
+	if u.ipConfigs.selectsNIC() {
+		nicID, err = u.selectVMNIC(ctx, vm)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		nicID = getPrimaryNICID(vm)
+	}
+	if nicID == "" {
+		return "", fmt.Errorf("VM %s has no network interfaces", vmName)
+	}
+	u.nics.set(vmName, nicID)
+	return nicID, nil
+}
 
-	nicClient, err := getNicClient()
+// listNICIDs returns the primary NIC ID of every VM in the cluster's resource group
+func (u *IPUpdate) listNICIDs(ctx context.Context) (map[string]string, error) {
+	vmClient, err := u.getVMClient()
 	if err != nil {
 		return nil, err
 	}
+	list, err := vmClient.ListComplete(ctx, u.sp.ResourceGroup)
+	if err != nil {
+		return nil, wrapError(err, "cannot list VMs")
+	}
+	nicIDs := make(map[string]string)
+	for list.NotDone() {
+		vm := list.Value()
+		if nicID := getPrimaryNICID(vm); vm.Name != nil && nicID != "" {
+			nicIDs[*vm.Name] = nicID
+		}
+		if err := list.Next(); err != nil {
+			return nil, wrapError(err, "cannot list VMs")
+		}
+	}
+	return nicIDs, nil
+}
 
-	networkInterface, err := nicClient.Get(ctx, spDetails.ResourceGroup, nicName, "")
-	return &networkInterface, err
+// getPrimaryNICID returns the ID of the VM's primary NIC, or of its first NIC if none is marked primary
+func getPrimaryNICID(vm compute.VirtualMachine) string {
+	if vm.VirtualMachineProperties == nil || vm.NetworkProfile == nil || vm.NetworkProfile.NetworkInterfaces == nil {
+		return ""
+	}
+	nics := *vm.NetworkProfile.NetworkInterfaces
+	for _, nic := range nics {
+		if nic.NetworkInterfaceReferenceProperties != nil && to.Bool(nic.Primary) {
+			return to.String(nic.ID)
+		}
+	}
+	if len(nics) > 0 {
+		// this will be something like /subscriptions/6bd0e514-c783-4dac-92d2-6788744eee7a/resourceGroups/MC_akslala_akslala_westeurope/providers/Microsoft.Network/networkInterfaces/aks-nodepool1-26427378-nic-0
+		return to.String(nics[0].ID)
+	}
+	return ""
 }
 
+// IPUpdater manages the Public IPs of the Nodes of a single cluster
 type IPUpdater interface {
-	CreateOrUpdateVMPulicIP(ctx context.Context, vmName string, ipName string) error
+	// CreateOrUpdateVMPulicIP returns the FQDN of the Public IP, if a domainNameLabel has been requested
+	CreateOrUpdateVMPulicIP(ctx context.Context, vmName string, ipName string, domainNameLabel string) (string, error)
 	DeletePublicIP(ctx context.Context, ipName string) error
 	DisassociatePublicIPForNode(ctx context.Context, nodeName string) error
+	// GetPublicIP returns the designated Public IP, or nil if it does not exist
+	GetPublicIP(ctx context.Context, ipName string) (*PublicIP, error)
+	// ListPublicIPs returns all the Public IPs the controller has created for this cluster
+	ListPublicIPs(ctx context.Context) ([]PublicIP, error)
+	// ListNetworkInterfaces returns the NICs of the cluster's VMs
+	ListNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error)
+	// SetSecondaryPublicIPs makes the VM have count secondary Public IPs, each in its own secondary IP configuration
+	// of the VM's NIC, and detaches and deletes the ones above count. It returns the secondary Public IPs, by index
+	SetSecondaryPublicIPs(ctx context.Context, vmName string, count int) ([]PublicIP, error)
+	// DeleteSecondaryPublicIPs detaches and deletes all the secondary Public IPs of the VM
+	DeleteSecondaryPublicIPs(ctx context.Context, vmName string) error
+	// AttachPublicIP attaches an existing Public IP, designated by its ID, to the VM's NIC and returns its FQDN
+	AttachPublicIP(ctx context.Context, vmName string, ipID string) (string, error)
+	// DetachPublicIP detaches the Public IP, designated by its ID, without deleting it
+	DetachPublicIP(ctx context.Context, ipID string) error
+	// GetPublicIPQuota returns the Public IP quota of the subscription in the cluster's location, nil if ARM does not report it
+	GetPublicIPQuota(ctx context.Context) (*PublicIPQuota, error)
+	// GetVMState returns whether the designated VM still exists
+	GetVMState(ctx context.Context, vmName string) (VMState, error)
+	// ListOrphanedNetworkInterfaces returns the NICs AKS created for VMs that do not exist anymore
+	ListOrphanedNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error)
+	// DeleteOrphanedNetworkInterface deletes the designated NIC, if it is still an orphan
+	DeleteOrphanedNetworkInterface(ctx context.Context, nicName string) error
+}
+
+// IPUpdate is the ARM backed IPUpdater. Each instance carries its own Service Principal details,
+// so a single process can manage the Public IPs of multiple clusters
+type IPUpdate struct {
+	sp  *ServicePrincipalDetails
+	log *log.Entry
+
+	authorizerLock sync.Mutex
+	authorizer     autorest.Authorizer
+
+	clientOptions ClientOptions
+	// rateLimiter, if set, throttles the requests of all clients
+	rateLimiter *ARMRateLimiter
+
+	clientsLock sync.Mutex
+	clients     clients
+
+	// nics caches the NIC of each VM
+	nics *nicCache
+	// ipConfigs selects the NIC and the IP configuration of each VM the Public IP is attached to
+	ipConfigs IPConfigSelector
+}
+
+// ClientOptions overrides the retry and polling behavior of the ARM clients. Zero values keep the autorest defaults
+type ClientOptions struct {
+	// RetryAttempts is the number of attempts for requests that fail with a retriable status code (e.g. 429)
+	RetryAttempts int
+	// RetryDuration is the base backoff between attempts
+	RetryDuration time.Duration
+	// PollingDelay is the delay between polls of a long-running operation, if ARM does not designate one
+	PollingDelay time.Duration
+	// PollingDuration is the max time we wait for a long-running operation to complete
+	PollingDuration time.Duration
+}
+
+// NewIPUpdate returns a new IPUpdate that uses the designated Service Principal details.
+// All log lines are written via the provided logger
+func NewIPUpdate(sp *ServicePrincipalDetails, logger *log.Entry) *IPUpdate {
+	return &IPUpdate{
+		sp:   sp,
+		log:  logger,
+		nics: newNICCache(defaultNICCacheTTL),
+	}
+}
+
+// SetAuthorizer overrides the authorizer used for ARM requests, instead of one based on the Service Principal credentials
+// This is useful for testing against a fake ARM endpoint, which needs no authorization
+func (u *IPUpdate) SetAuthorizer(a autorest.Authorizer) {
+	u.authorizerLock.Lock()
+	u.authorizer = a
+	u.authorizerLock.Unlock()
+	u.resetClients()
+}
+
+// SetClientOptions overrides the retry and polling behavior of the ARM clients
+func (u *IPUpdate) SetClientOptions(o ClientOptions) {
+	u.clientOptions = o
+	u.resetClients()
+}
+
+// SetRateLimiter makes all ARM clients wait for the designated rate limiter, which may be shared by multiple IPUpdates
+func (u *IPUpdate) SetRateLimiter(l *ARMRateLimiter) {
+	u.rateLimiter = l
+	u.resetClients()
+}
+
+// SetNICCacheTTL sets how long the NIC of each VM is cached, 0 disables the cache
+func (u *IPUpdate) SetNICCacheTTL(ttl time.Duration) {
+	u.nics = newNICCache(ttl)
+}
+
+// SetIPConfigSelector sets how the NIC and the IP configuration of each VM are selected, and empties the NIC cache
+func (u *IPUpdate) SetIPConfigSelector(s IPConfigSelector) {
+	u.ipConfigs = s
+	u.nics = newNICCache(u.nics.ttl)
+}
+
+// configureClient sets the authorizer, the rate limiter and the retry and polling behavior of an ARM client
+func (u *IPUpdate) configureClient(c *autorest.Client) error {
+	auth, err := u.getAuthorizer()
+	if err != nil {
+		return err
+	}
+	c.Authorizer = auth
+	if u.clientOptions.RetryAttempts != 0 {
+		c.RetryAttempts = u.clientOptions.RetryAttempts
+	}
+	if u.clientOptions.RetryDuration != 0 {
+		c.RetryDuration = u.clientOptions.RetryDuration
+	}
+	if u.clientOptions.PollingDelay != 0 {
+		c.PollingDelay = u.clientOptions.PollingDelay
+	}
+	if u.clientOptions.PollingDuration != 0 {
+		c.PollingDuration = u.clientOptions.PollingDuration
+	}
+	if u.rateLimiter != nil {
+		c.Sender = u.rateLimiter.Sender(c.Sender)
+	}
+	return nil
+}
+
+// baseURI returns the ARM endpoint for all requests
+func (u *IPUpdate) baseURI() string {
+	if u.sp.ResourceManagerEndpoint != "" {
+		return u.sp.ResourceManagerEndpoint
+	}
+	return network.DefaultBaseURI
+}
+
+// getAuthorizer returns the (cached) ARM authorizer for this IPUpdate's Service Principal
+func (u *IPUpdate) getAuthorizer() (autorest.Authorizer, error) {
+	u.authorizerLock.Lock()
+	defer u.authorizerLock.Unlock()
+	if u.authorizer != nil {
+		return u.authorizer, nil
+	}
+	a, err := GetResourceManagementAuthorizer(u.sp)
+	if err != nil {
+		return nil, err
+	}
+	u.authorizer = a
+	return a, nil
 }
-type IPUpdate struct{}
 
 // CreateOrUpdateVMPulicIP will create a new Public IP and assign it to the Virtual Machine
-func (*IPUpdate) CreateOrUpdateVMPulicIP(ctx context.Context, vmName string, ipName string) error {
+// If domainNameLabel is not empty, the Public IP gets this DNS label (or a variation of it, if it is taken) and its FQDN is returned
+func (u *IPUpdate) CreateOrUpdateVMPulicIP(ctx context.Context, vmName string, ipName string, domainNameLabel string) (string, error) {
 
-	log.Infof("Trying to get NIC from the VM %s", vmName)
+	u.log.Infof("Trying to get NIC from the VM %s", vmName)
 
-	nic, err := getNetworkInterface(ctx, vmName)
+	nic, err := u.getNetworkInterface(ctx, vmName)
 	if err != nil {
-		return fmt.Errorf("cannot get network interface: %v", err)
+		return "", wrapError(err, "cannot get network interface")
 	}
 
-	log.Info("NIC gotten successfully")
+	u.log.Info("NIC gotten successfully")
 
-	log.Infof("Trying to create the Public IP for Node %s", vmName)
+	// the Public IP is only created once it is known where it will be attached
+	i, err := u.ipConfigs.selectIPConfiguration(nic)
+	if err != nil {
+		return "", wrapError(err, "cannot select IP configuration for Node %s", vmName)
+	}
 
-	ip, err := createPublicIP(ctx, ipName)
+	u.log.Infof("Trying to create the Public IP for Node %s", vmName)
+
+	ip, err := u.createPublicIP(ctx, ipName, domainNameLabel)
 	if err != nil {
-		return fmt.Errorf("Cannot create Public IP for Node %s: %v", vmName, err)
+		return "", wrapError(err, "Cannot create Public IP for Node %s", vmName)
 	}
 
-	log.Infof("Public IP for Node %s created", vmName)
+	u.log.Infof("Public IP for Node %s created", vmName)
 
 	// set this IP Address to NIC's IP configuration
-	(*nic.IPConfigurations)[0].PublicIPAddress = ip
+	// we reference the IP only by its full ID, since it may be in a different Resource Group (or Subscription) than the NIC
+	(*nic.IPConfigurations)[i].PublicIPAddress = &network.PublicIPAddress{ID: ip.ID}
 
-	nicClient, err := getNicClient()
+	nicClient, err := u.getNicClient()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	log.Infof("Trying to assign the Public IP to the NIC for Node %s", vmName)
+	u.log.Infof("Trying to assign the Public IP to the NIC for Node %s", vmName)
 
-	future, err := nicClient.CreateOrUpdate(ctx, spDetails.ResourceGroup, getResourceName(*nic.ID), *nic)
+	// the NIC is written where it was read from, which is not the cluster's Resource Group for every selected NIC
+	future, err := nicClient.CreateOrUpdate(ctx, getResourceGroupFromID(*nic.ID), getResourceName(*nic.ID), *nic)
 
 	if err != nil {
-		return fmt.Errorf("cannot update NIC for Node %s: %v", vmName, err)
+		u.nics.invalidate(vmName)
+		return "", wrapError(err, "cannot update NIC for Node %s", vmName)
 	}
 
 	err = future.WaitForCompletion(ctx, nicClient.Client)
 	if err != nil {
-		return fmt.Errorf("cannot get NIC CreateOrUpdate response for Node %s: %v", vmName, err)
+		u.nics.invalidate(vmName)
+		return "", wrapError(err, "cannot get NIC CreateOrUpdate response for Node %s", vmName)
 	}
 
-	log.Infof("NIC for Node %s successfully updated", vmName)
+	u.log.Infof("NIC for Node %s successfully updated", vmName)
 
-	return nil
+	var fqdn string
+	if ip.PublicIPAddressPropertiesFormat != nil && ip.DNSSettings != nil && ip.DNSSettings.Fqdn != nil {
+		fqdn = *ip.DNSSettings.Fqdn
+	}
+
+	return fqdn, nil
 }
 
 // DeletePublicIP deletes the designated Public IP
-func (*IPUpdate) DeletePublicIP(ctx context.Context, ipName string) error {
-	ipClient, err := getIPClient()
+func (u *IPUpdate) DeletePublicIP(ctx context.Context, ipName string) error {
+	ipClient, err := u.getIPClient()
 	if err != nil {
 		return err
 	}
-	future, err := ipClient.Delete(ctx, spDetails.ResourceGroup, ipName)
+	future, err := ipClient.Delete(ctx, u.sp.IPResourceGroup, ipName)
 	if err != nil {
-		return fmt.Errorf("cannot delete Public IP address %s: %v", ipName, err)
+		return wrapError(err, "cannot delete Public IP address %s", ipName)
 	}
 
 	err = future.WaitForCompletion(ctx, ipClient.Client)
 	if err != nil {
-		return fmt.Errorf("cannot get public ip address %s CreateOrUpdate method's response: %v", ipName, err)
+		return wrapError(err, "cannot get public ip address %s CreateOrUpdate method's response", ipName)
 	}
 
-	log.Infof("IP %s successfully deleted", ipName)
+	u.log.Infof("IP %s successfully deleted", ipName)
 
 	return nil
 }
 
-// DisassociatePublicIPForNode will remove the Public IP address association from the VM's NIC
-func (*IPUpdate) DisassociatePublicIPForNode(ctx context.Context, nodeName string) error {
-	ipClient, err := getIPClient()
+// PublicIP is a Public IP created by the controller
+type PublicIP struct {
+	Name    string
+	Address string
+	FQDN    string
+	// AllocationMethod is Dynamic or Static
+	AllocationMethod string
+	// IPConfigurationID is the ID of the NIC IP configuration the Public IP is attached to, empty if it is not attached
+	IPConfigurationID string
+}
+
+func newPublicIP(ip network.PublicIPAddress) PublicIP {
+	p := PublicIP{Name: to.String(ip.Name)}
+	if ip.PublicIPAddressPropertiesFormat != nil {
+		p.Address = to.String(ip.IPAddress)
+		p.AllocationMethod = string(ip.PublicIPAllocationMethod)
+		if ip.DNSSettings != nil {
+			p.FQDN = to.String(ip.DNSSettings.Fqdn)
+		}
+		if ip.IPConfiguration != nil {
+			p.IPConfigurationID = to.String(ip.IPConfiguration.ID)
+		}
+	}
+	return p
+}
+
+// GetPublicIP returns the designated Public IP, or nil if it does not exist
+func (u *IPUpdate) GetPublicIP(ctx context.Context, ipName string) (*PublicIP, error) {
+	ipClient, err := u.getIPClient()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ipAddress, err := ipClient.Get(ctx, spDetails.ResourceGroup, GetPublicIPName(nodeName), "")
+	ip, err := ipClient.Get(ctx, u.sp.IPResourceGroup, ipName, "")
 	if err != nil {
-		return fmt.Errorf("cannot get IP Address: %v for Node %s", err, nodeName)
+		if ip.Response.Response != nil && ip.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, wrapError(err, "cannot get Public IP address %s", ipName)
 	}
+	p := newPublicIP(ip)
+	return &p, nil
+}
 
-	var nicName string
-	if ipAddress.IPConfiguration != nil {
-		ipConfiguration := *ipAddress.IPConfiguration.ID
-		//ipConfiguration has a value similar to:
-		///subscriptions/X/resourceGroups/Y/providers/Microsoft.Network/networkInterfaces/aks-nodepool1-26427378-nic-X/ipConfigurations/ipconfig1
+// ListPublicIPs returns the Public IPs the controller has created for this cluster.
+// Public IPs without the owner tag were created by older versions of the controller, these are only
+// considered ours when they live in the resource group of the cluster's VMs
+func (u *IPUpdate) ListPublicIPs(ctx context.Context) ([]PublicIP, error) {
+	ipClient, err := u.getIPClient()
+	if err != nil {
+		return nil, err
+	}
+	list, err := ipClient.ListComplete(ctx, u.sp.IPResourceGroup)
+	if err != nil {
+		return nil, wrapError(err, "cannot list Public IP addresses")
+	}
 
-		nicName = getNICNameFromIPConfiguration(ipConfiguration)
-	} else {
-		// IPConfiguration is nil => this IP address is already disassociated
-		return nil
+	var ips []PublicIP
+	for list.NotDone() {
+		ip := list.Value()
+		if ip.Name != nil && GetNodeNameFromPublicIPName(*ip.Name) != "" && u.isOwner(ip.Tags) {
+			ips = append(ips, newPublicIP(ip))
+		}
+		if err := list.Next(); err != nil {
+			return nil, wrapError(err, "cannot list Public IP addresses")
+		}
 	}
+	return ips, nil
+}
 
-	nicClient, err := getNicClient()
+// NetworkInterface is the NIC of a VM the Public IP goes to
+type NetworkInterface struct {
+	Name   string
+	ID     string
+	VMName string
+}
+
+// ListNetworkInterfaces returns, for every VM in the cluster's resource group, the NIC the Public IP goes to.
+// The NICs are also put in the NIC cache
+func (u *IPUpdate) ListNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	nics, err := u.listSelectedNICs(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	nicIDs := make(map[string]string, len(nics))
+	for _, nic := range nics {
+		nicIDs[nic.VMName] = nic.ID
+	}
+	u.nics.fill(nicIDs)
+	return nics, nil
+}
 
-	// get the NIC
-	nic, err := nicClient.Get(ctx, spDetails.ResourceGroup, nicName, "")
+// isOwner returns whether a Public IP with the designated tags belongs to this cluster
+func (u *IPUpdate) isOwner(tags map[string]*string) bool {
+	if owner, ok := tags[ownerTag]; ok && owner != nil {
+		return strings.EqualFold(*owner, u.sp.ResourceGroup)
+	}
+	return strings.EqualFold(u.sp.IPResourceGroup, u.sp.ResourceGroup)
+}
 
+// DisassociatePublicIPForNode will remove the Public IP address association from the VM's NIC.
+// It only detaches the Public IP from its IP configuration: the NIC itself is left to AKS, which deletes it with the VM
+func (u *IPUpdate) DisassociatePublicIPForNode(ctx context.Context, nodeName string) error {
+	ipClient, err := u.getIPClient()
+	if err != nil {
+		return err
+	}
+	ipAddress, err := ipClient.Get(ctx, u.sp.IPResourceGroup, GetPublicIPName(nodeName), "")
 	if err != nil {
-		return fmt.Errorf("cannot get NIC for Node %s, error: %v", nodeName, err)
+		return wrapError(err, "cannot get IP Address for Node %s", nodeName)
 	}
 
-	// set its Public IP to nil
-	(*nic.IPConfigurations)[0].PublicIPAddress = nil
+	if ipAddress.IPConfiguration == nil {
+		// IPConfiguration is nil => this IP address is already disassociated
+		return nil
+	}
+	if err := u.detachPublicIP(ctx, *ipAddress.IPConfiguration.ID); err != nil {
+		return wrapError(err, "cannot detach Public IP for Node %s", nodeName)
+	}
+	return nil
+}
 
-	// update the NIC so it has a nil Public IP
-	future, err := nicClient.CreateOrUpdate(ctx, spDetails.ResourceGroup, getResourceName(*nic.ID), nic)
+// detachPublicIP sets the Public IP of the designated IP configuration to nil, or removes the IP configuration
+// if it is our dedicated one
+func (u *IPUpdate) detachPublicIP(ctx context.Context, ipConfiguration string) error {
+	//ipConfiguration has a value similar to:
+	///subscriptions/X/resourceGroups/Y/providers/Microsoft.Network/networkInterfaces/aks-nodepool1-26427378-nic-X/ipConfigurations/ipconfig1
+	nicName := getNICNameFromIPConfiguration(ipConfiguration)
+	// the NIC may be in a different Resource Group than the Public IP
+	nicResourceGroup := getResourceGroupFromID(ipConfiguration)
 
+	nicClient, err := u.getNicClient()
 	if err != nil {
-		return fmt.Errorf("cannot update NIC for Node %s, error: %v", nodeName, err)
+		return err
 	}
 
-	err = future.WaitForCompletion(ctx, nicClient.Client)
+	// get the NIC
+	nic, err := nicClient.Get(ctx, nicResourceGroup, nicName, "")
 	if err != nil {
-		return fmt.Errorf("cannot get NIC CreateOrUpdate response for Node %s, error: %v", nodeName, err)
+		return wrapError(err, "cannot get NIC %s", nicName)
 	}
 
-	// there is a chance that after the scale-in operation completes, the NIC will still be alive
-	// This may happen due to a race condition between AKS calling Delete on the NIC and our code that
-	// calls CreateOrUpdate
-	// to make sure NIC gets removed, we'll just call delete on its instance
-	futureDelete, err := nicClient.Delete(ctx, spDetails.ResourceGroup, getResourceName(*nic.ID))
-	if err != nil {
-		return fmt.Errorf("cannot delete NIC for Node %s, error: %v. NIC may have already been deleted", nodeName, err)
+	var ipConfigs []network.InterfaceIPConfiguration
+	for _, ipConfig := range *nic.IPConfigurations {
+		if strings.EqualFold(to.String(ipConfig.ID), ipConfiguration) {
+			if u.ipConfigs.SecondaryIPConfigName != "" && strings.EqualFold(to.String(ipConfig.Name), u.ipConfigs.SecondaryIPConfigName) {
+				continue
+			}
+			ipConfig.PublicIPAddress = nil
+		}
+		ipConfigs = append(ipConfigs, ipConfig)
 	}
+	nic.IPConfigurations = &ipConfigs
 
-	err = futureDelete.WaitForCompletion(ctx, nicClient.Client)
-	if err != nil {
-		return fmt.Errorf("cannot get NIC Delete response for Node %s:, error: %v. NIC may have already been deleted", nodeName, err)
+	// update the NIC so it has a nil Public IP
+	if err := u.updateNetworkInterface(ctx, &nic); err != nil {
+		return wrapError(err, "cannot update NIC %s", nicName)
 	}
-
 	return nil
 }
 
@@ -276,3 +854,28 @@ func getNICNameFromIPConfiguration(ipConfig string) string {
 	parts := strings.Split(ipConfig, "/")
 	return parts[len(parts)-3]
 }
+
+// getResourceGroupFromID accepts a string of type
+// /subscriptions/X/resourceGroups/Y/providers/Microsoft.Network/networkInterfaces/Z/ipConfigurations/ipconfig1
+// and will return the Resource Group, i.e. Y
+func getResourceGroupFromID(fullID string) string {
+	return getIDSegment(fullID, "resourceGroups")
+}
+
+// getSubscriptionFromID accepts a string of type
+// /subscriptions/X/resourceGroups/Y/providers/Microsoft.Network/networkSecurityGroups/Z
+// and will return the Subscription, i.e. X
+func getSubscriptionFromID(fullID string) string {
+	return getIDSegment(fullID, "subscriptions")
+}
+
+// getIDSegment returns the part of a resource ID that follows the designated key
+func getIDSegment(fullID string, key string) string {
+	parts := strings.Split(fullID, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if strings.EqualFold(parts[i], key) {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
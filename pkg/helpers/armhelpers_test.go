@@ -0,0 +1,538 @@
+package helpers
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/fakearm"
+)
+
+const (
+	testSubscription  = "sub"
+	testResourceGroup = "MC_rg_aks_westeurope"
+	testLocation      = "westeurope"
+	testVMName        = "aks-nodepool1-26427378-0"
+)
+
+func newTestIPUpdate(server *fakearm.Server, ipResourceGroup string) *IPUpdate {
+	sp := &ServicePrincipalDetails{
+		SubscriptionID:          testSubscription,
+		Location:                testLocation,
+		ResourceGroup:           testResourceGroup,
+		IPResourceGroup:         ipResourceGroup,
+		ResourceManagerEndpoint: server.URL,
+	}
+	setPublicIPLocationDefaults(sp)
+	u := NewIPUpdate(sp, log.WithField("cluster", "test"))
+	u.SetAuthorizer(autorest.NullAuthorizer{})
+	return u
+}
+
+func getNICPublicIPID(nic fakearm.Resource) string {
+	ipConfigs, _ := nic.Properties()["ipConfigurations"].([]interface{})
+	if len(ipConfigs) == 0 {
+		return ""
+	}
+	props, _ := ipConfigs[0].(map[string]interface{})["properties"].(map[string]interface{})
+	ip, _ := props["publicIPAddress"].(map[string]interface{})
+	id, _ := ip["id"].(string)
+	return id
+}
+
+func TestCreateOrUpdateVMPulicIP(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	nicID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+
+	u := newTestIPUpdate(server, "")
+	fqdn, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), "")
+	if err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+	if fqdn != "" {
+		t.Errorf("expected no FQDN, got %s", fqdn)
+	}
+
+	ipID := fakearm.PublicIPID(testSubscription, testResourceGroup, GetPublicIPName(testVMName))
+	ip := server.Get(ipID)
+	if ip == nil {
+		t.Fatalf("Public IP %s was not created", ipID)
+	}
+	if ip.Properties()["ipAddress"] == nil {
+		t.Errorf("Public IP %s has no address", ipID)
+	}
+	if got := getNICPublicIPID(server.Get(nicID)); !strings.EqualFold(got, ipID) {
+		t.Errorf("NIC references Public IP %q, expected %q", got, ipID)
+	}
+}
+
+func TestPublicIPInSeparateResourceGroup(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	nicID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+
+	u := newTestIPUpdate(server, "public-ips")
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), ""); err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+
+	ipID := fakearm.PublicIPID(testSubscription, "public-ips", GetPublicIPName(testVMName))
+	if server.Get(ipID) == nil {
+		t.Fatalf("Public IP %s was not created", ipID)
+	}
+	if got := getNICPublicIPID(server.Get(nicID)); !strings.EqualFold(got, ipID) {
+		t.Errorf("NIC references Public IP %q, expected %q", got, ipID)
+	}
+
+	if err := u.DisassociatePublicIPForNode(context.Background(), testVMName); err != nil {
+		t.Fatalf("error disassociating Public IP: %v", err)
+	}
+	if err := u.DeletePublicIP(context.Background(), GetPublicIPName(testVMName)); err != nil {
+		t.Fatalf("error deleting Public IP: %v", err)
+	}
+	if server.Get(ipID) != nil {
+		t.Errorf("Public IP %s was not deleted", ipID)
+	}
+}
+
+func TestDeleteAttachedPublicIP(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	nicID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+
+	u := newTestIPUpdate(server, "")
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), ""); err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+
+	err := u.DeletePublicIP(context.Background(), GetPublicIPName(testVMName))
+	if ClassifyError(err) != ErrorConflict || GetErrorCode(err) != "PublicIPAddressCannotBeDeleted" {
+		t.Fatalf("expected PublicIPAddressCannotBeDeleted error, got %v", err)
+	}
+
+	if err := u.DisassociatePublicIPForNode(context.Background(), testVMName); err != nil {
+		t.Fatalf("error disassociating Public IP: %v", err)
+	}
+	// the NIC is only detached, never deleted
+	if server.Get(nicID) == nil {
+		t.Errorf("NIC %s was deleted", nicID)
+	}
+	if err := u.DeletePublicIP(context.Background(), GetPublicIPName(testVMName)); err != nil {
+		t.Fatalf("error deleting Public IP: %v", err)
+	}
+}
+
+func TestPublicIPDNSLabelCollision(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+	// somebody else already uses the label
+	server.Put(fakearm.PublicIPID(testSubscription, "other", "other-ip"), fakearm.Resource{
+		"location": testLocation,
+		"properties": map[string]interface{}{
+			"dnsSettings": map[string]interface{}{"domainNameLabel": "node0"},
+		},
+	})
+
+	u := newTestIPUpdate(server, "")
+	fqdn, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), "node0")
+	if err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+	if fqdn != "node0-1.westeurope.cloudapp.azure.com" {
+		t.Errorf("unexpected FQDN %s", fqdn)
+	}
+}
+
+func TestSanitizeDomainNameLabel(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	tests := []struct {
+		label, expected string
+	}{
+		{"aks-nodepool1-0", "aks-nodepool1-0"},
+		{"AKS_NodePool1.0", "aks-nodepool1-0"},
+		{"0-node", "node"},
+		{long, long[:maxDomainNameLabelLength]},
+		{strings.Repeat("a", 62) + "-b", strings.Repeat("a", 62)},
+		{"12", ""},
+	}
+	for _, tt := range tests {
+		label, err := sanitizeDomainNameLabel(tt.label)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", tt.label, label)
+			}
+			continue
+		}
+		if err != nil || label != tt.expected {
+			t.Errorf("%s: expected %s, got %s, %v", tt.label, tt.expected, label, err)
+		}
+	}
+}
+
+func TestDryRunIPUpdate(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+
+	u := newTestIPUpdate(server, "")
+	var planned []string
+	dryRun := NewDryRunIPUpdate(u, func(a PlannedAction) { planned = append(planned, a.Action) })
+
+	if _, err := dryRun.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), ""); err != nil {
+		t.Fatalf("error planning Public IP creation: %v", err)
+	}
+	if ip, err := u.GetPublicIP(context.Background(), GetPublicIPName(testVMName)); err != nil || ip != nil {
+		t.Fatalf("Public IP should not have been created, got %v, %v", ip, err)
+	}
+
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), ""); err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+	if err := dryRun.DeletePublicIP(context.Background(), GetPublicIPName(testVMName)); err != nil {
+		t.Fatalf("error planning Public IP deletion: %v", err)
+	}
+	ip, err := u.GetPublicIP(context.Background(), GetPublicIPName(testVMName))
+	if err != nil || ip == nil || ip.IPConfigurationID == "" {
+		t.Fatalf("Public IP should still be attached, got %v, %v", ip, err)
+	}
+
+	if strings.Join(planned, ",") != "create,attach,detach,delete" {
+		t.Errorf("unexpected planned actions %v", planned)
+	}
+}
+
+func TestNICCache(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	vmNames := []string{"aks-nodepool1-26427378-0", "aks-nodepool1-26427378-1", "aks-nodepool1-26427378-2"}
+	for _, vmName := range vmNames {
+		server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, vmName)
+	}
+
+	u := newTestIPUpdate(server, "")
+	for _, vmName := range vmNames {
+		if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), vmName, GetPublicIPName(vmName), ""); err != nil {
+			t.Fatalf("error creating Public IP for %s: %v", vmName, err)
+		}
+	}
+
+	// a single List of the VMs, and no VM GETs
+	var lists, gets int
+	for _, r := range server.Requests() {
+		switch {
+		case strings.HasSuffix(r, "/providers/Microsoft.Compute/virtualMachines"):
+			lists++
+		case strings.Contains(r, "/providers/Microsoft.Compute/virtualMachines/"):
+			gets++
+		}
+	}
+	if lists != 1 || gets != 0 {
+		t.Errorf("expected 1 VM List and 0 VM GETs, got %d and %d", lists, gets)
+	}
+
+	// the VM gets another NIC, the stale entry is invalidated and the next attempt succeeds
+	vmName := vmNames[0]
+	server.Delete(fakearm.NetworkInterfaceID(testSubscription, testResourceGroup, vmName+"-nic"))
+	nic := fakearm.Resource{"location": testLocation, "properties": map[string]interface{}{
+		"ipConfigurations": []interface{}{map[string]interface{}{"name": "ipconfig1", "properties": map[string]interface{}{"primary": true}}},
+	}}
+	nicID := fakearm.NetworkInterfaceID(testSubscription, testResourceGroup, vmName+"-nic2")
+	server.Put(nicID, nic)
+	vm := server.Get(fakearm.VirtualMachineID(testSubscription, testResourceGroup, vmName))
+	vm.Properties()["networkProfile"] = map[string]interface{}{
+		"networkInterfaces": []interface{}{map[string]interface{}{"id": nicID, "properties": map[string]interface{}{"primary": true}}},
+	}
+	server.Put(fakearm.VirtualMachineID(testSubscription, testResourceGroup, vmName), vm)
+
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), vmName, GetPublicIPName(vmName), ""); err == nil {
+		t.Fatal("expected an error for the stale NIC")
+	}
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), vmName, GetPublicIPName(vmName), ""); err != nil {
+		t.Fatalf("error creating Public IP after the cache was invalidated: %v", err)
+	}
+	if id := getNICPublicIPID(server.Get(nicID)); id == "" {
+		t.Errorf("Public IP was not attached to the new NIC")
+	}
+}
+
+func getIPConfigurationPublicIPIDs(nic fakearm.Resource) map[string]string {
+	ids := make(map[string]string)
+	ipConfigs, _ := nic.Properties()["ipConfigurations"].([]interface{})
+	for _, ipConfig := range ipConfigs {
+		name, _ := ipConfig.(map[string]interface{})["name"].(string)
+		props, _ := ipConfig.(map[string]interface{})["properties"].(map[string]interface{})
+		ip, _ := props["publicIPAddress"].(map[string]interface{})
+		ids[name], _ = ip["id"].(string)
+	}
+	return ids
+}
+
+func TestIPConfigSelection(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	primaryNICID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+	publicNICID := server.AddNetworkInterface(testSubscription, testResourceGroup, testLocation, testVMName, testVMName+"-public", "public")
+	ipID := fakearm.PublicIPID(testSubscription, testResourceGroup, GetPublicIPName(testVMName))
+
+	// by subnet, the Public IP goes to the secondary NIC
+	u := newTestIPUpdate(server, "")
+	u.SetIPConfigSelector(IPConfigSelector{Subnet: "public"})
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), ""); err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+	if got := getNICPublicIPID(server.Get(publicNICID)); !strings.EqualFold(got, ipID) {
+		t.Errorf("secondary NIC references Public IP %q, expected %q", got, ipID)
+	}
+	if got := getNICPublicIPID(server.Get(primaryNICID)); got != "" {
+		t.Errorf("primary NIC references Public IP %q, expected none", got)
+	}
+	nics, err := u.ListNetworkInterfaces(context.Background())
+	if err != nil {
+		t.Fatalf("error listing NICs: %v", err)
+	}
+	if len(nics) != 1 || !strings.EqualFold(nics[0].ID, publicNICID) || nics[0].VMName != testVMName {
+		t.Errorf("unexpected NICs %+v", nics)
+	}
+
+	// a dedicated secondary IP configuration leaves the primary one alone
+	u = newTestIPUpdate(server, "")
+	u.SetIPConfigSelector(IPConfigSelector{NICName: regexp.MustCompile(`-nic$`), SecondaryIPConfigName: "publicip"})
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, "other-ip", ""); err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+	ids := getIPConfigurationPublicIPIDs(server.Get(primaryNICID))
+	if len(ids) != 2 || ids["ipconfig1"] != "" || !strings.EqualFold(ids["publicip"], fakearm.PublicIPID(testSubscription, testResourceGroup, "other-ip")) {
+		t.Errorf("unexpected IP configurations of the primary NIC %v", ids)
+	}
+
+	// no Public IP is created when no IP configuration matches
+	u = newTestIPUpdate(server, "")
+	u.SetIPConfigSelector(IPConfigSelector{IPConfigName: regexp.MustCompile(`^public$`)})
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, "unattachable-ip", ""); err == nil {
+		t.Errorf("expected an error when no IP configuration matches")
+	}
+	if server.Get(fakearm.PublicIPID(testSubscription, testResourceGroup, "unattachable-ip")) != nil {
+		t.Errorf("a Public IP was created for an IP configuration that does not exist")
+	}
+}
+
+func TestSelectedNICInAnotherResourceGroup(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+	// the VM's public NIC lives in another Resource Group, so listing the cluster's NICs does not find it
+	publicNICID := fakearm.NetworkInterfaceID(testSubscription, "public-nics", testVMName+"-public")
+	server.Put(publicNICID, fakearm.Resource{"location": testLocation, "properties": map[string]interface{}{
+		"primary": false,
+		"ipConfigurations": []interface{}{map[string]interface{}{"name": "ipconfig1", "properties": map[string]interface{}{
+			"primary": true,
+			"subnet":  map[string]interface{}{"id": "/subscriptions/" + testSubscription + "/resourceGroups/public-nics/providers/Microsoft.Network/virtualNetworks/vnet/subnets/public"},
+		}}},
+	}})
+	vmID := fakearm.VirtualMachineID(testSubscription, testResourceGroup, testVMName)
+	vm := server.Get(vmID)
+	networkProfile := vm.Properties()["networkProfile"].(map[string]interface{})
+	networkProfile["networkInterfaces"] = append(networkProfile["networkInterfaces"].([]interface{}),
+		map[string]interface{}{"id": publicNICID, "properties": map[string]interface{}{"primary": false}})
+	server.Put(vmID, vm)
+
+	u := newTestIPUpdate(server, "")
+	u.SetIPConfigSelector(IPConfigSelector{Subnet: "public"})
+	for i := 0; i < 2; i++ {
+		if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), ""); err != nil {
+			t.Fatalf("error creating Public IP: %v", err)
+		}
+	}
+	ipID := fakearm.PublicIPID(testSubscription, testResourceGroup, GetPublicIPName(testVMName))
+	if got := getNICPublicIPID(server.Get(publicNICID)); !strings.EqualFold(got, ipID) {
+		t.Errorf("public NIC references Public IP %q, expected %q", got, ipID)
+	}
+	if nic := server.Get(fakearm.NetworkInterfaceID(testSubscription, testResourceGroup, testVMName+"-public")); nic != nil {
+		t.Errorf("the public NIC was written to the cluster's Resource Group")
+	}
+
+	// the VM's selected NIC is looked up once, then cached
+	var vmGets int
+	for _, r := range server.Requests() {
+		if strings.HasPrefix(r, "GET ") && strings.HasSuffix(r, "/virtualMachines/"+testVMName) {
+			vmGets++
+		}
+	}
+	if vmGets != 1 {
+		t.Errorf("expected 1 VM GET, got %d", vmGets)
+	}
+}
+
+func TestSecondaryPublicIPs(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	nicID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+
+	secondaryName := GetSecondaryPublicIPName(testVMName, 2)
+	if GetNodeNameFromPublicIPName(secondaryName) != testVMName || GetPublicIPIndex(secondaryName) != 2 {
+		t.Errorf("cannot get the Node and index of %s", secondaryName)
+	}
+
+	u := newTestIPUpdate(server, "")
+	ips, err := u.SetSecondaryPublicIPs(context.Background(), testVMName, 2)
+	if err != nil {
+		t.Fatalf("error setting secondary Public IPs: %v", err)
+	}
+	if len(ips) != 2 || ips[0].Address == "" || ips[1].Address == "" {
+		t.Errorf("unexpected secondary Public IPs %+v", ips)
+	}
+	ids := getIPConfigurationPublicIPIDs(server.Get(nicID))
+	if len(ids) != 3 || ids["ipconfig1"] != "" || !strings.EqualFold(ids[secondaryName], fakearm.PublicIPID(testSubscription, testResourceGroup, secondaryName)) {
+		t.Errorf("unexpected IP configurations %v", ids)
+	}
+
+	// scaling down detaches and deletes the second one
+	if _, err := u.SetSecondaryPublicIPs(context.Background(), testVMName, 1); err != nil {
+		t.Fatalf("error setting secondary Public IPs: %v", err)
+	}
+	if ids := getIPConfigurationPublicIPIDs(server.Get(nicID)); len(ids) != 2 {
+		t.Errorf("unexpected IP configurations %v", ids)
+	}
+	if server.Get(fakearm.PublicIPID(testSubscription, testResourceGroup, secondaryName)) != nil {
+		t.Errorf("Public IP %s was not deleted", secondaryName)
+	}
+
+	if err := u.DeleteSecondaryPublicIPs(context.Background(), testVMName); err != nil {
+		t.Fatalf("error deleting secondary Public IPs: %v", err)
+	}
+	if ids := getIPConfigurationPublicIPIDs(server.Get(nicID)); len(ids) != 1 {
+		t.Errorf("unexpected IP configurations %v", ids)
+	}
+	if ips := server.List(testSubscription, testResourceGroup, "publicIPAddresses"); len(ips) != 0 {
+		t.Errorf("expected no Public IPs, got %d", len(ips))
+	}
+}
+
+func TestAttachPublicIP(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	nicID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+	addIP := func(name, location, sku string) string {
+		id := fakearm.PublicIPID(testSubscription, "partner", name)
+		ip := fakearm.Resource{"location": location, "properties": map[string]interface{}{"publicIPAllocationMethod": "Static"}}
+		if sku != "" {
+			ip["sku"] = map[string]interface{}{"name": sku}
+		}
+		server.Put(id, ip)
+		return id
+	}
+	ipID := addIP("reserved", testLocation, "Basic")
+
+	u := newTestIPUpdate(server, "")
+	if _, err := u.AttachPublicIP(context.Background(), testVMName, ipID); err != nil {
+		t.Fatalf("error attaching Public IP: %v", err)
+	}
+	if got := getNICPublicIPID(server.Get(nicID)); !strings.EqualFold(got, ipID) {
+		t.Errorf("NIC references Public IP %q, expected %q", got, ipID)
+	}
+	// attaching it again is a no-op
+	if _, err := u.AttachPublicIP(context.Background(), testVMName, ipID); err != nil {
+		t.Errorf("error attaching Public IP again: %v", err)
+	}
+
+	// it cannot be attached to another Node
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, "aks-nodepool1-26427378-1")
+	if _, err := u.AttachPublicIP(context.Background(), "aks-nodepool1-26427378-1", ipID); err == nil {
+		t.Error("expected an error attaching a Public IP that is attached to another NIC")
+	}
+	for _, id := range []string{addIP("standard", testLocation, "Standard"), addIP("elsewhere", "northeurope", "")} {
+		if _, err := u.AttachPublicIP(context.Background(), "aks-nodepool1-26427378-1", id); err == nil {
+			t.Errorf("expected an error attaching incompatible Public IP %s", id)
+		}
+	}
+
+	// detaching never deletes it
+	if err := u.DetachPublicIP(context.Background(), ipID); err != nil {
+		t.Fatalf("error detaching Public IP: %v", err)
+	}
+	if got := getNICPublicIPID(server.Get(nicID)); got != "" {
+		t.Errorf("NIC references Public IP %q, expected none", got)
+	}
+	if server.Get(ipID) == nil {
+		t.Errorf("Public IP %s was deleted", ipID)
+	}
+}
+
+func TestOrphanedNetworkInterfaces(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	liveNICID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+	goneVMName, withIPVMName := "aks-nodepool1-26427378-1", "aks-nodepool1-26427378-2"
+	goneNICID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, goneVMName)
+	withIPNICID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, withIPVMName)
+	// not named like an AKS NIC
+	otherNICID := fakearm.NetworkInterfaceID(testSubscription, testResourceGroup, "jumpbox-nic")
+	server.Put(otherNICID, fakearm.Resource{"location": testLocation})
+
+	u := newTestIPUpdate(server, "")
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), withIPVMName, GetPublicIPName(withIPVMName), ""); err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+	for _, vmName := range []string{goneVMName, withIPVMName} {
+		server.Delete(fakearm.VirtualMachineID(testSubscription, testResourceGroup, vmName))
+	}
+
+	if state, err := u.GetVMState(context.Background(), testVMName); err != nil || state != VMExists {
+		t.Errorf("expected VM %s to exist, got %s, %v", testVMName, state, err)
+	}
+	if state, err := u.GetVMState(context.Background(), goneVMName); err != nil || state != VMDeleted {
+		t.Errorf("expected VM %s to be deleted, got %s, %v", goneVMName, state, err)
+	}
+
+	nics, err := u.ListOrphanedNetworkInterfaces(context.Background())
+	if err != nil {
+		t.Fatalf("error listing orphaned NICs: %v", err)
+	}
+	if len(nics) != 1 || !strings.EqualFold(nics[0].ID, goneNICID) || nics[0].VMName != goneVMName {
+		t.Fatalf("unexpected orphaned NICs %v", nics)
+	}
+	if err := u.DeleteOrphanedNetworkInterface(context.Background(), nics[0].Name); err != nil {
+		t.Fatalf("error deleting orphaned NIC: %v", err)
+	}
+
+	// the ownership checks are repeated on delete
+	for _, nicID := range []string{liveNICID, withIPNICID, otherNICID} {
+		if err := u.DeleteOrphanedNetworkInterface(context.Background(), getResourceName(nicID)); err == nil {
+			t.Errorf("expected an error deleting NIC %s", nicID)
+		}
+	}
+	for nicID, exists := range map[string]bool{goneNICID: false, liveNICID: true, withIPNICID: true, otherNICID: true} {
+		if (server.Get(nicID) != nil) != exists {
+			t.Errorf("NIC %s: expected exists=%t", nicID, exists)
+		}
+	}
+}
+
+func TestGetPublicIPQuota(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	u := newTestIPUpdate(server, "")
+
+	// not every location reports it
+	quota, err := u.GetPublicIPQuota(context.Background())
+	if err != nil || quota != nil {
+		t.Fatalf("expected no quota, got %v, %v", quota, err)
+	}
+
+	server.SetUsage(testSubscription, testLocation, "NetworkInterfaces", 3, 65536)
+	server.SetUsage(testSubscription, testLocation, publicIPUsageName, 7, 10)
+	quota, err = u.GetPublicIPQuota(context.Background())
+	if err != nil {
+		t.Fatalf("error getting Public IP quota: %v", err)
+	}
+	if quota == nil || quota.Limit != 10 || quota.Used != 7 || quota.Remaining() != 3 {
+		t.Errorf("unexpected Public IP quota %+v", quota)
+	}
+}
@@ -0,0 +1,98 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// AttachPublicIP attaches an existing Public IP, designated by its ID, to the selected IP configuration of the VM's NIC,
+// instead of creating one. The Public IP must not be attached to another NIC, and must be a Basic SKU Public IP
+// in the cluster's location. It returns the FQDN of the Public IP, if it has one
+func (u *IPUpdate) AttachPublicIP(ctx context.Context, vmName string, ipID string) (string, error) {
+	ip, err := u.getPublicIPByID(ctx, ipID)
+	if err != nil {
+		return "", err
+	}
+	if err := u.checkAttachable(ip); err != nil {
+		return "", err
+	}
+	var fqdn string
+	if ip.PublicIPAddressPropertiesFormat != nil && ip.DNSSettings != nil {
+		fqdn = to.String(ip.DNSSettings.Fqdn)
+	}
+
+	nic, err := u.getNetworkInterface(ctx, vmName)
+	if err != nil {
+		return "", wrapError(err, "cannot get network interface")
+	}
+	if ip.PublicIPAddressPropertiesFormat != nil && ip.IPConfiguration != nil && ip.IPConfiguration.ID != nil {
+		attachedTo := *ip.IPConfiguration.ID
+		if strings.HasPrefix(strings.ToLower(attachedTo), strings.ToLower(to.String(nic.ID))+"/") {
+			// already attached to this Node
+			return fqdn, nil
+		}
+		return "", fmt.Errorf("Public IP %s is attached to another NIC, through IP configuration %s", ipID, attachedTo)
+	}
+
+	i, err := u.ipConfigs.selectIPConfiguration(nic)
+	if err != nil {
+		return "", wrapError(err, "cannot select IP configuration for Node %s", vmName)
+	}
+	(*nic.IPConfigurations)[i].PublicIPAddress = &network.PublicIPAddress{ID: ip.ID}
+
+	u.log.Infof("Trying to attach the Public IP %s to the NIC for Node %s", ipID, vmName)
+	if err := u.updateNetworkInterface(ctx, nic); err != nil {
+		u.nics.invalidate(vmName)
+		return "", wrapError(err, "cannot update NIC for Node %s", vmName)
+	}
+	return fqdn, nil
+}
+
+// DetachPublicIP detaches the Public IP, designated by its ID, from the NIC it is attached to. It never deletes the Public IP
+func (u *IPUpdate) DetachPublicIP(ctx context.Context, ipID string) error {
+	ip, err := u.getPublicIPByID(ctx, ipID)
+	if err != nil {
+		return err
+	}
+	if ip.PublicIPAddressPropertiesFormat == nil || ip.IPConfiguration == nil || ip.IPConfiguration.ID == nil {
+		// already detached
+		return nil
+	}
+	if err := u.detachPublicIP(ctx, *ip.IPConfiguration.ID); err != nil {
+		return wrapError(err, "cannot detach Public IP %s", ipID)
+	}
+	return nil
+}
+
+// getPublicIPByID returns the Public IP with the designated ID, which may be in any Resource Group or Subscription
+func (u *IPUpdate) getPublicIPByID(ctx context.Context, ipID string) (*network.PublicIPAddress, error) {
+	ipClient, err := u.getIPClientFor(getSubscriptionFromID(ipID))
+	if err != nil {
+		return nil, err
+	}
+	ip, err := ipClient.Get(ctx, getResourceGroupFromID(ipID), getResourceName(ipID), "")
+	if err != nil {
+		return nil, wrapError(err, "cannot get Public IP address %s", ipID)
+	}
+	return &ip, nil
+}
+
+// checkAttachable returns an error if the Public IP cannot be attached to the cluster's VMs
+func (u *IPUpdate) checkAttachable(ip *network.PublicIPAddress) error {
+	if ip.Sku != nil && ip.Sku.Name != "" && ip.Sku.Name != network.PublicIPAddressSkuNameBasic {
+		return fmt.Errorf("Public IP %s has the %s SKU, only Basic SKU Public IPs can be attached to the cluster's VMs", to.String(ip.ID), ip.Sku.Name)
+	}
+	if location := to.String(ip.Location); normalizeLocation(location) != normalizeLocation(u.sp.Location) {
+		return fmt.Errorf("Public IP %s is in %s, not in the cluster's location %s", to.String(ip.ID), location, u.sp.Location)
+	}
+	return nil
+}
+
+// normalizeLocation turns a location display name, e.g. West Europe, into its name, e.g. westeurope
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.Replace(location, " ", "", -1))
+}
@@ -0,0 +1,142 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/dns/mgmt/2017-10-01/dns"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
+
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// DNSZoneDetails describes the Azure DNS zone that will hold the records for the Nodes' Public IPs
+type DNSZoneDetails struct {
+	Name           string
+	ResourceGroup  string
+	SubscriptionID string
+	TTL            int64
+}
+
+// DNSUpdater manages the DNS records that point to the Nodes' Public IPs
+type DNSUpdater interface {
+	// CreateOrUpdateDNSRecord points the record to the designated Public IP, which is either the name of a Public IP
+	// created by the controller, or the resource ID of a bring-your-own Public IP
+	CreateOrUpdateDNSRecord(ctx context.Context, recordName string, ipName string) (string, error)
+	DeleteDNSRecord(ctx context.Context, recordName string) error
+}
+
+// DNSUpdate is the ARM backed DNSUpdater. It shares the credentials and the logger of an IPUpdate
+type DNSUpdate struct {
+	*IPUpdate
+	zone DNSZoneDetails
+}
+
+// NewDNSUpdate returns a new DNSUpdate for the designated zone.
+// If the zone's Subscription is empty, the Subscription of the cluster is used
+func NewDNSUpdate(ipUpdate *IPUpdate, zone DNSZoneDetails) *DNSUpdate {
+	if zone.SubscriptionID == "" {
+		zone.SubscriptionID = ipUpdate.sp.SubscriptionID
+	}
+	return &DNSUpdate{
+		IPUpdate: ipUpdate,
+		zone:     zone,
+	}
+}
+
+// CreateOrUpdateDNSRecord creates (or updates) an A or AAAA record, depending on the Public IP's version,
+// that points to the address of the designated Public IP. The record is only written if it does not point
+// to that address already. It returns the FQDN of the record
+func (d *DNSUpdate) CreateOrUpdateDNSRecord(ctx context.Context, recordName string, ipName string) (string, error) {
+	ipClient, err := d.getIPClient()
+	if err != nil {
+		return "", err
+	}
+	var ip network.PublicIPAddress
+	if strings.HasPrefix(ipName, "/subscriptions/") {
+		byoIP, err := d.getPublicIPByID(ctx, ipName)
+		if err != nil {
+			return "", err
+		}
+		ip = *byoIP
+	} else {
+		ip, err = ipClient.Get(ctx, d.sp.IPResourceGroup, ipName, "")
+		if err != nil {
+			return "", wrapError(err, "cannot get Public IP %s", ipName)
+		}
+	}
+	if ip.PublicIPAddressPropertiesFormat == nil || ip.IPAddress == nil || *ip.IPAddress == "" {
+		// dynamic IPs get their address only after they are attached to a running VM
+		return "", fmt.Errorf("Public IP %s has not been allocated an address yet", ipName)
+	}
+
+	recordType := dns.A
+	recordSet := dns.RecordSet{
+		RecordSetProperties: &dns.RecordSetProperties{
+			TTL: to.Int64Ptr(d.zone.TTL),
+		},
+	}
+	if ip.PublicIPAddressVersion == network.IPv6 {
+		recordType = dns.AAAA
+		recordSet.AaaaRecords = &[]dns.AaaaRecord{{Ipv6Address: ip.IPAddress}}
+	} else {
+		recordSet.ARecords = &[]dns.ARecord{{Ipv4Address: ip.IPAddress}}
+	}
+
+	recordSetsClient, err := d.getRecordSetsClient(d.zone.SubscriptionID)
+	if err != nil {
+		return "", err
+	}
+
+	current, err := recordSetsClient.Get(ctx, d.zone.ResourceGroup, d.zone.Name, recordName, recordType)
+	if err != nil && (current.Response.Response == nil || current.StatusCode != http.StatusNotFound) {
+		return "", wrapError(err, "cannot get DNS record %s.%s", recordName, d.zone.Name)
+	}
+	if err == nil && getRecordSetAddress(current) == *ip.IPAddress {
+		return recordName + "." + d.zone.Name, nil
+	}
+
+	d.log.Infof("Trying to set DNS %s record %s.%s to %s", recordType, recordName, d.zone.Name, *ip.IPAddress)
+
+	_, err = recordSetsClient.CreateOrUpdate(ctx, d.zone.ResourceGroup, d.zone.Name, recordName, recordType, recordSet, "", "")
+	if err != nil {
+		return "", wrapError(err, "cannot create DNS record %s.%s", recordName, d.zone.Name)
+	}
+
+	return recordName + "." + d.zone.Name, nil
+}
+
+// getRecordSetAddress returns the address of an A or AAAA record set with a single record, "" otherwise
+func getRecordSetAddress(recordSet dns.RecordSet) string {
+	if recordSet.RecordSetProperties == nil {
+		return ""
+	}
+	if recordSet.ARecords != nil && len(*recordSet.ARecords) == 1 {
+		return to.String((*recordSet.ARecords)[0].Ipv4Address)
+	}
+	if recordSet.AaaaRecords != nil && len(*recordSet.AaaaRecords) == 1 {
+		return to.String((*recordSet.AaaaRecords)[0].Ipv6Address)
+	}
+	return ""
+}
+
+// DeleteDNSRecord deletes the A and AAAA records with the designated name
+func (d *DNSUpdate) DeleteDNSRecord(ctx context.Context, recordName string) error {
+	recordSetsClient, err := d.getRecordSetsClient(d.zone.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	for _, recordType := range []dns.RecordType{dns.A, dns.AAAA} {
+		resp, err := recordSetsClient.Delete(ctx, d.zone.ResourceGroup, d.zone.Name, recordName, recordType, "")
+		if err != nil && (resp.Response == nil || resp.StatusCode != http.StatusNotFound) {
+			return wrapError(err, "cannot delete DNS %s record %s.%s", recordType, recordName, d.zone.Name)
+		}
+	}
+
+	d.log.Infof("DNS record %s.%s successfully deleted", recordName, d.zone.Name)
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PlannedCreate is a resource the controller would create
+	PlannedCreate = "create"
+	// PlannedAttach is a Public IP the controller would attach to a NIC
+	PlannedAttach = "attach"
+	// PlannedDetach is a Public IP the controller would detach from its NIC
+	PlannedDetach = "detach"
+	// PlannedDelete is a resource the controller would delete
+	PlannedDelete = "delete"
+	// PlannedUpdate is a Node label or annotation the controller would set
+	PlannedUpdate = "update"
+)
+
+// PlannedAction is a write the controller would have made if it was not running in dry-run mode
+type PlannedAction struct {
+	Time    time.Time `json:"time"`
+	Cluster string    `json:"cluster"`
+	// Node is the Node the action is for, empty if the action is not for a single Node
+	Node     string `json:"node,omitempty"`
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+	Details  string `json:"details,omitempty"`
+}
+
+func (a PlannedAction) String() string {
+	s := a.Action + " " + a.Resource
+	if a.Details != "" {
+		s += " (" + a.Details + ")"
+	}
+	return s
+}
+
+// Plan collects the actions planned in dry-run mode and writes them as a JSON report.
+// The same action is only recorded once, no matter how many times the Node is synced
+type Plan struct {
+	lock    sync.Mutex
+	path    string
+	seen    map[string]bool
+	Actions []PlannedAction `json:"actions"`
+}
+
+// NewPlan returns an empty Plan. If path is not empty, the report is rewritten there every time an action is added
+func NewPlan(path string) *Plan {
+	return &Plan{
+		path:    path,
+		seen:    make(map[string]bool),
+		Actions: []PlannedAction{},
+	}
+}
+
+// Add records the action and returns true, or returns false if the same action has already been recorded
+func (p *Plan) Add(a PlannedAction) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	key := strings.Join([]string{a.Cluster, a.Node, a.Action, a.Resource, a.Details}, "/")
+	if p.seen[key] {
+		return false, nil
+	}
+	p.seen[key] = true
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	p.Actions = append(p.Actions, a)
+
+	if p.path == "" {
+		return true, nil
+	}
+	report, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return true, err
+	}
+	if err := ioutil.WriteFile(p.path, report, 0644); err != nil {
+		return true, fmt.Errorf("cannot write dry-run report %s: %v", p.path, err)
+	}
+	return true, nil
+}
+
+// PlanFunc is called with every write a dry-run updater skips
+type PlanFunc func(a PlannedAction)
+
+// DryRunIPUpdate is an IPUpdater that reads through another IPUpdater, but only plans the writes.
+// Every method is implemented explicitly, so that a write added to IPUpdater cannot reach ARM in dry-run mode
+type DryRunIPUpdate struct {
+	ipUpdater IPUpdater
+	plan      PlanFunc
+}
+
+// NewDryRunIPUpdate returns a DryRunIPUpdate that reads through ipUpdater and passes the planned writes to plan
+func NewDryRunIPUpdate(ipUpdater IPUpdater, plan PlanFunc) *DryRunIPUpdate {
+	return &DryRunIPUpdate{ipUpdater: ipUpdater, plan: plan}
+}
+
+// GetPublicIP reads through
+func (d *DryRunIPUpdate) GetPublicIP(ctx context.Context, ipName string) (*PublicIP, error) {
+	return d.ipUpdater.GetPublicIP(ctx, ipName)
+}
+
+// ListPublicIPs reads through
+func (d *DryRunIPUpdate) ListPublicIPs(ctx context.Context) ([]PublicIP, error) {
+	return d.ipUpdater.ListPublicIPs(ctx)
+}
+
+// ListNetworkInterfaces reads through
+func (d *DryRunIPUpdate) ListNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	return d.ipUpdater.ListNetworkInterfaces(ctx)
+}
+
+// GetPublicIPQuota reads through
+func (d *DryRunIPUpdate) GetPublicIPQuota(ctx context.Context) (*PublicIPQuota, error) {
+	return d.ipUpdater.GetPublicIPQuota(ctx)
+}
+
+// GetVMState reads through
+func (d *DryRunIPUpdate) GetVMState(ctx context.Context, vmName string) (VMState, error) {
+	return d.ipUpdater.GetVMState(ctx, vmName)
+}
+
+// ListOrphanedNetworkInterfaces reads through
+func (d *DryRunIPUpdate) ListOrphanedNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	return d.ipUpdater.ListOrphanedNetworkInterfaces(ctx)
+}
+
+// CreateOrUpdateVMPulicIP plans the creation of the Public IP, if it does not exist, and its attachment to the VM's NIC
+func (d *DryRunIPUpdate) CreateOrUpdateVMPulicIP(ctx context.Context, vmName string, ipName string, domainNameLabel string) (string, error) {
+	ip, err := d.GetPublicIP(ctx, ipName)
+	if err != nil {
+		return "", err
+	}
+	if ip == nil {
+		details := ""
+		if domainNameLabel != "" {
+			details = "DNS label " + domainNameLabel
+		}
+		d.plan(PlannedAction{Node: vmName, Action: PlannedCreate, Resource: "Public IP " + ipName, Details: details})
+	}
+	if ip == nil || ip.IPConfigurationID == "" {
+		d.plan(PlannedAction{Node: vmName, Action: PlannedAttach, Resource: "Public IP " + ipName, Details: "to the NIC of VM " + vmName})
+	}
+	if ip != nil {
+		return ip.FQDN, nil
+	}
+	return "", nil
+}
+
+// DeletePublicIP plans the deletion of the Public IP, and its detachment if it is still attached
+func (d *DryRunIPUpdate) DeletePublicIP(ctx context.Context, ipName string) error {
+	ip, err := d.GetPublicIP(ctx, ipName)
+	if err != nil || ip == nil {
+		return err
+	}
+	nodeName := GetNodeNameFromPublicIPName(ipName)
+	if ip.IPConfigurationID != "" {
+		d.plan(PlannedAction{Node: nodeName, Action: PlannedDetach, Resource: "Public IP " + ipName, Details: "from " + ip.IPConfigurationID})
+	}
+	d.plan(PlannedAction{Node: nodeName, Action: PlannedDelete, Resource: "Public IP " + ipName, Details: ip.Address})
+	return nil
+}
+
+// DisassociatePublicIPForNode plans the detachment of the Node's Public IP
+func (d *DryRunIPUpdate) DisassociatePublicIPForNode(ctx context.Context, nodeName string) error {
+	d.plan(PlannedAction{Node: nodeName, Action: PlannedDetach, Resource: "Public IP " + GetPublicIPName(nodeName)})
+	return nil
+}
+
+// SetSecondaryPublicIPs plans the creation and attachment of the missing secondary Public IPs, and the deletion
+// of the ones above count. It returns the secondary Public IPs that already exist
+func (d *DryRunIPUpdate) SetSecondaryPublicIPs(ctx context.Context, vmName string, count int) ([]PublicIP, error) {
+	ips, err := d.ListPublicIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[int]PublicIP)
+	for _, ip := range ips {
+		if index := GetPublicIPIndex(ip.Name); index > 0 && GetNodeNameFromPublicIPName(ip.Name) == vmName {
+			existing[index] = ip
+		}
+	}
+	var result []PublicIP
+	for index := 1; index <= count; index++ {
+		ipName := GetSecondaryPublicIPName(vmName, index)
+		if ip, ok := existing[index]; ok {
+			result = append(result, ip)
+			continue
+		}
+		d.plan(PlannedAction{Node: vmName, Action: PlannedCreate, Resource: "Public IP " + ipName})
+		d.plan(PlannedAction{Node: vmName, Action: PlannedAttach, Resource: "Public IP " + ipName, Details: "to IP configuration " + ipName + " of the NIC of VM " + vmName})
+	}
+	for index, ip := range existing {
+		if index > count {
+			d.plan(PlannedAction{Node: vmName, Action: PlannedDelete, Resource: "Public IP " + ip.Name, Details: ip.Address})
+		}
+	}
+	return result, nil
+}
+
+// DeleteSecondaryPublicIPs plans the deletion of all the secondary Public IPs of the VM
+func (d *DryRunIPUpdate) DeleteSecondaryPublicIPs(ctx context.Context, vmName string) error {
+	ips, err := d.ListPublicIPs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if GetPublicIPIndex(ip.Name) > 0 && GetNodeNameFromPublicIPName(ip.Name) == vmName {
+			d.plan(PlannedAction{Node: vmName, Action: PlannedDelete, Resource: "Public IP " + ip.Name, Details: ip.Address})
+		}
+	}
+	return nil
+}
+
+// AttachPublicIP plans the attachment of the existing Public IP to the VM's NIC
+func (d *DryRunIPUpdate) AttachPublicIP(ctx context.Context, vmName string, ipID string) (string, error) {
+	d.plan(PlannedAction{Node: vmName, Action: PlannedAttach, Resource: "Public IP " + ipID, Details: "to the NIC of VM " + vmName})
+	return "", nil
+}
+
+// DetachPublicIP plans the detachment of the existing Public IP
+func (d *DryRunIPUpdate) DetachPublicIP(ctx context.Context, ipID string) error {
+	d.plan(PlannedAction{Action: PlannedDetach, Resource: "Public IP " + ipID})
+	return nil
+}
+
+// DeleteOrphanedNetworkInterface plans the deletion of the NIC
+func (d *DryRunIPUpdate) DeleteOrphanedNetworkInterface(ctx context.Context, nicName string) error {
+	d.plan(PlannedAction{Action: PlannedDelete, Resource: "NIC " + nicName})
+	return nil
+}
+
+// DryRunDNSUpdate is a DNSUpdater that only plans the writes
+type DryRunDNSUpdate struct {
+	plan PlanFunc
+}
+
+// NewDryRunDNSUpdate returns a DryRunDNSUpdate that passes the planned writes to plan
+func NewDryRunDNSUpdate(plan PlanFunc) *DryRunDNSUpdate {
+	return &DryRunDNSUpdate{plan: plan}
+}
+
+// CreateOrUpdateDNSRecord plans the creation of the DNS record
+func (d *DryRunDNSUpdate) CreateOrUpdateDNSRecord(ctx context.Context, recordName string, ipName string) (string, error) {
+	d.plan(PlannedAction{Node: GetNodeNameFromPublicIPName(ipName), Action: PlannedCreate, Resource: "DNS record " + recordName, Details: "for Public IP " + ipName})
+	return "", nil
+}
+
+// DeleteDNSRecord plans the deletion of the DNS record
+func (d *DryRunDNSUpdate) DeleteDNSRecord(ctx context.Context, recordName string) error {
+	d.plan(PlannedAction{Action: PlannedDelete, Resource: "DNS record " + recordName})
+	return nil
+}
+
+// DryRunNSGUpdate is an NSGUpdater that only plans the writes
+type DryRunNSGUpdate struct {
+	plan PlanFunc
+}
+
+// NewDryRunNSGUpdate returns a DryRunNSGUpdate that passes the planned writes to plan
+func NewDryRunNSGUpdate(plan PlanFunc) *DryRunNSGUpdate {
+	return &DryRunNSGUpdate{plan: plan}
+}
+
+// EnsureSecurityRules plans the creation of the rules. It returns an empty NSG ID, as the NSG is not looked up
+func (d *DryRunNSGUpdate) EnsureSecurityRules(ctx context.Context, vmName string, rules []SecurityRule) (string, error) {
+	for _, rule := range rules {
+		d.plan(PlannedAction{Node: vmName, Action: PlannedCreate, Resource: "NSG rule " + rule.String(), Details: "in the NSG of VM " + vmName})
+	}
+	return "", nil
+}
+
+// DeleteSecurityRules plans the deletion of the rules of the VM, or of the cluster's rules, from the NSG
+func (d *DryRunNSGUpdate) DeleteSecurityRules(ctx context.Context, nsgID string, vmName string) error {
+	if nsgID != "" {
+		d.plan(PlannedAction{Node: vmName, Action: PlannedDelete, Resource: "NSG rules " + securityRulePrefix + "*", Details: "in NSG " + nsgID})
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// ErrorClass is what a failed ARM request means for the caller, whatever the request was
+type ErrorClass string
+
+const (
+	// ErrorNotFound means the resource does not exist
+	ErrorNotFound ErrorClass = "NotFound"
+	// ErrorConflict means the resource is in use, e.g. a Public IP that is still attached cannot be deleted
+	ErrorConflict ErrorClass = "Conflict"
+	// ErrorThrottled means ARM throttled the request, or the rate limiter did not send it
+	ErrorThrottled ErrorClass = "Throttled"
+	// ErrorQuotaExceeded means the subscription has reached a limit, e.g. its Public IP quota
+	ErrorQuotaExceeded ErrorClass = "QuotaExceeded"
+	// ErrorAuthFailure means the Service Principal cannot authenticate, or is not allowed to make the request
+	ErrorAuthFailure ErrorClass = "AuthFailure"
+	// ErrorCanceled means the request was cancelled, e.g. because the controller is stopping
+	ErrorCanceled ErrorClass = "Canceled"
+	// ErrorTransient means the request failed on the way or on ARM's side, and should work if retried
+	ErrorTransient ErrorClass = "Transient"
+	// ErrorOther is any other error, e.g. an invalid request, that will fail again if retried as is
+	ErrorOther ErrorClass = "Other"
+)
+
+// conflictCodes are the ARM error codes of requests on resources that are in use
+var conflictCodes = map[string]bool{
+	"PublicIPAddressCannotBeDeleted":       true,
+	"PublicIPAddressInUse":                 true,
+	"InUseNetworkInterfaceCannotBeDeleted": true,
+	"Conflict":                             true,
+}
+
+// transientCodes are the ARM error codes of requests that should succeed if retried
+var transientCodes = map[string]bool{
+	"AnotherOperationInProgress": true,
+	"RetryableError":             true,
+	"InternalServerError":        true,
+	"InternalError":              true,
+	"ServiceUnavailable":         true,
+	"GatewayTimeout":             true,
+}
+
+// quotaCodes are the ARM error codes of requests that would exceed a limit of the subscription
+var quotaCodes = map[string]bool{
+	"QuotaExceeded":             true,
+	"PublicIPCountLimitReached": true,
+}
+
+// authCodes are the ARM error codes of requests that the Service Principal is not allowed to make
+var authCodes = map[string]bool{
+	"AuthorizationFailed":              true,
+	"LinkedAuthorizationFailed":        true,
+	"InvalidAuthenticationToken":       true,
+	"InvalidAuthenticationTokenTenant": true,
+	"ExpiredAuthenticationToken":       true,
+	"AuthenticationFailed":             true,
+	"InvalidClientSecretProvided":      true,
+}
+
+// ClassifiedError is an error caused by an ARM request, with the class and the ARM error code of the failure.
+// The helpers return it instead of a plain error, so that the class survives the context added to the message
+type ClassifiedError struct {
+	Class ErrorClass
+	// Code is the ARM error code, e.g. PublicIPAddressCannotBeDeleted, if ARM returned one
+	Code string
+	// StatusCode is the HTTP status code of the response, 0 if there was none
+	StatusCode int
+	// RetryAfter is how long ARM asked us to back off, for throttled requests
+	RetryAfter time.Duration
+
+	message string
+}
+
+func (e *ClassifiedError) Error() string {
+	return e.message
+}
+
+// ClassifyError returns the class of an error returned by the helpers or by the ARM clients
+func ClassifyError(err error) ErrorClass {
+	class, _, _ := classify(err)
+	return class
+}
+
+// GetErrorCode returns the ARM error code of an error returned by the helpers or by the ARM clients, "" if there is none
+func GetErrorCode(err error) string {
+	_, code, _ := classify(err)
+	return code
+}
+
+// GetRetryAfter returns how long ARM asked us to back off, if the error is a throttled request, 0 otherwise
+func GetRetryAfter(err error) time.Duration {
+	switch e := err.(type) {
+	case *ClassifiedError:
+		return e.RetryAfter
+	case *ThrottledError:
+		return e.RetryAfter
+	case autorest.DetailedError:
+		return GetRetryAfter(e.Original)
+	case *autorest.DetailedError:
+		return GetRetryAfter(e.Original)
+	}
+	return 0
+}
+
+// IsNotFound returns whether the error means that the resource does not exist
+func IsNotFound(err error) bool {
+	return ClassifyError(err) == ErrorNotFound
+}
+
+// wrapError adds context to err like fmt.Errorf("<format>: %v", a..., err) does, but keeps the class of the error
+func wrapError(err error, format string, a ...interface{}) error {
+	message := fmt.Sprintf(format, a...) + ": " + err.Error()
+	class, code, statusCode := classify(err)
+	if class == ErrorOther && code == "" && statusCode == 0 {
+		return fmt.Errorf("%s", message)
+	}
+	return &ClassifiedError{Class: class, Code: code, StatusCode: statusCode, RetryAfter: GetRetryAfter(err), message: message}
+}
+
+// classify returns the class, the ARM error code and the HTTP status code of err
+func classify(err error) (ErrorClass, string, int) {
+	switch e := err.(type) {
+	case nil:
+		return "", "", 0
+	case *ClassifiedError:
+		return e.Class, e.Code, e.StatusCode
+	case *ThrottledError:
+		if e.Code != "" {
+			return ErrorThrottled, e.Code, http.StatusTooManyRequests
+		}
+		return ErrorThrottled, "", 0
+	case autorest.DetailedError:
+		return classifyDetailedError(e)
+	case *autorest.DetailedError:
+		return classifyDetailedError(*e)
+	case azure.RequestError:
+		return classifyRequestError(e)
+	case *azure.RequestError:
+		return classifyRequestError(*e)
+	case azure.ServiceError:
+		return classifyResponse(e.Code, 0)
+	case *azure.ServiceError:
+		return classifyResponse(e.Code, 0)
+	case adal.TokenRefreshError:
+		return ErrorAuthFailure, "", 0
+	}
+	if err == context.Canceled {
+		return ErrorCanceled, "", 0
+	}
+	if e, ok := err.(*url.Error); ok && e.Err == context.Canceled {
+		// the HTTP client returns the cancellation of the request's context as a url.Error
+		return ErrorCanceled, "", 0
+	}
+	if err == context.DeadlineExceeded {
+		return ErrorTransient, "", 0
+	}
+	if _, ok := err.(net.Error); ok {
+		// the request was not sent, or no response was received
+		return ErrorTransient, "", 0
+	}
+	return ErrorOther, "", 0
+}
+
+func classifyDetailedError(e autorest.DetailedError) (ErrorClass, string, int) {
+	statusCode, _ := e.StatusCode.(int)
+	if e.Original != nil {
+		// the original error has the ARM error code, and for some of them the status code
+		class, code, originalStatusCode := classify(e.Original)
+		if statusCode == 0 {
+			statusCode = originalStatusCode
+		}
+		if code != "" || class != ErrorOther {
+			if class == ErrorOther {
+				class, _, _ = classifyResponse(code, statusCode)
+			}
+			return class, code, statusCode
+		}
+	}
+	return classifyResponse("", statusCode)
+}
+
+func classifyRequestError(e azure.RequestError) (ErrorClass, string, int) {
+	statusCode, _ := e.StatusCode.(int)
+	var code string
+	if e.ServiceError != nil {
+		code = e.ServiceError.Code
+	}
+	return classifyResponse(code, statusCode)
+}
+
+// classifyResponse classifies an ARM error response by its error code first, then by its status code
+func classifyResponse(code string, statusCode int) (ErrorClass, string, int) {
+	switch {
+	case code == "ResourceNotFound" || code == "NotFound" || code == "ResourceGroupNotFound":
+		return ErrorNotFound, code, statusCode
+	case conflictCodes[code]:
+		return ErrorConflict, code, statusCode
+	case quotaCodes[code] || strings.HasSuffix(code, "QuotaExceeded"):
+		return ErrorQuotaExceeded, code, statusCode
+	case authCodes[code]:
+		return ErrorAuthFailure, code, statusCode
+	case code == "TooManyRequests" || strings.HasPrefix(code, "SubscriptionRequestsThrottled"):
+		return ErrorThrottled, code, statusCode
+	case transientCodes[code]:
+		return ErrorTransient, code, statusCode
+	}
+
+	switch {
+	case statusCode == http.StatusNotFound:
+		return ErrorNotFound, code, statusCode
+	case statusCode == http.StatusConflict:
+		return ErrorConflict, code, statusCode
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorThrottled, code, statusCode
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrorAuthFailure, code, statusCode
+	case statusCode == http.StatusRequestTimeout || statusCode >= http.StatusInternalServerError:
+		return ErrorTransient, code, statusCode
+	}
+	return ErrorOther, code, statusCode
+}
@@ -0,0 +1,51 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+func TestClassifyError(t *testing.T) {
+	requestError := func(statusCode int, code string) error {
+		return &azure.RequestError{DetailedError: autorest.DetailedError{StatusCode: statusCode}, ServiceError: &azure.ServiceError{Code: code}}
+	}
+	tests := []struct {
+		name  string
+		err   error
+		class ErrorClass
+		code  string
+	}{
+		{"LRO error", autorest.DetailedError{Original: &azure.ServiceError{Code: "PublicIPAddressCannotBeDeleted"}}, ErrorConflict, "PublicIPAddressCannotBeDeleted"},
+		{"in use", autorest.DetailedError{Original: requestError(400, "PublicIPAddressInUse"), StatusCode: 400}, ErrorConflict, "PublicIPAddressInUse"},
+		{"throttled", autorest.DetailedError{Original: requestError(429, "TooManyRequests")}, ErrorThrottled, "TooManyRequests"},
+		{"rate limiter", autorest.DetailedError{Original: &ThrottledError{Kind: WriteRequest}}, ErrorThrottled, ""},
+		{"not found", autorest.DetailedError{StatusCode: 404}, ErrorNotFound, ""},
+		{"quota", requestError(400, "PublicIPCountLimitReached"), ErrorQuotaExceeded, "PublicIPCountLimitReached"},
+		{"auth", autorest.DetailedError{Original: requestError(403, "AuthorizationFailed")}, ErrorAuthFailure, "AuthorizationFailed"},
+		{"another operation", requestError(409, "AnotherOperationInProgress"), ErrorTransient, "AnotherOperationInProgress"},
+		{"server error", autorest.DetailedError{StatusCode: 503}, ErrorTransient, ""},
+		{"connection", autorest.DetailedError{Original: &url.Error{Op: "Put", URL: "https://management.azure.com", Err: errors.New("connection refused")}}, ErrorTransient, ""},
+		{"canceled", context.Canceled, ErrorCanceled, ""},
+		{"canceled request", autorest.DetailedError{Original: &url.Error{Op: "Put", URL: "https://management.azure.com", Err: context.Canceled}}, ErrorCanceled, ""},
+		{"invalid request", requestError(400, "InvalidRequestFormat"), ErrorOther, "InvalidRequestFormat"},
+		{"not an ARM error", errors.New("NIC has no IP configurations"), ErrorOther, ""},
+	}
+	for _, tt := range tests {
+		if class := ClassifyError(tt.err); class != tt.class {
+			t.Errorf("%s: expected class %s, got %s", tt.name, tt.class, class)
+		}
+		// the class survives the context the helpers add
+		wrapped := wrapError(tt.err, "cannot delete Public IP %s", "ipconfig-aks-nodepool1-26427378-0")
+		if class, code := ClassifyError(wrapped), GetErrorCode(wrapped); class != tt.class || code != tt.code {
+			t.Errorf("%s: expected class %s and code %q once wrapped, got %s and %q", tt.name, tt.class, tt.code, class, code)
+		}
+		if wrapped.Error() != "cannot delete Public IP ipconfig-aks-nodepool1-26427378-0: "+tt.err.Error() {
+			t.Errorf("%s: unexpected message %q", tt.name, wrapped.Error())
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // ServicePrincipalDetails contains the Service Principal credentials for the AKS cluster
@@ -20,10 +22,14 @@ type ServicePrincipalDetails struct {
 	AadClientSecret string
 	Location        string
 	ResourceGroup   string
+	// IPResourceGroup is the Resource Group where the Public IPs are created. Defaults to ResourceGroup
+	IPResourceGroup string
+	// IPSubscriptionID is the Subscription where the Public IPs are created. Defaults to SubscriptionID
+	IPSubscriptionID string
+	// ResourceManagerEndpoint is the ARM endpoint. Defaults to the Azure public cloud one
+	ResourceManagerEndpoint string
 }
 
-var spDetails ServicePrincipalDetails
-
 /*
 /etc/kubernetes/azure.json is ...
 
@@ -41,10 +47,11 @@ var spDetails ServicePrincipalDetails
 
 // InitializeServicePrincipalDetails reads the /etc/kubernetes/azure.json file on the host (mounted via hostPath on the Pod)
 // this files contains the credentials for the AKS cluster's Service Principal
-func InitializeServicePrincipalDetails() error {
+func InitializeServicePrincipalDetails() (*ServicePrincipalDetails, error) {
+	var sp *ServicePrincipalDetails
 
 	if os.Getenv("TENANT_ID") != "" && os.Getenv("SUBSCRIPTION_ID") != "" && os.Getenv("AAD_CLIENT_ID") != "" && os.Getenv("AAD_CLIENT_SECRET") != "" && os.Getenv("LOCATION") != "" && os.Getenv("RESOURCE_GROUP") != "" {
-		spDetails = ServicePrincipalDetails{
+		sp = &ServicePrincipalDetails{
 			TenantID:        os.Getenv("TENANT_ID"),
 			SubscriptionID:  os.Getenv("SUBSCRIPTION_ID"),
 			AadClientID:     os.Getenv("AAD_CLIENT_ID"),
@@ -52,37 +59,123 @@ func InitializeServicePrincipalDetails() error {
 			Location:        os.Getenv("LOCATION"),
 			ResourceGroup:   os.Getenv("RESOURCE_GROUP"),
 		}
-		return nil
+	} else {
+		var err error
+		sp, err = LoadServicePrincipalDetails("/akssp/azure.json")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// PUBLIC_IP_RESOURCE_GROUP and PUBLIC_IP_SUBSCRIPTION_ID env variables can be used to keep the Public IPs
+	// outside of the MC_ Resource Group, where the VMs and the NICs live
+	if os.Getenv("PUBLIC_IP_RESOURCE_GROUP") != "" {
+		sp.IPResourceGroup = os.Getenv("PUBLIC_IP_RESOURCE_GROUP")
 	}
+	if os.Getenv("PUBLIC_IP_SUBSCRIPTION_ID") != "" {
+		sp.IPSubscriptionID = os.Getenv("PUBLIC_IP_SUBSCRIPTION_ID")
+	}
+	if os.Getenv("RESOURCE_MANAGER_ENDPOINT") != "" {
+		sp.ResourceManagerEndpoint = os.Getenv("RESOURCE_MANAGER_ENDPOINT")
+	}
+	setPublicIPLocationDefaults(sp)
+
+	return sp, nil
+}
 
-	file, e := ioutil.ReadFile("/akssp/azure.json")
+// LoadServicePrincipalDetails reads the Service Principal details from an azure.json formatted file
+// Optional "publicIPResourceGroup" and "publicIPSubscriptionId" keys set the location of the Public IPs
+// and an optional "resourceManagerEndpoint" key sets the ARM endpoint
+func LoadServicePrincipalDetails(path string) (*ServicePrincipalDetails, error) {
+	file, e := ioutil.ReadFile(path)
 	if e != nil {
 		fmt.Printf("File error: %v\n", e)
-		return e
+		return nil, e
 	}
 	var f interface{}
 	err := json.Unmarshal(file, &f)
 
 	if err != nil {
 		fmt.Printf("Unmarshaling error: %v\n", err)
-		return err
+		return nil, err
 	}
 
-	m := f.(map[string]interface{})
+	m, ok := f.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("file %s does not contain a JSON object", path)
+	}
 
-	spDetails = ServicePrincipalDetails{
-		TenantID:        m["tenantId"].(string),
-		SubscriptionID:  m["subscriptionId"].(string),
-		AadClientID:     m["aadClientId"].(string),
-		AadClientSecret: m["aadClientSecret"].(string),
-		Location:        m["location"].(string),
-		ResourceGroup:   m["resourceGroup"].(string),
+	getString := func(key string) string {
+		v, _ := m[key].(string)
+		return v
 	}
 
-	return nil
+	sp := &ServicePrincipalDetails{
+		TenantID:         getString("tenantId"),
+		SubscriptionID:   getString("subscriptionId"),
+		AadClientID:      getString("aadClientId"),
+		AadClientSecret:  getString("aadClientSecret"),
+		Location:         getString("location"),
+		ResourceGroup:    getString("resourceGroup"),
+		IPResourceGroup:  getString("publicIPResourceGroup"),
+		IPSubscriptionID: getString("publicIPSubscriptionId"),
+
+		ResourceManagerEndpoint: getString("resourceManagerEndpoint"),
+	}
+	setPublicIPLocationDefaults(sp)
+
+	return sp, nil
+}
+
+// setPublicIPLocationDefaults makes the Public IPs live next to the VMs and the NICs,
+// unless a different Resource Group or Subscription has been configured
+func setPublicIPLocationDefaults(sp *ServicePrincipalDetails) {
+	if sp.IPResourceGroup == "" {
+		sp.IPResourceGroup = sp.ResourceGroup
+	}
+	if sp.IPSubscriptionID == "" {
+		sp.IPSubscriptionID = sp.SubscriptionID
+	}
 }
 
+// publicIPPrefix is the prefix of the names of all the Public IPs created by the controller
+const publicIPPrefix = "ipconfig-"
+
 // GetPublicIPName returns the name of the Public IP resource, which is based on the Node's name
 func GetPublicIPName(vmName string) string {
-	return "ipconfig-" + vmName
+	return publicIPPrefix + vmName
+}
+
+// secondaryPublicIPSeparator separates the Node's name from the index in the names of secondary Public IPs.
+// Node names cannot contain it, so a secondary Public IP cannot be mistaken for the Public IP of another Node
+const secondaryPublicIPSeparator = "_"
+
+// GetSecondaryPublicIPName returns the name of a Node's secondary Public IP, indexed from 1
+func GetSecondaryPublicIPName(vmName string, index int) string {
+	return GetPublicIPName(vmName) + secondaryPublicIPSeparator + strconv.Itoa(index)
+}
+
+// GetPublicIPIndex returns the index of a secondary Public IP, or 0 for the Node's primary Public IP
+func GetPublicIPIndex(ipName string) int {
+	i := strings.LastIndex(ipName, secondaryPublicIPSeparator)
+	if i == -1 {
+		return 0
+	}
+	index, err := strconv.Atoi(ipName[i+1:])
+	if err != nil || index < 1 {
+		return 0
+	}
+	return index
+}
+
+// GetNodeNameFromPublicIPName returns the name of the Node a primary or secondary Public IP was created for,
+// or an empty string if the name does not belong to a Public IP created by the controller
+func GetNodeNameFromPublicIPName(ipName string) string {
+	if !strings.HasPrefix(ipName, publicIPPrefix) {
+		return ""
+	}
+	if GetPublicIPIndex(ipName) > 0 {
+		ipName = ipName[:strings.LastIndex(ipName, secondaryPublicIPSeparator)]
+	}
+	return strings.TrimPrefix(ipName, publicIPPrefix)
 }
@@ -0,0 +1,192 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2017-03-30/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// IPConfigSelector selects the NIC and the IP configuration a Node's Public IP is attached to.
+// The zero value selects the primary IP configuration of the VM's primary NIC
+type IPConfigSelector struct {
+	// NICName, if set, selects the first NIC of the VM whose name matches, the primary NIC if more than one do
+	NICName *regexp.Regexp
+	// IPConfigName, if set, selects the IP configuration whose name matches, the primary one if more than one do
+	IPConfigName *regexp.Regexp
+	// Subnet, if set, is the name or the ID of the subnet of the NIC and the IP configuration
+	Subnet string
+	// SecondaryIPConfigName, if set, is the name of a secondary IP configuration that the controller creates on the
+	// selected NIC, in the subnet of the selected IP configuration, and dedicates to the Public IP.
+	// The other IP configurations are left alone
+	SecondaryIPConfigName string
+}
+
+// selectsNIC returns whether the selector needs the NIC bodies to pick a NIC, rather than the primary flag of the VM
+func (s IPConfigSelector) selectsNIC() bool {
+	return s.NICName != nil || s.Subnet != ""
+}
+
+// matchesSubnet returns whether the IP configuration is in the selector's subnet
+func (s IPConfigSelector) matchesSubnet(ipConfig network.InterfaceIPConfiguration) bool {
+	if s.Subnet == "" {
+		return true
+	}
+	if ipConfig.InterfaceIPConfigurationPropertiesFormat == nil || ipConfig.Subnet == nil || ipConfig.Subnet.ID == nil {
+		return false
+	}
+	if strings.Contains(s.Subnet, "/") {
+		return strings.EqualFold(*ipConfig.Subnet.ID, s.Subnet)
+	}
+	return strings.EqualFold(getResourceName(*ipConfig.Subnet.ID), s.Subnet)
+}
+
+// matchesNIC returns whether the NIC can be selected
+func (s IPConfigSelector) matchesNIC(nic network.Interface) bool {
+	if s.NICName != nil && !s.NICName.MatchString(to.String(nic.Name)) {
+		return false
+	}
+	if s.Subnet == "" {
+		return true
+	}
+	if nic.InterfacePropertiesFormat == nil || nic.IPConfigurations == nil {
+		return false
+	}
+	for _, ipConfig := range *nic.IPConfigurations {
+		if s.matchesSubnet(ipConfig) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectIPConfiguration returns the index of the selected IP configuration of the NIC.
+// If the selector has a SecondaryIPConfigName, that IP configuration is added to the NIC when it does not exist
+func (s IPConfigSelector) selectIPConfiguration(nic *network.Interface) (int, error) {
+	if nic.InterfacePropertiesFormat == nil || nic.IPConfigurations == nil || len(*nic.IPConfigurations) == 0 {
+		return -1, fmt.Errorf("NIC %s has no IP configurations", to.String(nic.Name))
+	}
+	ipConfigs := *nic.IPConfigurations
+
+	if s.SecondaryIPConfigName != "" {
+		for i, ipConfig := range ipConfigs {
+			if strings.EqualFold(to.String(ipConfig.Name), s.SecondaryIPConfigName) {
+				return i, nil
+			}
+		}
+	}
+
+	selected := -1
+	for i, ipConfig := range ipConfigs {
+		if s.IPConfigName != nil && !s.IPConfigName.MatchString(to.String(ipConfig.Name)) {
+			continue
+		}
+		if !s.matchesSubnet(ipConfig) {
+			continue
+		}
+		if selected == -1 || isPrimaryIPConfiguration(ipConfig) && !isPrimaryIPConfiguration(ipConfigs[selected]) {
+			selected = i
+		}
+	}
+	if selected == -1 {
+		return -1, fmt.Errorf("no IP configuration of NIC %s matches the selection", to.String(nic.Name))
+	}
+	if s.SecondaryIPConfigName == "" {
+		return selected, nil
+	}
+
+	// the secondary IP configuration gets a private IP in the same subnet as the selected one
+	if ipConfigs[selected].InterfaceIPConfigurationPropertiesFormat == nil || ipConfigs[selected].Subnet == nil {
+		return -1, fmt.Errorf("IP configuration %s of NIC %s has no subnet", to.String(ipConfigs[selected].Name), to.String(nic.Name))
+	}
+	ipConfigs = append(ipConfigs, network.InterfaceIPConfiguration{
+		Name: to.StringPtr(s.SecondaryIPConfigName),
+		InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+			Primary:                   to.BoolPtr(false),
+			PrivateIPAllocationMethod: network.Dynamic,
+			PrivateIPAddressVersion:   network.IPv4,
+			Subnet:                    &network.Subnet{ID: ipConfigs[selected].Subnet.ID},
+		},
+	})
+	nic.IPConfigurations = &ipConfigs
+	return len(ipConfigs) - 1, nil
+}
+
+func isPrimaryIPConfiguration(ipConfig network.InterfaceIPConfiguration) bool {
+	return ipConfig.InterfaceIPConfigurationPropertiesFormat != nil && to.Bool(ipConfig.Primary)
+}
+
+// selectVMNIC returns the ID of the NIC of the VM the selector picks, the primary one if more than one match.
+// It only gets the VM's NICs, rather than listing all the NICs of the cluster
+func (u *IPUpdate) selectVMNIC(ctx context.Context, vm compute.VirtualMachine) (string, error) {
+	if vm.VirtualMachineProperties == nil || vm.NetworkProfile == nil || vm.NetworkProfile.NetworkInterfaces == nil {
+		return "", nil
+	}
+	nicClient, err := u.getNicClient()
+	if err != nil {
+		return "", err
+	}
+	var selected *network.Interface
+	for _, ref := range *vm.NetworkProfile.NetworkInterfaces {
+		nicID := to.String(ref.ID)
+		if nicID == "" {
+			continue
+		}
+		nic, err := nicClient.Get(ctx, getResourceGroupFromID(nicID), getResourceName(nicID), "")
+		if err != nil {
+			return "", wrapError(err, "cannot get network interface %s", nicID)
+		}
+		if !u.ipConfigs.matchesNIC(nic) {
+			continue
+		}
+		if selected == nil || to.Bool(nic.Primary) && !to.Bool(selected.Primary) {
+			selected = &nic
+		}
+	}
+	if selected == nil {
+		return "", fmt.Errorf("no NIC of VM %s matches the selection", to.String(vm.Name))
+	}
+	return to.String(selected.ID), nil
+}
+
+// listSelectedNICs returns, for every VM in the cluster's resource group, the NIC the selector picks
+func (u *IPUpdate) listSelectedNICs(ctx context.Context) ([]NetworkInterface, error) {
+	nicClient, err := u.getNicClient()
+	if err != nil {
+		return nil, err
+	}
+	list, err := nicClient.ListComplete(ctx, u.sp.ResourceGroup)
+	if err != nil {
+		return nil, wrapError(err, "cannot list network interfaces")
+	}
+
+	selected := make(map[string]network.Interface)
+	var vmNames []string
+	for list.NotDone() {
+		nic := list.Value()
+		if nic.InterfacePropertiesFormat != nil && nic.VirtualMachine != nil && nic.VirtualMachine.ID != nil && u.ipConfigs.matchesNIC(nic) {
+			vmName := getResourceName(*nic.VirtualMachine.ID)
+			previous, ok := selected[vmName]
+			if !ok {
+				vmNames = append(vmNames, vmName)
+			}
+			if !ok || to.Bool(nic.Primary) && !to.Bool(previous.Primary) {
+				selected[vmName] = nic
+			}
+		}
+		if err := list.Next(); err != nil {
+			return nil, wrapError(err, "cannot list network interfaces")
+		}
+	}
+
+	nics := make([]NetworkInterface, 0, len(vmNames))
+	for _, vmName := range vmNames {
+		nic := selected[vmName]
+		nics = append(nics, NetworkInterface{Name: to.String(nic.Name), ID: to.String(nic.ID), VMName: vmName})
+	}
+	return nics, nil
+}
@@ -0,0 +1,33 @@
+package helpers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	armRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aksnodepublicip_arm_requests_total",
+		Help: "ARM requests by kind (read or write) and status code. Requests the rate limiter did not send have the throttled code.",
+	}, []string{"kind", "code"})
+	armThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aksnodepublicip_arm_throttled_total",
+		Help: "ARM requests that were throttled with a 429 status code, by kind.",
+	}, []string{"kind"})
+	armRateLimitRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aksnodepublicip_arm_ratelimit_remaining",
+		Help: "Lowest x-ms-ratelimit-remaining-* header of the last ARM response, by kind.",
+	}, []string{"kind"})
+	armRateLimiterWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aksnodepublicip_arm_ratelimiter_wait_seconds",
+		Help:    "Time ARM requests waited for the client-side rate limiter, by kind.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 7),
+	}, []string{"kind"})
+	nicCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aksnodepublicip_nic_cache_lookups_total",
+		Help: "Lookups of the NIC of a VM in the NIC cache, by result (hit or miss).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(armRequests, armThrottled, armRateLimitRemaining, armRateLimiterWait, nicCacheLookups)
+}
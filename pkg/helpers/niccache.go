@@ -0,0 +1,68 @@
+package helpers
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultNICCacheTTL is how long the NIC of each VM is cached by default. The NIC of an AKS VM never changes,
+// but a VM may be deleted and recreated with the same name
+const defaultNICCacheTTL = 10 * time.Minute
+
+// nicCache maps VM names to the ID of their primary NIC
+type nicCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]nicCacheEntry
+
+	// refreshLock makes a single worker at a time list the VMs on a cache miss
+	refreshLock sync.Mutex
+}
+
+type nicCacheEntry struct {
+	nicID   string
+	expires time.Time
+}
+
+// newNICCache returns an empty cache, a ttl <= 0 disables it
+func newNICCache(ttl time.Duration) *nicCache {
+	return &nicCache{ttl: ttl, entries: make(map[string]nicCacheEntry)}
+}
+
+// get returns the NIC ID of the VM, or false if it is not cached or has expired
+func (c *nicCache) get(vmName string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[vmName]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.nicID, true
+}
+
+func (c *nicCache) set(vmName, nicID string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[vmName] = nicCacheEntry{nicID: nicID, expires: time.Now().Add(c.ttl)}
+}
+
+// fill replaces the whole cache with the NIC IDs of a VM List
+func (c *nicCache) fill(nicIDs map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires := time.Now().Add(c.ttl)
+	c.entries = make(map[string]nicCacheEntry, len(nicIDs))
+	for vmName, nicID := range nicIDs {
+		c.entries[vmName] = nicCacheEntry{nicID: nicID, expires: expires}
+	}
+}
+
+// invalidate removes the VM from the cache, after a request on its NIC failed
+func (c *nicCache) invalidate(vmName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, vmName)
+}
@@ -0,0 +1,395 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
+
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	// securityRulePrefix is the prefix of all the NSG rules managed by the controller
+	securityRulePrefix = "aksnodepublicip-"
+	// securityRuleDescriptionFormat is the description of the NSG rules of a Node, with the cluster (the resource group
+	// of its VMs) and the Node's name. Rules are only updated and deleted by the controller of the cluster that owns them
+	securityRuleDescriptionFormat = "aksnodepublicip cluster=%s node=%s"
+
+	// NSGTargetAuto adds the rules to the NIC's NSG, or to the subnet's NSG if the NIC has none
+	NSGTargetAuto = "auto"
+	// NSGTargetNIC adds the rules to the NIC's NSG
+	NSGTargetNIC = "nic"
+	// NSGTargetSubnet adds the rules to the subnet's NSG
+	NSGTargetSubnet = "subnet"
+
+	// maxSecurityRulePriority is the max priority Azure allows for an NSG rule
+	maxSecurityRulePriority = 4096
+	// maxPort is the highest TCP or UDP port
+	maxPort = 65535
+)
+
+// nsgLocks serializes the rule writes to each NSG, across all the NSGUpdates of the process. New rules get the first
+// free priority of the NSG, so concurrent writes would pick the same one and ARM would reject the second
+var nsgLocks = struct {
+	lock  sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// lockNSG waits till no other rule write is in progress on the designated NSG, and returns the func that releases it
+func lockNSG(nsgID string) func() {
+	nsgLocks.lock.Lock()
+	l, ok := nsgLocks.locks[strings.ToLower(nsgID)]
+	if !ok {
+		l = &sync.Mutex{}
+		nsgLocks.locks[strings.ToLower(nsgID)] = l
+	}
+	nsgLocks.lock.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// SecurityRule is an inbound allow rule for a port range and a protocol
+type SecurityRule struct {
+	// Protocol is one of tcp, udp or *
+	Protocol string
+	// PortRange is a single port (7777) or a range (7000-8000)
+	PortRange string
+}
+
+// name returns the name of the NSG rule for the designated Node of the designated cluster. The name is unique
+// per cluster and Node, so that the rules of the Nodes of several clusters can share an NSG
+func (r SecurityRule) name(owner, vmName string) string {
+	protocol := r.Protocol
+	if protocol == "*" {
+		protocol = "all"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(owner) + "/" + vmName))
+	return fmt.Sprintf("%s%08x-%s-%s", securityRulePrefix, h.Sum32(), protocol, r.PortRange)
+}
+
+func (r SecurityRule) String() string {
+	return r.Protocol + ":" + r.PortRange
+}
+
+// ParseSecurityRules parses a comma separated list of protocol:portRange pairs, like tcp:7000-8000,udp:7777
+func ParseSecurityRules(s string) ([]SecurityRule, error) {
+	var rules []SecurityRule
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		parts := strings.Split(r, ":")
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid NSG rule %s, expected protocol:portRange", r)
+		}
+		protocol := strings.ToLower(parts[0])
+		if protocol != "tcp" && protocol != "udp" && protocol != "*" {
+			return nil, fmt.Errorf("invalid protocol %s in NSG rule %s, expected tcp, udp or *", parts[0], r)
+		}
+		if err := validatePortRange(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid port range in NSG rule %s: %s", r, err.Error())
+		}
+		rules = append(rules, SecurityRule{Protocol: protocol, PortRange: parts[1]})
+	}
+	return rules, nil
+}
+
+// validatePortRange checks that the port range is a port or a range of ports between 1 and maxPort, like 7777 or 7000-8000
+func validatePortRange(portRange string) error {
+	bounds := strings.Split(portRange, "-")
+	if len(bounds) > 2 {
+		return fmt.Errorf("%s is not a port or a range of ports", portRange)
+	}
+	var ports []int
+	for _, b := range bounds {
+		port, err := strconv.Atoi(b)
+		if err != nil || port < 1 || port > maxPort {
+			return fmt.Errorf("%s is not a port between 1 and %d", b, maxPort)
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) == 2 && ports[0] > ports[1] {
+		return fmt.Errorf("range %s ends before it starts", portRange)
+	}
+	return nil
+}
+
+// NSGUpdater manages the inbound rules that allow traffic to the Nodes' Public IPs
+type NSGUpdater interface {
+	// EnsureSecurityRules makes the rules the only ones of the VM in the NSG of the VM, and returns the NSG's ID
+	EnsureSecurityRules(ctx context.Context, vmName string, rules []SecurityRule) (string, error)
+	// DeleteSecurityRules removes the cluster's rules of the designated VM from the designated NSG,
+	// or all the cluster's rules if vmName is empty
+	DeleteSecurityRules(ctx context.Context, nsgID string, vmName string) error
+}
+
+// NSGUpdate is the ARM backed NSGUpdater. It shares the credentials and the logger of an IPUpdate
+type NSGUpdate struct {
+	*IPUpdate
+	target       string
+	basePriority int32
+}
+
+// NewNSGUpdate returns a new NSGUpdate. target is one of NSGTargetAuto, NSGTargetNIC or NSGTargetSubnet
+// and basePriority is the priority of the first rule the controller creates
+func NewNSGUpdate(ipUpdate *IPUpdate, target string, basePriority int32) *NSGUpdate {
+	return &NSGUpdate{
+		IPUpdate:     ipUpdate,
+		target:       target,
+		basePriority: basePriority,
+	}
+}
+
+// getNSGID returns the ID of the NSG the rules for the VM's NIC should be added to, depending on the target
+func (n *NSGUpdate) getNSGID(ctx context.Context, vmName string, nic *network.Interface) (string, error) {
+	if n.target != NSGTargetSubnet && nic.InterfacePropertiesFormat != nil &&
+		nic.NetworkSecurityGroup != nil && nic.NetworkSecurityGroup.ID != nil {
+		return *nic.NetworkSecurityGroup.ID, nil
+	}
+	if n.target == NSGTargetNIC {
+		return "", fmt.Errorf("NIC of VM %s does not have an NSG", vmName)
+	}
+
+	// the subnet of the IP configuration the Public IP is attached to. The selection is made on a copy,
+	// since it may add the secondary IP configuration to the NIC
+	selectedNIC := *nic
+	if nic.InterfacePropertiesFormat != nil {
+		properties := *nic.InterfacePropertiesFormat
+		selectedNIC.InterfacePropertiesFormat = &properties
+	}
+	i, err := n.ipConfigs.selectIPConfiguration(&selectedNIC)
+	if err != nil {
+		return "", wrapError(err, "cannot select IP configuration for VM %s", vmName)
+	}
+	ipConfig := (*selectedNIC.IPConfigurations)[i]
+	if ipConfig.InterfaceIPConfigurationPropertiesFormat == nil || ipConfig.Subnet == nil || ipConfig.Subnet.ID == nil {
+		return "", fmt.Errorf("cannot find the subnet of VM %s", vmName)
+	}
+	// this will be something like /subscriptions/X/resourceGroups/Y/providers/Microsoft.Network/virtualNetworks/Z/subnets/W
+	subnetID := *ipConfig.Subnet.ID
+	parts := strings.Split(subnetID, "/")
+
+	subnetsClient, err := n.getSubnetsClient(getSubscriptionFromID(subnetID))
+	if err != nil {
+		return "", err
+	}
+	subnet, err := subnetsClient.Get(ctx, getResourceGroupFromID(subnetID), parts[len(parts)-3], parts[len(parts)-1], "")
+	if err != nil {
+		return "", wrapError(err, "cannot get subnet %s", subnetID)
+	}
+	if subnet.SubnetPropertiesFormat == nil || subnet.NetworkSecurityGroup == nil || subnet.NetworkSecurityGroup.ID == nil {
+		return "", fmt.Errorf("subnet %s does not have an NSG", subnetID)
+	}
+	return *subnet.NetworkSecurityGroup.ID, nil
+}
+
+// getSecurityRuleDestinations returns the private addresses of the IP configurations of the NIC that have a Public IP.
+// NSGs filter inbound traffic after the Public IP has been translated to the private address, whether they are
+// associated with the NIC or with its subnet, so the rules only open the ports of this Node
+func getSecurityRuleDestinations(nic *network.Interface) ([]string, error) {
+	var destinations []string
+	if nic.InterfacePropertiesFormat != nil && nic.IPConfigurations != nil {
+		for _, ipConfig := range *nic.IPConfigurations {
+			if ipConfig.InterfaceIPConfigurationPropertiesFormat != nil && ipConfig.PublicIPAddress != nil &&
+				to.String(ipConfig.PrivateIPAddress) != "" {
+				destinations = append(destinations, to.String(ipConfig.PrivateIPAddress))
+			}
+		}
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("NIC %s has no IP configuration with a Public IP and a private address", to.String(nic.Name))
+	}
+	sort.Strings(destinations)
+	return destinations, nil
+}
+
+// isOwnedSecurityRule returns whether the rule was created by the controller of this cluster for the designated VM,
+// or for any of the cluster's VMs if vmName is empty
+func (n *NSGUpdate) isOwnedSecurityRule(r network.SecurityRule, vmName string) bool {
+	if r.SecurityRulePropertiesFormat == nil || !strings.HasPrefix(to.String(r.Name), securityRulePrefix) {
+		return false
+	}
+	description := to.String(r.Description)
+	if vmName == "" {
+		return strings.HasPrefix(description, fmt.Sprintf(securityRuleDescriptionFormat, n.sp.ResourceGroup, ""))
+	}
+	return description == fmt.Sprintf(securityRuleDescriptionFormat, n.sp.ResourceGroup, vmName)
+}
+
+// listSecurityRules returns the rules of the designated NSG
+func (n *NSGUpdate) listSecurityRules(ctx context.Context, rulesClient *network.SecurityRulesClient, resourceGroup, nsgName string) ([]network.SecurityRule, error) {
+	list, err := rulesClient.ListComplete(ctx, resourceGroup, nsgName)
+	if err != nil {
+		return nil, wrapError(err, "cannot list the rules of NSG %s", nsgName)
+	}
+	var rules []network.SecurityRule
+	for list.NotDone() {
+		rules = append(rules, list.Value())
+		if err := list.Next(); err != nil {
+			return nil, wrapError(err, "cannot list the rules of NSG %s", nsgName)
+		}
+	}
+	return rules, nil
+}
+
+// EnsureSecurityRules makes the rules the only inbound allow rules of the VM in the NSG of the VM's NIC or subnet.
+// The rules only allow traffic to the VM's addresses. Rules that already exist keep their priority, new rules get
+// the first free priority after basePriority, and the VM's rules that are not in rules anymore are deleted
+func (n *NSGUpdate) EnsureSecurityRules(ctx context.Context, vmName string, rules []SecurityRule) (string, error) {
+	nic, err := n.getNetworkInterface(ctx, vmName)
+	if err != nil {
+		return "", wrapError(err, "cannot get network interface")
+	}
+	nsgID, err := n.getNSGID(ctx, vmName, nic)
+	if err != nil {
+		return "", err
+	}
+	var destinations []string
+	if len(rules) > 0 {
+		destinations, err = getSecurityRuleDestinations(nic)
+		if err != nil {
+			return "", err
+		}
+	}
+	subscriptionID, resourceGroup, nsgName := getSubscriptionFromID(nsgID), getResourceGroupFromID(nsgID), getResourceName(nsgID)
+
+	rulesClient, err := n.getSecurityRulesClient(subscriptionID)
+	if err != nil {
+		return "", err
+	}
+	unlock := lockNSG(nsgID)
+	defer unlock()
+	existingRules, err := n.listSecurityRules(ctx, rulesClient, resourceGroup, nsgName)
+	if err != nil {
+		return "", err
+	}
+
+	owned := make(map[string]network.SecurityRule)
+	usedPriorities := make(map[int32]bool)
+	for _, r := range existingRules {
+		if n.isOwnedSecurityRule(r, vmName) {
+			owned[to.String(r.Name)] = r
+		}
+		if r.SecurityRulePropertiesFormat != nil && r.Priority != nil && r.Direction == network.SecurityRuleDirectionInbound {
+			usedPriorities[*r.Priority] = true
+		}
+	}
+
+	priority := n.basePriority
+	for _, rule := range rules {
+		name := rule.name(n.sp.ResourceGroup, vmName)
+		existing, ok := owned[name]
+		delete(owned, name)
+		if ok && existing.DestinationAddressPrefixes != nil && strings.Join(*existing.DestinationAddressPrefixes, ",") == strings.Join(destinations, ",") {
+			continue
+		}
+
+		rulePriority := priority
+		if ok && existing.Priority != nil {
+			// the VM's address changed, the rule keeps its priority
+			rulePriority = *existing.Priority
+		} else {
+			for usedPriorities[priority] {
+				priority++
+			}
+			if priority > maxSecurityRulePriority {
+				return "", fmt.Errorf("no free priority left in NSG %s", nsgName)
+			}
+			usedPriorities[priority] = true
+			rulePriority = priority
+		}
+
+		n.log.Infof("Trying to set rule %s with priority %d to %s in NSG %s", name, rulePriority, strings.Join(destinations, ","), nsgName)
+
+		future, err := rulesClient.CreateOrUpdate(ctx, resourceGroup, nsgName, name, network.SecurityRule{
+			Name: to.StringPtr(name),
+			SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
+				Description:                to.StringPtr(fmt.Sprintf(securityRuleDescriptionFormat, n.sp.ResourceGroup, vmName)),
+				Protocol:                   getSecurityRuleProtocol(rule.Protocol),
+				SourcePortRange:            to.StringPtr("*"),
+				DestinationPortRange:       to.StringPtr(rule.PortRange),
+				SourceAddressPrefix:        to.StringPtr("*"),
+				DestinationAddressPrefixes: &destinations,
+				Access:                     network.SecurityRuleAccessAllow,
+				Direction:                  network.SecurityRuleDirectionInbound,
+				Priority:                   to.Int32Ptr(rulePriority),
+			},
+		})
+		if err != nil {
+			return "", wrapError(err, "cannot create rule %s in NSG %s", name, nsgName)
+		}
+		err = future.WaitForCompletion(ctx, rulesClient.Client)
+		if err != nil {
+			return "", wrapError(err, "cannot get rule %s CreateOrUpdate response in NSG %s", name, nsgName)
+		}
+	}
+
+	// the rules that were removed from the Node
+	for name := range owned {
+		if err := n.deleteSecurityRule(ctx, rulesClient, resourceGroup, nsgName, name); err != nil {
+			return "", err
+		}
+	}
+
+	return nsgID, nil
+}
+
+// DeleteSecurityRules removes the rules the controller of this cluster has created for the designated VM,
+// or for all the cluster's VMs if vmName is empty, from the designated NSG
+func (n *NSGUpdate) DeleteSecurityRules(ctx context.Context, nsgID string, vmName string) error {
+	subscriptionID, resourceGroup, nsgName := getSubscriptionFromID(nsgID), getResourceGroupFromID(nsgID), getResourceName(nsgID)
+
+	rulesClient, err := n.getSecurityRulesClient(subscriptionID)
+	if err != nil {
+		return err
+	}
+	unlock := lockNSG(nsgID)
+	defer unlock()
+	rules, err := n.listSecurityRules(ctx, rulesClient, resourceGroup, nsgName)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rules {
+		if !n.isOwnedSecurityRule(r, vmName) {
+			continue
+		}
+		if err := n.deleteSecurityRule(ctx, rulesClient, resourceGroup, nsgName, to.String(r.Name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *NSGUpdate) deleteSecurityRule(ctx context.Context, rulesClient *network.SecurityRulesClient, resourceGroup, nsgName, name string) error {
+	future, err := rulesClient.Delete(ctx, resourceGroup, nsgName, name)
+	if err != nil {
+		return wrapError(err, "cannot delete rule %s from NSG %s", name, nsgName)
+	}
+	err = future.WaitForCompletion(ctx, rulesClient.Client)
+	if err != nil {
+		return wrapError(err, "cannot get rule %s Delete response from NSG %s", name, nsgName)
+	}
+	n.log.Infof("Rule %s successfully deleted from NSG %s", name, nsgName)
+	return nil
+}
+
+func getSecurityRuleProtocol(protocol string) network.SecurityRuleProtocol {
+	switch protocol {
+	case "tcp":
+		return network.SecurityRuleProtocolTCP
+	case "udp":
+		return network.SecurityRuleProtocolUDP
+	default:
+		return network.SecurityRuleProtocolAsterisk
+	}
+}
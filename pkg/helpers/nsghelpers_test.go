@@ -0,0 +1,233 @@
+package helpers
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/fakearm"
+)
+
+func TestParseSecurityRules(t *testing.T) {
+	rules, err := ParseSecurityRules("TCP:7000-8000, udp:7777,*:1")
+	if err != nil {
+		t.Fatalf("error parsing rules: %v", err)
+	}
+	if len(rules) != 3 || rules[0].String() != "tcp:7000-8000" || rules[1].String() != "udp:7777" || rules[2].String() != "*:1" {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+
+	for _, s := range []string{"tcp:0", "tcp:65536", "udp:8000-7000", "tcp:1-2-3", "tcp:http", "tcp:", "icmp:80", "80"} {
+		if _, err := ParseSecurityRules(s); err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestSecurityRules(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	nicID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+
+	nsgID := "/subscriptions/" + testSubscription + "/resourceGroups/" + testResourceGroup + "/providers/Microsoft.Network/networkSecurityGroups/nsg"
+	server.Put(nsgID, fakearm.Resource{"location": testLocation, "properties": map[string]interface{}{}})
+	nic := server.Get(nicID)
+	nic.Properties()["networkSecurityGroup"] = map[string]interface{}{"id": nsgID}
+	server.Put(nicID, nic)
+	// a rule of another cluster sharing the NSG, and a rule the controller created before rules were scoped
+	otherRuleID := nsgID + "/securityRules/aksnodepublicip-0badf00d-tcp-80"
+	server.Put(otherRuleID, fakearm.Resource{"properties": map[string]interface{}{
+		"description": "aksnodepublicip cluster=MC_other node=" + testVMName,
+		"priority":    1000,
+		"direction":   "Inbound",
+	}})
+	legacyRuleID := nsgID + "/securityRules/aksnodepublicip-tcp-80"
+	server.Put(legacyRuleID, fakearm.Resource{"properties": map[string]interface{}{"priority": 1001, "direction": "Inbound"}})
+
+	u := newTestIPUpdate(server, "")
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), ""); err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+	ipConfigs, _ := server.Get(nicID).Properties()["ipConfigurations"].([]interface{})
+	props, _ := ipConfigs[0].(map[string]interface{})["properties"].(map[string]interface{})
+	privateIP, _ := props["privateIPAddress"].(string)
+	if privateIP == "" {
+		t.Fatalf("NIC %s has no private address", nicID)
+	}
+
+	n := NewNSGUpdate(u, NSGTargetNIC, 1000)
+	tcpRule, udpRule := SecurityRule{Protocol: "tcp", PortRange: "7000-8000"}, SecurityRule{Protocol: "udp", PortRange: "7777"}
+	tcpRuleID := nsgID + "/securityRules/" + tcpRule.name(testResourceGroup, testVMName)
+	udpRuleID := nsgID + "/securityRules/" + udpRule.name(testResourceGroup, testVMName)
+
+	got, err := n.EnsureSecurityRules(context.Background(), testVMName, []SecurityRule{tcpRule, udpRule})
+	if err != nil {
+		t.Fatalf("error ensuring rules: %v", err)
+	}
+	if got != nsgID {
+		t.Errorf("expected NSG %s, got %s", nsgID, got)
+	}
+	for _, id := range []string{tcpRuleID, udpRuleID} {
+		rule := server.Get(id)
+		if rule == nil {
+			t.Fatalf("rule %s was not created", id)
+		}
+		destinations, _ := rule.Properties()["destinationAddressPrefixes"].([]interface{})
+		if len(destinations) != 1 || destinations[0] != privateIP {
+			t.Errorf("rule %s has destinations %v, expected %s", id, destinations, privateIP)
+		}
+		if priority, _ := rule.Properties()["priority"].(float64); priority < 1002 {
+			t.Errorf("rule %s has priority %v, which is used by another rule", id, priority)
+		}
+	}
+
+	// the rule that is no longer wanted is deleted
+	if _, err := n.EnsureSecurityRules(context.Background(), testVMName, []SecurityRule{udpRule}); err != nil {
+		t.Fatalf("error ensuring rules: %v", err)
+	}
+	if server.Get(tcpRuleID) != nil {
+		t.Errorf("rule %s was not deleted", tcpRuleID)
+	}
+	if server.Get(udpRuleID) == nil {
+		t.Errorf("rule %s was deleted", udpRuleID)
+	}
+
+	// only the rules of the designated VM are deleted
+	if err := n.DeleteSecurityRules(context.Background(), nsgID, "aks-nodepool1-26427378-1"); err != nil {
+		t.Fatalf("error deleting rules: %v", err)
+	}
+	if server.Get(udpRuleID) == nil {
+		t.Errorf("rule %s of another VM was deleted", udpRuleID)
+	}
+
+	// only the rules of the cluster are deleted
+	if err := n.DeleteSecurityRules(context.Background(), nsgID, ""); err != nil {
+		t.Fatalf("error deleting rules: %v", err)
+	}
+	if server.Get(udpRuleID) != nil {
+		t.Errorf("rule %s was not deleted", udpRuleID)
+	}
+	for _, id := range []string{otherRuleID, legacyRuleID} {
+		if server.Get(id) == nil {
+			t.Errorf("rule %s, that the cluster does not own, was deleted", id)
+		}
+	}
+}
+
+func TestSecurityRulesConcurrentWrites(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	nsgID := "/subscriptions/" + testSubscription + "/resourceGroups/" + testResourceGroup + "/providers/Microsoft.Network/networkSecurityGroups/nsg"
+	server.Put(nsgID, fakearm.Resource{"location": testLocation, "properties": map[string]interface{}{}})
+
+	u := newTestIPUpdate(server, "")
+	vmNames := []string{"aks-nodepool1-26427378-0", "aks-nodepool1-26427378-1", "aks-nodepool1-26427378-2"}
+	for _, vmName := range vmNames {
+		nicID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, vmName)
+		nic := server.Get(nicID)
+		nic.Properties()["networkSecurityGroup"] = map[string]interface{}{"id": nsgID}
+		server.Put(nicID, nic)
+		if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), vmName, GetPublicIPName(vmName), ""); err != nil {
+			t.Fatalf("error creating Public IP: %v", err)
+		}
+	}
+
+	// the Nodes' rules are written at the same time, each must get its own priority
+	n := NewNSGUpdate(u, NSGTargetNIC, 1000)
+	rule := SecurityRule{Protocol: "tcp", PortRange: "7777"}
+	errs := make(chan error, len(vmNames))
+	for _, vmName := range vmNames {
+		go func(vmName string) {
+			_, err := n.EnsureSecurityRules(context.Background(), vmName, []SecurityRule{rule})
+			errs <- err
+		}(vmName)
+	}
+	for range vmNames {
+		if err := <-errs; err != nil {
+			t.Fatalf("error ensuring rules: %v", err)
+		}
+	}
+	priorities := make(map[float64]string)
+	for _, vmName := range vmNames {
+		id := nsgID + "/securityRules/" + rule.name(testResourceGroup, vmName)
+		r := server.Get(id)
+		if r == nil {
+			t.Fatalf("rule %s was not created", id)
+		}
+		priority, _ := r.Properties()["priority"].(float64)
+		if other, ok := priorities[priority]; ok {
+			t.Errorf("rules of %s and %s have the same priority %v", other, vmName, priority)
+		}
+		priorities[priority] = vmName
+	}
+}
+
+func TestSubnetSecurityRules(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	nicID := server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+
+	// the Public IP goes to a second IP configuration, whose subnet has another NSG than the first one's
+	vnetID := "/subscriptions/" + testSubscription + "/resourceGroups/" + testResourceGroup + "/providers/Microsoft.Network/virtualNetworks/vnet"
+	nsgsID := "/subscriptions/" + testSubscription + "/resourceGroups/" + testResourceGroup + "/providers/Microsoft.Network/networkSecurityGroups/"
+	for _, subnet := range []string{"subnet", "public"} {
+		server.Put(nsgsID+subnet+"-nsg", fakearm.Resource{"location": testLocation, "properties": map[string]interface{}{}})
+		server.Put(vnetID+"/subnets/"+subnet, fakearm.Resource{"properties": map[string]interface{}{
+			"networkSecurityGroup": map[string]interface{}{"id": nsgsID + subnet + "-nsg"},
+		}})
+	}
+	nic := server.Get(nicID)
+	ipConfigs, _ := nic.Properties()["ipConfigurations"].([]interface{})
+	nic.Properties()["ipConfigurations"] = append(ipConfigs, map[string]interface{}{
+		"name": "public",
+		"properties": map[string]interface{}{
+			"primary":                   false,
+			"privateIPAllocationMethod": "Dynamic",
+			"subnet":                    map[string]interface{}{"id": vnetID + "/subnets/public"},
+		},
+	})
+	server.Put(nicID, nic)
+
+	u := newTestIPUpdate(server, "")
+	u.SetIPConfigSelector(IPConfigSelector{IPConfigName: regexp.MustCompile(`^public$`)})
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), ""); err != nil {
+		t.Fatalf("error creating Public IP: %v", err)
+	}
+	n := NewNSGUpdate(u, NSGTargetSubnet, 1000)
+	nsgID, err := n.EnsureSecurityRules(context.Background(), testVMName, []SecurityRule{{Protocol: "tcp", PortRange: "80"}})
+	if err != nil {
+		t.Fatalf("error ensuring rules: %v", err)
+	}
+	if nsgID != nsgsID+"public-nsg" {
+		t.Errorf("expected the NSG of the selected IP configuration's subnet, got %s", nsgID)
+	}
+}
+
+func TestSubscriptionClientsAreReused(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	u := newTestIPUpdate(server, "")
+	n := NewNSGUpdate(u, NSGTargetAuto, 1000)
+
+	rulesClient, _ := n.getSecurityRulesClient(testSubscription)
+	if c, _ := n.getSecurityRulesClient(strings.ToUpper(testSubscription)); c != rulesClient {
+		t.Error("expected the security rules client of the Subscription to be reused")
+	}
+	if c, _ := n.getSecurityRulesClient("other"); c == rulesClient {
+		t.Error("expected another Subscription to get its own security rules client")
+	}
+	subnetsClient, _ := n.getSubnetsClient(testSubscription)
+	if c, _ := n.getSubnetsClient(testSubscription); c != subnetsClient {
+		t.Error("expected the subnets client of the Subscription to be reused")
+	}
+	recordSetsClient, _ := u.getRecordSetsClient(testSubscription)
+	if c, _ := NewDNSUpdate(u, DNSZoneDetails{}).getRecordSetsClient(testSubscription); c != recordSetsClient {
+		t.Error("expected the DNS updaters of the IPUpdate to share the record sets client")
+	}
+
+	u.resetClients()
+	if c, _ := n.getSecurityRulesClient(testSubscription); c == rulesClient {
+		t.Error("expected a new security rules client after the clients were reset")
+	}
+}
@@ -10,21 +10,8 @@ import (
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 )
 
-var (
-	armAuthorizer autorest.Authorizer
-)
-
 // GetResourceManagementAuthorizer gets an OAuth token for managing resources using Service Principal credentials
-func GetResourceManagementAuthorizer() (a autorest.Authorizer, err error) {
-	if armAuthorizer != nil {
-		return armAuthorizer, nil
-	}
-
-	config := auth.NewClientCredentialsConfig(spDetails.AadClientID, spDetails.AadClientSecret, spDetails.TenantID)
-	a, err = config.Authorizer()
-
-	if err == nil {
-		armAuthorizer = a
-	}
-	return
+func GetResourceManagementAuthorizer(sp *ServicePrincipalDetails) (autorest.Authorizer, error) {
+	config := auth.NewClientCredentialsConfig(sp.AadClientID, sp.AadClientSecret, sp.TenantID)
+	return config.Authorizer()
 }
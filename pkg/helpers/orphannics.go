@@ -0,0 +1,151 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// VMState is whether a VM still exists, as ARM reports it
+type VMState string
+
+const (
+	// VMExists means the VM exists and is not being deleted
+	VMExists VMState = "Exists"
+	// VMDeleting means ARM is deleting the VM
+	VMDeleting VMState = "Deleting"
+	// VMDeleted means the VM does not exist anymore
+	VMDeleted VMState = "Deleted"
+)
+
+// nicNameRegexp matches the names AKS gives to the NICs of its VMs, e.g. aks-nodepool1-26427378-nic-0 for
+// the VM aks-nodepool1-26427378-0, or aks-nodepool1-26427378-0-nic
+var nicNameRegexp = regexp.MustCompile(`^(aks-.+)-nic-(\d+)$|^(aks-.+)-nic$`)
+
+// GetVMState returns whether the designated VM of the cluster still exists
+func (u *IPUpdate) GetVMState(ctx context.Context, vmName string) (VMState, error) {
+	vmClient, err := u.getVMClient()
+	if err != nil {
+		return "", err
+	}
+	vm, err := vmClient.Get(ctx, u.sp.ResourceGroup, vmName, "")
+	if err != nil {
+		if vm.Response.Response != nil && vm.StatusCode == http.StatusNotFound {
+			return VMDeleted, nil
+		}
+		return "", wrapError(err, "cannot get VM %s", vmName)
+	}
+	if vm.VirtualMachineProperties != nil && strings.EqualFold(to.String(vm.ProvisioningState), string(VMDeleting)) {
+		return VMDeleting, nil
+	}
+	return VMExists, nil
+}
+
+// getVMNameOfNIC returns the name of the VM AKS created the NIC for, or "" if the NIC was not named by AKS
+func getVMNameOfNIC(nicName string) string {
+	m := nicNameRegexp.FindStringSubmatch(nicName)
+	switch {
+	case m == nil:
+		return ""
+	case m[1] != "":
+		return m[1] + "-" + m[2]
+	default:
+		return m[3]
+	}
+}
+
+// ListOrphanedNetworkInterfaces returns the NICs of the cluster's resource group that AKS created for a VM that
+// does not exist anymore. The controller never deletes NICs on its own, this is for an explicit cleanup
+func (u *IPUpdate) ListOrphanedNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	nicClient, err := u.getNicClient()
+	if err != nil {
+		return nil, err
+	}
+	list, err := nicClient.ListComplete(ctx, u.sp.ResourceGroup)
+	if err != nil {
+		return nil, wrapError(err, "cannot list network interfaces")
+	}
+
+	var orphans []NetworkInterface
+	for list.NotDone() {
+		nic := list.Value()
+		if vmName := getVMNameOfNIC(to.String(nic.Name)); vmName != "" && isDetachedNIC(nic) {
+			state, err := u.GetVMState(ctx, vmName)
+			if err != nil {
+				return nil, err
+			}
+			if state == VMDeleted {
+				orphans = append(orphans, NetworkInterface{Name: to.String(nic.Name), ID: to.String(nic.ID), VMName: vmName})
+			}
+		}
+		if err := list.Next(); err != nil {
+			return nil, wrapError(err, "cannot list network interfaces")
+		}
+	}
+	return orphans, nil
+}
+
+// DeleteOrphanedNetworkInterface deletes a NIC returned by ListOrphanedNetworkInterfaces. The ownership checks are
+// repeated right before the delete, so a NIC that was reused in the meantime is left alone
+func (u *IPUpdate) DeleteOrphanedNetworkInterface(ctx context.Context, nicName string) error {
+	vmName := getVMNameOfNIC(nicName)
+	if vmName == "" {
+		return fmt.Errorf("NIC %s was not created by AKS for a VM, not deleting it", nicName)
+	}
+	nicClient, err := u.getNicClient()
+	if err != nil {
+		return err
+	}
+	nic, err := nicClient.Get(ctx, u.sp.ResourceGroup, nicName, "")
+	if err != nil {
+		if nic.Response.Response != nil && nic.StatusCode == http.StatusNotFound {
+			// already deleted
+			return nil
+		}
+		return wrapError(err, "cannot get NIC %s", nicName)
+	}
+	if !isDetachedNIC(nic) {
+		return fmt.Errorf("NIC %s is attached to a VM or has a Public IP, not deleting it", nicName)
+	}
+	state, err := u.GetVMState(ctx, vmName)
+	if err != nil {
+		return err
+	}
+	if state != VMDeleted {
+		return fmt.Errorf("VM %s of NIC %s still exists, not deleting it", vmName, nicName)
+	}
+
+	u.log.Infof("Deleting NIC %s of deleted VM %s", nicName, vmName)
+	future, err := nicClient.Delete(ctx, u.sp.ResourceGroup, nicName)
+	if err != nil {
+		return wrapError(err, "cannot delete NIC %s", nicName)
+	}
+	if err := future.WaitForCompletion(ctx, nicClient.Client); err != nil {
+		return wrapError(err, "cannot get NIC Delete response for NIC %s", nicName)
+	}
+	u.nics.invalidate(vmName)
+	return nil
+}
+
+// isDetachedNIC returns whether the NIC is neither attached to a VM nor has a Public IP
+func isDetachedNIC(nic network.Interface) bool {
+	if nic.InterfacePropertiesFormat == nil {
+		return true
+	}
+	if nic.VirtualMachine != nil && nic.VirtualMachine.ID != nil {
+		return false
+	}
+	if nic.IPConfigurations != nil {
+		for _, ipConfig := range *nic.IPConfigurations {
+			if ipConfig.InterfaceIPConfigurationPropertiesFormat != nil && ipConfig.PublicIPAddress != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package helpers
+
+import (
+	"context"
+
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// publicIPUsageName is the name of the Public IP quota in the Network usage API
+const publicIPUsageName = "PublicIPAddresses"
+
+// PublicIPQuota is the Public IP quota of a subscription in a location
+type PublicIPQuota struct {
+	Limit int64
+	Used  int64
+}
+
+// Remaining returns how many more Public IPs can be created
+func (q PublicIPQuota) Remaining() int64 {
+	if q.Used >= q.Limit {
+		return 0
+	}
+	return q.Limit - q.Used
+}
+
+// GetPublicIPQuota returns the Public IP quota of the subscription of the Public IPs in the cluster's location,
+// from the Network usage API. It returns nil if the API does not report it
+func (u *IPUpdate) GetPublicIPQuota(ctx context.Context) (*PublicIPQuota, error) {
+	usagesClient, err := u.getUsagesClient()
+	if err != nil {
+		return nil, err
+	}
+	list, err := usagesClient.ListComplete(ctx, normalizeLocation(u.sp.Location))
+	if err != nil {
+		return nil, wrapError(err, "cannot list network usages in %s", u.sp.Location)
+	}
+	for list.NotDone() {
+		usage := list.Value()
+		if usage.Name != nil && to.String(usage.Name.Value) == publicIPUsageName {
+			return &PublicIPQuota{Limit: to.Int64(usage.Limit), Used: to.Int64(usage.CurrentValue)}, nil
+		}
+		if err := list.Next(); err != nil {
+			return nil, wrapError(err, "cannot list network usages in %s", u.sp.Location)
+		}
+	}
+	return nil, nil
+}
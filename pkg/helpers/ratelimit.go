@@ -0,0 +1,289 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// ReadRequest is the budget of GET and HEAD requests, including the polling of long-running operations
+	ReadRequest = "read"
+	// WriteRequest is the budget of PUT, PATCH, POST and DELETE requests
+	WriteRequest = "write"
+)
+
+const (
+	// defaultRetryAfter is how long we back off when ARM throttles a request without a Retry-After header,
+	// or reports that no requests are remaining
+	defaultRetryAfter = 30 * time.Second
+	// maxThrottleWait is the longest a request waits for a throttling backoff to end. Requests that would wait longer
+	// fail, so that the worker can move on and the Node is requeued instead
+	maxThrottleWait = 5 * time.Second
+)
+
+// ARMRateLimiter is a token bucket per subscription and request kind, shared by all the ARM clients of the process,
+// as ARM throttles per subscription and principal, not per client.
+// It also backs off a subscription when ARM throttles a request or reports that no requests are remaining
+type ARMRateLimiter struct {
+	readQPS    float64
+	readBurst  int
+	writeQPS   float64
+	writeBurst int
+
+	lock sync.Mutex
+	// limiters are the token buckets, by subscription and request kind
+	limiters map[string]*rate.Limiter
+	// blockedUntil is when the throttling backoff ends, by subscription and request kind
+	blockedUntil map[string]time.Time
+}
+
+// NewARMRateLimiter returns a rate limiter with the designated budgets for each subscription. A QPS <= 0 means no limit
+func NewARMRateLimiter(readQPS float64, readBurst int, writeQPS float64, writeBurst int) *ARMRateLimiter {
+	return &ARMRateLimiter{
+		readQPS:      readQPS,
+		readBurst:    readBurst,
+		writeQPS:     writeQPS,
+		writeBurst:   writeBurst,
+		limiters:     make(map[string]*rate.Limiter),
+		blockedUntil: make(map[string]time.Time),
+	}
+}
+
+// ThrottledError is returned when ARM throttled a request, or instead of sending a request when ARM asked us
+// to back off for longer than maxThrottleWait
+type ThrottledError struct {
+	Kind         string
+	Subscription string
+	RetryAfter   time.Duration
+	// Code is the ARM error code of the throttled response, "" if the request was not sent
+	Code string
+}
+
+func (e *ThrottledError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("ARM throttled a %s request in subscription %s (%s), retry after %s", e.Kind, e.Subscription, e.Code, e.RetryAfter)
+	}
+	return fmt.Sprintf("ARM %s requests in subscription %s are throttled, retry after %s", e.Kind, e.Subscription, e.RetryAfter)
+}
+
+// Timeout is part of net.Error
+func (e *ThrottledError) Timeout() bool {
+	return false
+}
+
+// Temporary is part of net.Error. autorest retries the requests that fail with any other error than a net.Error
+// that is not temporary, so a ThrottledError must be one for the worker to move on
+func (e *ThrottledError) Temporary() bool {
+	return false
+}
+
+// RetryAfter returns how long till the longest throttling backoff of the subscription ends, 0 if ARM is not throttling
+// us there. A nil ARMRateLimiter is never throttled
+func (l *ARMRateLimiter) RetryAfter(subscriptionID string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var longest time.Duration
+	for _, kind := range []string{ReadRequest, WriteRequest} {
+		if d := time.Until(l.blockedUntil[budgetKey(subscriptionID, kind)]); d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// budgetKey is the key of the token bucket and of the backoff of a subscription and request kind
+func budgetKey(subscriptionID, kind string) string {
+	return strings.ToLower(subscriptionID) + "/" + kind
+}
+
+// getLimiter returns the token bucket of the designated budget, and creates it if needed
+func (l *ARMRateLimiter) getLimiter(subscriptionID, kind string) *rate.Limiter {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	key := budgetKey(subscriptionID, kind)
+	limiter, ok := l.limiters[key]
+	if !ok {
+		qps, burst := l.readQPS, l.readBurst
+		if kind == WriteRequest {
+			qps, burst = l.writeQPS, l.writeBurst
+		}
+		if qps <= 0 {
+			limiter = rate.NewLimiter(rate.Inf, 0)
+		} else {
+			if burst < 1 {
+				burst = 1
+			}
+			limiter = rate.NewLimiter(rate.Limit(qps), burst)
+		}
+		l.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// Sender wraps the designated sender, nil for the autorest default, so that every request,
+// including retries and polls, waits for the rate limiter.
+// A throttled response is returned as a ThrottledError, so that autorest does not keep retrying it
+// and the Node is requeued once the backoff is over instead
+func (l *ARMRateLimiter) Sender(next autorest.Sender) autorest.Sender {
+	if next == nil {
+		jar, _ := cookiejar.New(nil)
+		next = &http.Client{Jar: jar}
+	}
+	return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		kind, subscriptionID := requestKind(r), requestSubscription(r)
+		if err := l.wait(r, subscriptionID, kind); err != nil {
+			armRequests.WithLabelValues(kind, "throttled").Inc()
+			return nil, err
+		}
+		resp, err := next.Do(r)
+		backoff := l.observe(subscriptionID, kind, resp, err)
+		if err == nil && resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			return nil, newThrottledError(resp, subscriptionID, kind, backoff)
+		}
+		return resp, err
+	})
+}
+
+// wait blocks till the request can be sent, or returns a ThrottledError
+func (l *ARMRateLimiter) wait(r *http.Request, subscriptionID, kind string) error {
+	l.lock.Lock()
+	backoff := time.Until(l.blockedUntil[budgetKey(subscriptionID, kind)])
+	l.lock.Unlock()
+	if backoff > maxThrottleWait {
+		return &ThrottledError{Kind: kind, Subscription: subscriptionID, RetryAfter: backoff}
+	}
+	if backoff > 0 {
+		select {
+		case <-time.After(backoff):
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+
+	start := time.Now()
+	if err := l.getLimiter(subscriptionID, kind).Wait(r.Context()); err != nil {
+		return err
+	}
+	armRateLimiterWait.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// observe records the response in the metrics, and starts a backoff of the subscription if ARM throttled the request
+// or has no requests remaining for us. It returns the backoff, 0 if there is none
+func (l *ARMRateLimiter) observe(subscriptionID, kind string, resp *http.Response, err error) time.Duration {
+	if err != nil || resp == nil {
+		armRequests.WithLabelValues(kind, "error").Inc()
+		return 0
+	}
+	armRequests.WithLabelValues(kind, strconv.Itoa(resp.StatusCode)).Inc()
+
+	var backoff time.Duration
+	if remaining, ok := rateLimitRemaining(resp, kind); ok {
+		armRateLimitRemaining.WithLabelValues(kind).Set(float64(remaining))
+		if remaining <= 0 {
+			backoff = defaultRetryAfter
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		armThrottled.WithLabelValues(kind).Inc()
+		backoff = defaultRetryAfter
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			backoff = retryAfter
+		}
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	key := budgetKey(subscriptionID, kind)
+	if until := time.Now().Add(backoff); until.After(l.blockedUntil[key]) {
+		l.blockedUntil[key] = until
+	}
+	return backoff
+}
+
+// newThrottledError returns the ThrottledError of a throttled response, with the ARM error code of its body
+func newThrottledError(resp *http.Response, subscriptionID, kind string, backoff time.Duration) *ThrottledError {
+	defer resp.Body.Close()
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	code := "TooManyRequests"
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.Error.Code != "" {
+		code = body.Error.Code
+	}
+	return &ThrottledError{Kind: kind, Subscription: subscriptionID, RetryAfter: backoff, Code: code}
+}
+
+// requestSubscription returns the subscription of the request's URL, "" for requests outside of a subscription
+func requestSubscription(r *http.Request) string {
+	parts := strings.Split(r.URL.Path, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if strings.EqualFold(parts[i], "subscriptions") {
+			return strings.ToLower(parts[i+1])
+		}
+	}
+	return ""
+}
+
+func requestKind(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ReadRequest
+	}
+	return WriteRequest
+}
+
+// rateLimitRemaining returns the lowest x-ms-ratelimit-remaining-* header of the request kind, e.g.
+// x-ms-ratelimit-remaining-subscription-reads or x-ms-ratelimit-remaining-subscription-resource-requests
+func rateLimitRemaining(resp *http.Response, kind string) (int, bool) {
+	var headers []string
+	if kind == ReadRequest {
+		headers = []string{"x-ms-ratelimit-remaining-subscription-reads", "x-ms-ratelimit-remaining-tenant-reads"}
+	} else {
+		headers = []string{"x-ms-ratelimit-remaining-subscription-writes", "x-ms-ratelimit-remaining-tenant-writes",
+			"x-ms-ratelimit-remaining-subscription-deletes"}
+	}
+	headers = append(headers, "x-ms-ratelimit-remaining-subscription-resource-requests")
+
+	lowest, found := 0, false
+	for _, h := range headers {
+		remaining, err := strconv.Atoi(resp.Header.Get(h))
+		if err != nil {
+			continue
+		}
+		if !found || remaining < lowest {
+			lowest, found = remaining, true
+		}
+	}
+	return lowest, found
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
@@ -0,0 +1,96 @@
+package helpers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/fakearm"
+)
+
+func countRequests(server *fakearm.Server, method string) int {
+	var n int
+	for _, r := range server.Requests() {
+		if strings.HasPrefix(r, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestARMRateLimiterRetryAfter(t *testing.T) {
+	server := fakearm.NewServer()
+	defer server.Close()
+	server.AddVirtualMachine(testSubscription, testResourceGroup, testLocation, testVMName)
+
+	limiter := NewARMRateLimiter(0, 0, 0, 0)
+	u := newTestIPUpdate(server, "")
+	u.SetClientOptions(ClientOptions{RetryAttempts: 1})
+	u.SetRateLimiter(limiter)
+
+	fault := fakearm.Throttled(http.MethodPut, "publicIPAddresses", 1)
+	fault.RetryAfter = "60"
+	server.AddFault(fault)
+	if _, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), ""); err == nil {
+		t.Fatal("expected the throttled request to fail")
+	}
+	if d := limiter.RetryAfter(testSubscription); d < 50*time.Second || d > 60*time.Second {
+		t.Errorf("expected to back off for about 60s, got %s", d)
+	}
+
+	// writes are not sent till the backoff is over
+	puts := countRequests(server, http.MethodPut)
+	_, err := u.CreateOrUpdateVMPulicIP(context.Background(), testVMName, GetPublicIPName(testVMName), "")
+	if err == nil || !strings.Contains(err.Error(), "throttled") {
+		t.Errorf("expected a throttling error, got %v", err)
+	}
+	if n := countRequests(server, http.MethodPut); n != puts {
+		t.Errorf("%d write requests were sent during the backoff", n-puts)
+	}
+
+	// reads have their own budget
+	if _, err := u.GetPublicIP(context.Background(), GetPublicIPName(testVMName)); err != nil {
+		t.Errorf("error reading during the write backoff: %v", err)
+	}
+
+	// and so do the other subscriptions
+	if d := limiter.RetryAfter("other"); d != 0 {
+		t.Errorf("expected no backoff in another subscription, got %s", d)
+	}
+	sender := limiter.Sender(autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: r}, nil
+	}))
+	r, _ := http.NewRequest(http.MethodPut, server.URL+"/subscriptions/other/resourceGroups/rg/providers/Microsoft.Network/publicIPAddresses/ip", nil)
+	if _, err := sender.Do(r); err != nil {
+		t.Errorf("error writing to another subscription during the backoff: %v", err)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("x-ms-ratelimit-remaining-subscription-reads", "11999")
+	resp.Header.Set("x-ms-ratelimit-remaining-subscription-writes", "0")
+	resp.Header.Set("x-ms-ratelimit-remaining-subscription-resource-requests", "150")
+
+	if remaining, ok := rateLimitRemaining(resp, ReadRequest); !ok || remaining != 150 {
+		t.Errorf("expected 150 remaining reads, got %d", remaining)
+	}
+	if remaining, ok := rateLimitRemaining(resp, WriteRequest); !ok || remaining != 0 {
+		t.Errorf("expected 0 remaining writes, got %d", remaining)
+	}
+
+	if d, ok := parseRetryAfter("17"); !ok || d != 17*time.Second {
+		t.Errorf("unexpected Retry-After %s", d)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d, ok := parseRetryAfter(date); !ok || d <= 50*time.Second {
+		t.Errorf("unexpected Retry-After %s for %s", d, date)
+	}
+	if _, ok := parseRetryAfter("soon"); ok {
+		t.Error("expected an invalid Retry-After")
+	}
+}
@@ -0,0 +1,175 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// SetSecondaryPublicIPs makes the VM have count secondary Public IPs. Each one is attached to its own secondary
+// IP configuration, named after the Public IP, in the subnet of the IP configuration the ipConfigs selector picks.
+// Secondary Public IPs above count are detached, their IP configurations removed, and deleted
+func (u *IPUpdate) SetSecondaryPublicIPs(ctx context.Context, vmName string, count int) ([]PublicIP, error) {
+	nic, err := u.getNetworkInterface(ctx, vmName)
+	if err != nil {
+		return nil, wrapError(err, "cannot get network interface")
+	}
+
+	// the subnet of the secondary IP configurations
+	selector := u.ipConfigs
+	selector.SecondaryIPConfigName = ""
+	selected, err := selector.selectIPConfiguration(nic)
+	if err != nil {
+		return nil, wrapError(err, "cannot select IP configuration for Node %s", vmName)
+	}
+	primary := (*nic.IPConfigurations)[selected]
+	if primary.InterfaceIPConfigurationPropertiesFormat == nil || primary.Subnet == nil {
+		return nil, fmt.Errorf("IP configuration %s of NIC %s has no subnet", to.String(primary.Name), to.String(nic.Name))
+	}
+
+	existing := make(map[int]bool)
+	var ipConfigs []network.InterfaceIPConfiguration
+	var removed []string
+	for _, ipConfig := range *nic.IPConfigurations {
+		index := getSecondaryPublicIPIndex(vmName, to.String(ipConfig.Name))
+		if index > count {
+			removed = append(removed, to.String(ipConfig.Name))
+			continue
+		}
+		if index > 0 {
+			existing[index] = true
+		}
+		ipConfigs = append(ipConfigs, ipConfig)
+	}
+
+	changed := len(removed) > 0
+	for index := 1; index <= count; index++ {
+		if existing[index] {
+			continue
+		}
+		changed = true
+		ipName := GetSecondaryPublicIPName(vmName, index)
+		u.log.Infof("Trying to create secondary Public IP %s for Node %s", ipName, vmName)
+		ip, err := u.createPublicIP(ctx, ipName, "")
+		if err != nil {
+			return nil, wrapError(err, "cannot create secondary Public IP for Node %s", vmName)
+		}
+		ipConfigs = append(ipConfigs, network.InterfaceIPConfiguration{
+			Name: to.StringPtr(ipName),
+			InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+				Primary:                   to.BoolPtr(false),
+				PrivateIPAllocationMethod: network.Dynamic,
+				PrivateIPAddressVersion:   network.IPv4,
+				Subnet:                    &network.Subnet{ID: primary.Subnet.ID},
+				PublicIPAddress:           &network.PublicIPAddress{ID: ip.ID},
+			},
+		})
+	}
+
+	if changed {
+		nic.IPConfigurations = &ipConfigs
+		if err := u.updateNetworkInterface(ctx, nic); err != nil {
+			u.nics.invalidate(vmName)
+			return nil, wrapError(err, "cannot update NIC for Node %s", vmName)
+		}
+	}
+
+	for _, ipName := range removed {
+		if err := u.DeletePublicIP(ctx, ipName); err != nil {
+			return nil, err
+		}
+	}
+
+	ips := make([]PublicIP, 0, count)
+	for index := 1; index <= count; index++ {
+		ip, err := u.GetPublicIP(ctx, GetSecondaryPublicIPName(vmName, index))
+		if err != nil {
+			return nil, err
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("secondary Public IP %s of Node %s does not exist", GetSecondaryPublicIPName(vmName, index), vmName)
+		}
+		ips = append(ips, *ip)
+	}
+	return ips, nil
+}
+
+// DeleteSecondaryPublicIPs detaches and deletes all the secondary Public IPs of the VM. It does not need the VM,
+// so it also cleans up after a VM that no longer exists
+func (u *IPUpdate) DeleteSecondaryPublicIPs(ctx context.Context, vmName string) error {
+	ips, err := u.ListPublicIPs(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the NICs the secondary Public IPs are still attached to
+	nicIDs := make(map[string]string)
+	var ipNames []string
+	for _, ip := range ips {
+		if GetPublicIPIndex(ip.Name) == 0 || GetNodeNameFromPublicIPName(ip.Name) != vmName {
+			continue
+		}
+		ipNames = append(ipNames, ip.Name)
+		if ip.IPConfigurationID != "" {
+			nicID := ip.IPConfigurationID[:strings.LastIndex(strings.ToLower(ip.IPConfigurationID), "/ipconfigurations/")]
+			nicIDs[strings.ToLower(nicID)] = nicID
+		}
+	}
+
+	nicClient, err := u.getNicClient()
+	if err != nil {
+		return err
+	}
+	for _, nicID := range nicIDs {
+		nic, err := nicClient.Get(ctx, getResourceGroupFromID(nicID), getResourceName(nicID), "")
+		if err != nil {
+			return wrapError(err, "cannot get NIC %s", nicID)
+		}
+		if nic.InterfacePropertiesFormat == nil || nic.IPConfigurations == nil {
+			continue
+		}
+		var ipConfigs []network.InterfaceIPConfiguration
+		for _, ipConfig := range *nic.IPConfigurations {
+			if getSecondaryPublicIPIndex(vmName, to.String(ipConfig.Name)) == 0 {
+				ipConfigs = append(ipConfigs, ipConfig)
+			}
+		}
+		nic.IPConfigurations = &ipConfigs
+		if err := u.updateNetworkInterface(ctx, &nic); err != nil {
+			return wrapError(err, "cannot update NIC %s", nicID)
+		}
+	}
+
+	for _, ipName := range ipNames {
+		if err := u.DeletePublicIP(ctx, ipName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSecondaryPublicIPIndex returns the index of the secondary Public IP of the VM an IP configuration is named after,
+// or 0 if it is not one of the VM's secondary IP configurations
+func getSecondaryPublicIPIndex(vmName, ipConfigName string) int {
+	index := GetPublicIPIndex(ipConfigName)
+	if index == 0 || GetNodeNameFromPublicIPName(ipConfigName) != vmName {
+		return 0
+	}
+	return index
+}
+
+// updateNetworkInterface writes the NIC and waits for the update to complete
+func (u *IPUpdate) updateNetworkInterface(ctx context.Context, nic *network.Interface) error {
+	nicClient, err := u.getNicClient()
+	if err != nil {
+		return err
+	}
+	future, err := nicClient.CreateOrUpdate(ctx, getResourceGroupFromID(*nic.ID), getResourceName(*nic.ID), *nic)
+	if err != nil {
+		return err
+	}
+	return future.WaitForCompletion(ctx, nicClient.Client)
+}
@@ -1,6 +1,7 @@
 package signals
 
 import (
+	"context"
 	"os"
 	"os/signal"
 )
@@ -25,3 +26,14 @@ func SetupSignalHandler() (stopCh <-chan struct{}) {
 
 	return stop
 }
+
+// SetupSignalContext is like SetupSignalHandler, but returns a context that is cancelled on the first signal
+func SetupSignalContext() context.Context {
+	stopCh := SetupSignalHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	return ctx
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	helpers "github.com/dgkanatsios/AksNodePublicIPController/pkg/helpers"
+)
+
+// publicIPQuotaCheckPeriod is how long the Public IP quota reported by ARM is used for, the Public IPs
+// created in the meantime are counted locally
+const publicIPQuotaCheckPeriod = time.Minute
+
+// publicIPQuotaLow is the reason of the Events recorded on the Nodes that don't get a Public IP because of the quota
+const publicIPQuotaLow = "PublicIPQuotaLow"
+
+// quotaState caches the Public IP quota of the cluster's Public IP subscription and location
+type quotaState struct {
+	lock    sync.Mutex
+	quota   *helpers.PublicIPQuota
+	checked time.Time
+}
+
+// refreshPublicIPQuota gets the Public IP quota from ARM, and reports it as a metric
+func (c *NodeController) refreshPublicIPQuota(ctx context.Context) {
+	c.quota.lock.Lock()
+	defer c.quota.lock.Unlock()
+	c.refreshPublicIPQuotaLocked(ctx)
+}
+
+func (c *NodeController) refreshPublicIPQuotaLocked(ctx context.Context) {
+	// a failed check is not retried before the period is over either, so that it does not add to a throttling
+	c.quota.checked = time.Now()
+	quota, err := c.ipUpdater.GetPublicIPQuota(ctx)
+	if err != nil {
+		// the quota check must not prevent the creations, ARM still enforces the quota
+		c.log.Warnf("Cannot get the Public IP quota: %s", err.Error())
+		return
+	}
+	c.quota.quota = quota
+	if quota != nil {
+		publicIPQuotaRemaining.WithLabelValues(c.clusterName).Set(float64(quota.Remaining()))
+	}
+}
+
+// expirePublicIPQuota makes the next reservation read the Public IP quota from ARM again
+func (c *NodeController) expirePublicIPQuota() {
+	c.quota.lock.Lock()
+	defer c.quota.lock.Unlock()
+	c.quota.checked = time.Time{}
+}
+
+// reservePublicIPQuota returns whether count more Public IPs can be created for the Node without the remaining
+// Public IP quota going below the threshold, and counts them as used if so.
+// Otherwise, it records a Warning Event on the Node, and requeues it for when the quota is checked again
+func (c *NodeController) reservePublicIPQuota(ctx context.Context, node *corev1.Node, count int) bool {
+	c.quota.lock.Lock()
+	defer c.quota.lock.Unlock()
+	if time.Since(c.quota.checked) > publicIPQuotaCheckPeriod {
+		c.refreshPublicIPQuotaLocked(ctx)
+	}
+	if c.quota.quota == nil {
+		// ARM does not report it
+		return true
+	}
+
+	remaining := c.quota.quota.Remaining()
+	if remaining-int64(count) < int64(c.publicIPQuotaThreshold) {
+		message := fmt.Sprintf("Not creating %d Public IP(s) for Node %s: %d remaining in the Public IP quota of the subscription, the threshold is %d",
+			count, node.Name, remaining, c.publicIPQuotaThreshold)
+		c.log.Warn(message)
+		publicIPQuotaRefusals.WithLabelValues(c.clusterName).Inc()
+		if c.plan == nil {
+			c.recorder.Event(node, corev1.EventTypeWarning, publicIPQuotaLow, message)
+		}
+		c.workqueue.AddAfter(node.Name, publicIPQuotaCheckPeriod)
+		return false
+	}
+	c.quota.quota.Used += int64(count)
+	publicIPQuotaRemaining.WithLabelValues(c.clusterName).Set(float64(c.quota.quota.Remaining()))
+	return true
+}
+
+// releasePublicIPQuota no longer counts as used count Public IPs that reservePublicIPQuota reserved, and whose creation failed
+func (c *NodeController) releasePublicIPQuota(count int) {
+	c.quota.lock.Lock()
+	defer c.quota.lock.Unlock()
+	if c.quota.quota == nil {
+		return
+	}
+	// the quota may have been checked again since, then ARM did not count them either
+	c.quota.quota.Used -= int64(count)
+	if c.quota.quota.Used < 0 {
+		c.quota.quota.Used = 0
+	}
+	publicIPQuotaRemaining.WithLabelValues(c.clusterName).Set(float64(c.quota.quota.Remaining()))
+}
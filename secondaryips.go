@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/dgkanatsios/AksNodePublicIPController/pkg/annotations"
+)
+
+const (
+	publicIPCountAnnotation = annotations.PublicIPCount
+	publicIPsAnnotation     = annotations.PublicIPs
+
+	successSettingPublicIPs = "SuccessSettingPublicIPs"
+	errorSettingPublicIPs   = "ErrorSettingPublicIPs"
+)
+
+// secondaryPublicIPsEnabled returns whether Nodes may have more than one Public IP
+func (c *NodeController) secondaryPublicIPsEnabled() bool {
+	return c.maxPublicIPsPerNode > 1
+}
+
+// getPublicIPCount returns the number of Public IPs the Node should have
+func (c *NodeController) getPublicIPCount(node *corev1.Node) (int, error) {
+	value, ok := node.Annotations[publicIPCountAnnotation]
+	if !ok {
+		return c.defaultPublicIPsPerNode, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 || count > c.maxPublicIPsPerNode {
+		return 0, fmt.Errorf("invalid %s annotation %q, it must be between 1 and %d", publicIPCountAnnotation, value, c.maxPublicIPsPerNode)
+	}
+	return count, nil
+}
+
+// ensureSecondaryPublicIPs reconciles the secondary Public IPs of a Node that has a Public IP with the requested count.
+// The addresses are kept in an annotation on the Node, so we don't call ARM on every sync
+func (c *NodeController) ensureSecondaryPublicIPs(ctx context.Context, node *corev1.Node) error {
+	count, err := c.getPublicIPCount(node)
+	if err != nil {
+		// requeueing does not help till the annotation is fixed
+		c.recorder.Event(node, corev1.EventTypeWarning, errorSettingPublicIPs, err.Error())
+		return nil
+	}
+	applied, ok := node.Annotations[publicIPsAnnotation]
+	if !ok && count == 1 || ok && len(strings.Split(applied, ",")) == count {
+		return nil
+	}
+
+	done, err := c.startARMOperation(ctx, node.Name, operationCreate)
+	if err != nil {
+		return err
+	}
+	defer done()
+	existing := 0
+	if ok {
+		existing = len(strings.Split(applied, ",")) - 1
+	}
+	reserved := 0
+	if count-1 > existing {
+		reserved = count - 1 - existing
+		if !c.reservePublicIPQuota(ctx, node, reserved) {
+			// the Node is requeued for when the quota is checked again
+			return nil
+		}
+	}
+	c.log.Infof("Node %s should have %d Public IPs, trying to set its secondary Public IPs", node.Name, count)
+	ips, err := c.ipUpdater.SetSecondaryPublicIPs(ctx, node.Name, count-1)
+	if err != nil {
+		if reserved > 0 {
+			c.releasePublicIPQuota(reserved)
+		}
+		c.recorder.Event(node, corev1.EventTypeWarning, errorSettingPublicIPs, err.Error())
+		return err
+	}
+
+	var addresses []string
+	for _, x := range node.Status.Addresses {
+		if x.Type == corev1.NodeExternalIP {
+			addresses = append(addresses, x.Address)
+			break
+		}
+	}
+	for _, ip := range ips {
+		addresses = append(addresses, ip.Address)
+	}
+	if err := c.setAnnotationToNode(node.Name, publicIPsAnnotation, strings.Join(addresses, ",")); err != nil {
+		return err
+	}
+	if c.plan == nil {
+		c.recorder.Event(node, corev1.EventTypeNormal, successSettingPublicIPs, fmt.Sprintf("Node %s has %d Public IPs", node.Name, count))
+	}
+	return nil
+}